@@ -4,60 +4,383 @@
 package btree
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
+	"runtime"
+	"time"
+	"unsafe"
 
 	"github.com/avisagie/indexes"
 )
 
-// B+ Tree. Consists of pages. Satisfies indexes.Index.
+// Value reference of a deleted key in a leaf.
+const tombstone = -1
+
+// Wrapped in the OpError of PutE and AppendE, and the panic of the
+// other puts, for values longer than Options.MaxValueSize.
+var ErrValueTooLarge = errors.New("Value too large")
+
+// The longest key the tree accepts. A quarter of a page, so that
+// pages always hold several keys and splits always make room.
+const MaxKeySize = pageSize / 4
+
+// Wrapped in the OpError of the E variants, and the panic of the
+// other puts, for keys longer than MaxKeySize.
+var ErrKeyTooLong = errors.New("Key too long")
+
+// Returned by ValidateKey, and wrapped in the OpError of the E
+// variants, for nil and empty keys, which the other operations panic
+// on.
+var ErrEmptyKey = errors.New("Empty key")
+
+// The error the E variants return, with the operation and the key it
+// failed on, e.g. to log the key that aborted a bulk load. Err is
+// ErrEmptyKey, ErrKeyTooLong or ErrValueTooLarge, for errors.Is.
+type OpError struct {
+	Op  string
+	Key []byte
+	Err error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("%s %q: %v", e.Op, e.Key, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// An OpError for err with a copy of key, nil if err is nil.
+func opError(op string, key []byte, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &OpError{Op: op, Key: copyBytes(key), Err: err}
+}
+
+// B+ Tree. Consists of pages. Satisfies indexes.Index. Not safe for
+// concurrent use, not even by concurrent readers: searches share a
+// scratch slice.
 type Btree struct {
 	pager  Pager
-	values [][]byte
+	values valueLog
 	root   int
 	size   int64
+
+	// sum of the lengths of all values in the value log
+	valueBytes int64
+
+	// number of deleted keys still in the leaves
+	tombstones int64
+
+	// sum of the lengths of values that were overwritten or
+	// deleted since the tree was built or last swept
+	deadValueBytes int64
+
+	// scratch space for the pageRefs visited by search. Only valid
+	// until the next search.
+	pageRefs []int
+
+	// finds and comparisons broken down by operation
+	opStats [numOps]OpStats
+
+	// the expiries of the keys put with PutWithTTL, nil until there
+	// are any
+	expiries map[string]int64
+
+	// number of page splits, new roots and keys moved to a sibling
+	// leaf since the tree was built or last swept
+	splits, rootPromotions, rotations int64
+
+	opts Options
+
+	// With AllowDuplicates, the refs of the second and further
+	// values of a key, by the ref in its leaf.
+	dups map[int][]int
+
+	// counts changes, so iterators can tell the tree changed
+	// under them
+	mods uint64
+
+	// Options.Observer if it is a TimingObserver
+	timer TimingObserver
+
+	// the path to the last leaf PutNext found, while mods is still
+	// tailMods
+	tail     []int
+	tailMods uint64
+
+	// With Options.Versioned, every value each key had, by the key,
+	// and the sequence number of the last write
+	versions map[string][]version
+	seq      uint64
+
+	// With Options.CacheLastLeaf, the leaf Get found its last key
+	// in, or -1, and how often Get could use it
+	lastLeaf                       int
+	leafCacheHits, leafCacheMisses int64
 }
 
+// Operations that BtreeStats breaks finds and comparisons down by.
+const (
+	opGet = iota
+	opPut
+	opStart
+	numOps
+)
+
 type btreeIter struct {
 	prefix   []byte
 	pageIter PageIter
 	page     Page
 	b        *Btree
 	done     bool
+
+	// the tree's mods when the iterator started
+	mods uint64
+
+	// the key Next returned last and how many of its values, for
+	// Token
+	last  []byte
+	lastN int
+
+	// duplicate values still to return for dupKey
+	dupKey []byte
+	dups   []int
+
+	// yield tombstones too, with ref tombstone
+	tombstones bool
+
+	// yield keys that expired too, for counts that must agree with
+	// Size
+	expired bool
+
+	// the error the pager failed to read the next page with
+	err error
+
+	// where the iteration started, the values returned since, and
+	// the estimated number from there to the end, see Remaining.
+	// total is -1 until Remaining estimates it.
+	from           []byte
+	yielded, total int64
 }
 
 func (i *btreeIter) Next() (ok bool, key []byte, value []byte) {
-	if i.done {
-		return
+	ok, key, ref := i.nextRef()
+	if ok {
+		value = i.b.readValue(key, ref)
 	}
+	return
+}
 
-	ok, key, ref := i.pageIter.Next()
-	if ok {
-		return ok, key, i.b.values[ref]
+// Next, but return the value's ref instead of the value.
+func (i *btreeIter) nextRef() (ok bool, key []byte, ref int) {
+	if i.mods != i.b.mods && !i.b.opts.UncheckedIteration {
+		panic("concurrent modification")
 	}
 
-	// !ok can mean we're done iterating or that we're at the end
-	// of this page. TODO ponder another return value that
-	// signifies being done iterating explicitly.
+	if len(i.dups) > 0 {
+		ref, i.dups = i.dups[0], i.dups[1:]
+		i.lastN++
+		i.yielded++
+		return true, i.dupKey, ref
+	}
 
-	n := i.page.NextPage()
-	if n == -1 {
-		i.done = true
-		return
+	fresh := false
+	for !i.done && i.err == nil {
+		ok, key, ref := i.pageIter.Next()
+		if ok {
+			fresh = false
+			if ref == tombstone && !i.tombstones || ref != tombstone && !i.expired && i.b.expired(key) {
+				continue
+			}
+			if i.b.dups != nil {
+				i.dupKey, i.dups = key, i.b.dups[ref]
+			}
+			i.last, i.lastN = key, 1
+			i.yielded++
+			return ok, key, ref
+		}
+
+		// !ok can mean we're done iterating or that we're at the
+		// end of this page. A page we just started on that has
+		// nothing for us means we're done. TODO ponder another
+		// return value that signifies being done iterating
+		// explicitly.
+		if fresh {
+			i.done = true
+			break
+		}
+
+		n := i.page.NextPage()
+		if n == -1 {
+			i.done = true
+			break
+		}
+
+		page, err := i.b.tryGet(n)
+		if err != nil {
+			i.err = err
+			break
+		}
+		i.page = page
+		i.startPage()
+		fresh = true
 	}
+	return false, nil, -1
+}
 
-	i.page = i.b.pager.Get(n)
-	i.pageIter = i.page.Start(i.prefix)
-	ok, key, ref = i.pageIter.Next()
-	if !ok {
-		i.done = true
+func (i *btreeIter) Done() bool {
+	return i.done
+}
+
+// An iterator that stops early when the pager fails to read a page,
+// like the ones Start returns. Next then returns false with Done still
+// false, and Err returns the error. Pages read before the first Next,
+// while the iterator starts, fail with the pager's panic.
+type ErrIter interface {
+	indexes.Iter
+	Err() error
+}
+
+// The error that stopped the iteration, nil if none did.
+func (i *btreeIter) Err() error {
+	return i.err
+}
+
+// The Err of it, nil if it is not an ErrIter.
+func iterErr(it indexes.Iter) error {
+	if e, ok := it.(ErrIter); ok {
+		return e.Err()
+	}
+	return nil
+}
+
+// Get page ref, returning the error the pager panics with if it fails
+// to read the page.
+func (b *Btree) tryGet(ref int) (page Page, err error) {
+	defer readError(&err)
+	return b.pager.Get(ref), nil
+}
+
+// The leaf where key goes, searching with pageRefs, or the error the
+// pager panics with if it fails to read a page on the way down.
+func (b *Btree) tryLeaf(key []byte, pageRefs *[]int) (page Page, err error) {
+	defer readError(&err)
+	_, _, *pageRefs = b.searchInto(key, (*pageRefs)[:0])
+	return b.pager.Get((*pageRefs)[len(*pageRefs)-1]), nil
+}
+
+// Deferred, turns the error a pager panics with into err. Other
+// panics, runtime errors among them, go on.
+func readError(err *error) {
+	if r := recover(); r != nil {
+		e, isErr := r.(error)
+		if _, isRuntime := r.(runtime.Error); !isErr || isRuntime {
+			panic(r)
+		}
+		*err = e
+	}
+}
+
+// An iterator that can estimate how many values it has left to
+// return, like the ones Start returns.
+type RemainingIter interface {
+	indexes.Iter
+	Remaining() int64
+}
+
+// A rough estimate of the number of values Next has left to return,
+// for progress bars. It assumes the values are spread evenly over the
+// pages, see EstimateRank, so it can be off by a lot on trees with
+// many tombstones, duplicates or expired keys. Never negative, and 0 once Next has
+// returned false.
+func (i *btreeIter) Remaining() int64 {
+	if i.done || i.err != nil {
+		return 0
+	}
+	if i.total < 0 {
+		end := prefixEnd(i.prefix)
+		i.total = i.b.Size()
+		if end != nil {
+			i.total = i.b.EstimateRank(end)
+		}
+		i.total -= i.b.EstimateRank(i.from)
+	}
+	return max(i.total-i.yielded, 0)
+}
+
+// Start iterating over the current page, reusing the page iterator
+// if the page supports it.
+func (i *btreeIter) startPage() {
+	if r, ok := i.pageIter.(resettablePageIter); ok && r.reset(i.page, i.prefix) {
 		return
 	}
-	return ok, key, i.b.values[ref]
+	i.pageIter = i.page.Start(i.prefix)
+}
+
+// An iterator that can be reset by StartReuse to scan again without
+// allocating. The zero value is ready to use.
+type ReusableIter struct {
+	btreeIter
+	pageRefs []int
 }
 
 func NewInMemoryBtree() indexes.Index {
-	ret := &Btree{newInplacePager(), make([][]byte, 0), 0, 0}
+	return NewBtreeWithOptions(Options{})
+}
+
+func NewInMemoryBtreeWithOptions(opts Options) indexes.Index {
+	return NewBtreeWithOptions(opts)
+}
+
+// Like NewInMemoryBtree, but returns the *Btree itself, for the methods
+// indexes.Index does not have.
+func NewBtree() *Btree {
+	return NewBtreeWithOptions(Options{})
+}
+
+// Like NewInMemoryBtreeWithOptions, but returns the *Btree itself.
+func NewBtreeWithOptions(opts Options) *Btree {
+	if opts.KeysPerPage != 0 && opts.KeysPerPage < MinKeysPerPage {
+		panic(fmt.Sprint("KeysPerPage must be at least ", MinKeysPerPage, ", got ", opts.KeysPerPage))
+	}
+
+	pager := newInplacePager()
+	pager.leafFormat = opts.LeafFormat
+	pager.keysPerPage = opts.KeysPerPage
+	return NewWithPagerAndOptions(pager, opts)
+}
+
+// A tree that keeps its pages in p, for pagers other than the
+// in-memory one. p must be new, see Pager for what it must do.
+func NewWithPager(p Pager) *Btree {
+	return NewWithPagerAndOptions(p, Options{})
+}
+
+// Like NewWithPager, with options. LeafFormat and KeysPerPage are up
+// to the pager and are ignored.
+func NewWithPagerAndOptions(p Pager, opts Options) *Btree {
+	if opts.VerifyReads {
+		p = verifyingPager{p}
+	}
+	ret := &Btree{
+		pager:    p,
+		values:   newValueLog(opts.ValueSegmentSize, opts.ExpectedEntries),
+		pageRefs: make([]int, 0, 8),
+		opts:     opts,
+		lastLeaf: -1,
+	}
+	ret.timer, _ = opts.Observer.(TimingObserver)
+	if opts.AllowDuplicates {
+		ret.dups = make(map[int][]int)
+	} else if opts.Versioned {
+		ret.versions = make(map[string][]version)
+	}
 
 	ref, root := ret.pager.New(false)
 	ret.root = ref
@@ -68,8 +391,22 @@ func NewInMemoryBtree() indexes.Index {
 	return ret
 }
 
+// A tree whose pages hold at most keysPerPage keys, so that tests
+// can make it split with a handful of keys.
+func NewTestBtree(keysPerPage int) *Btree {
+	return NewBtreeWithOptions(Options{KeysPerPage: keysPerPage})
+}
+
+// Search down the tree for key. The returned pageRefs are only valid
+// until the next call to search.
 func (b *Btree) search(key []byte) (ok bool, k Key, pageRefs []int) {
-	pageRefs = make([]int, 0, 8)
+	ok, k, pageRefs = b.searchInto(key, b.pageRefs[:0])
+	b.pageRefs = pageRefs
+	return
+}
+
+// search, appending the pageRefs visited to the given slice.
+func (b *Btree) searchInto(key []byte, pageRefs []int) (ok bool, k Key, _ []int) {
 	ref := b.root
 
 	// keep track of the pageRefs we visit searching down the
@@ -81,191 +418,1208 @@ func (b *Btree) search(key []byte) (ok bool, k Key, pageRefs []int) {
 		ok, k = p.Search(key)
 		ref = k.Ref()
 
-		// if it is a leaf, we're done
-		if p.IsLeaf() {
-			break
-		}
+		// if it is a leaf, we're done
+		if p.IsLeaf() {
+			break
+		}
+
+		pageRefs = append(pageRefs, ref)
+	}
+
+	return ok, k, pageRefs
+}
+
+func (b *Btree) Get(key []byte) (ok bool, value []byte) {
+	if key == nil || len(key) == 0 {
+		panic("Illegal key nil")
+	}
+
+	start := b.startTimer()
+	finds, comparisons := b.pager.Counters()
+
+	var k Key
+	if b.opts.CacheLastLeaf {
+		ok, k = b.searchCached(key)
+	} else {
+		ok, k, _ = b.search(key)
+	}
+	if ok && (k.Ref() == tombstone || b.expired(key)) {
+		ok = false
+	}
+	if ok {
+		value = b.readValue(k.Get(), k.Ref())
+	}
+	if b.opts.Observer != nil {
+		b.opts.Observer.OnGet(ok)
+	}
+	if b.timer != nil {
+		b.timer.OnGetDone(time.Since(start), ok)
+	}
+
+	b.countOp(opGet, finds, comparisons)
+	return
+}
+
+// search, but look in the last leaf first if key is within the keys
+// it holds. Leaves never share a range of keys, so the leaf is the
+// one a search from the root would find.
+func (b *Btree) searchCached(key []byte) (ok bool, k Key) {
+	if b.lastLeaf != -1 {
+		page := b.pager.Get(b.lastLeaf)
+		if n := page.Size(); n > 0 {
+			first, _ := page.GetKey(0)
+			last, _ := page.GetKey(n - 1)
+			if !keyLess(key, first) && !keyLess(last, key) {
+				b.leafCacheHits++
+				return page.Search(key)
+			}
+		}
+	}
+
+	b.leafCacheMisses++
+	ok, k, pageRefs := b.search(key)
+	b.lastLeaf = pageRefs[len(pageRefs)-1]
+	return
+}
+
+// Iterate over the keys that start with prefix. A nil prefix, like
+// an empty one, iterates over the whole tree.
+func (b *Btree) Start(prefix []byte) (it indexes.Iter) {
+	if prefix == nil {
+		prefix = []byte{}
+	}
+
+	finds, comparisons := b.pager.Counters()
+
+	page, err := b.tryLeaf(prefix, &b.pageRefs)
+	i := &btreeIter{prefix: prefix, page: page, err: err, b: b, mods: b.mods, from: prefix, total: -1}
+	if err == nil {
+		i.pageIter = page.Start(prefix)
+	}
+	it = i
+	if b.opts.Observer != nil {
+		b.opts.Observer.OnIterStart()
+	}
+
+	b.countOp(opStart, finds, comparisons)
+	return
+}
+
+// Like Start(nil), for use with range: for k, v := range b.All().
+func (b *Btree) All() func(yield func(key, value []byte) bool) {
+	return b.Prefix(nil)
+}
+
+// Like Start(prefix), for use with range. Breaking out of the loop
+// stops the iteration.
+func (b *Btree) Prefix(prefix []byte) func(yield func(key, value []byte) bool) {
+	return func(yield func(key, value []byte) bool) {
+		it := b.Start(prefix)
+		for {
+			ok, k, v := it.Next()
+			if !ok || !yield(k, v) {
+				return
+			}
+		}
+	}
+}
+
+// Iterate over all keys greater than or equal to key.
+func (b *Btree) seek(key []byte) *btreeIter {
+	page, err := b.tryLeaf(key, &b.pageRefs)
+	it := &btreeIter{prefix: nilBytes, page: page, err: err, b: b, mods: b.mods, from: key, total: -1}
+	if err == nil {
+		it.pageIter = page.Seek(key)
+	}
+	return it
+}
+
+// Iterates over keys and the lengths of their values.
+type SizeIter interface {
+	// like indexes.Iter, but returns the length of the value
+	// instead of the value. valueLen is 0 when done.
+	Next() (ok bool, key []byte, valueLen int)
+}
+
+type sizeIter struct {
+	it *btreeIter
+}
+
+func (i sizeIter) Next() (ok bool, key []byte, valueLen int) {
+	ok, key, ref := i.it.nextRef()
+	if ok {
+		valueLen = i.it.b.valueLen(ref)
+	}
+	return
+}
+
+// Like Start, but iterates over the lengths of the values without
+// reading or reassembling the values themselves.
+func (b *Btree) StartSizes(prefix []byte) SizeIter {
+	return sizeIter{b.Start(prefix).(*btreeIter)}
+}
+
+type filterIter struct {
+	it   indexes.Iter
+	pred func(key, value []byte) bool
+}
+
+func (i filterIter) Next() (ok bool, key []byte, value []byte) {
+	for {
+		ok, key, value = i.it.Next()
+		if !ok || i.pred(key, value) {
+			return
+		}
+	}
+}
+
+func (i filterIter) Done() bool {
+	return i.it.Done()
+}
+
+func (i filterIter) Err() error {
+	return iterErr(i.it)
+}
+
+// Like Start, but only yields the keys and values pred returns true
+// for. pred sees every key and value with the prefix, so this reads
+// as many pages as Start does.
+func (b *Btree) StartFilter(prefix []byte, pred func(key, value []byte) bool) indexes.Iter {
+	return filterIter{b.Start(prefix), pred}
+}
+
+// Iterates over keys and values, flagging values equal to the one
+// before.
+type DedupIter interface {
+	// like indexes.Iter, but sameAsPrev tells whether value is
+	// equal to the value Next returned before.
+	Next() (ok bool, key []byte, value []byte, sameAsPrev bool)
+}
+
+type dedupIter struct {
+	it   *btreeIter
+	prev []byte
+	any  bool
+}
+
+func (i *dedupIter) Next() (ok bool, key []byte, value []byte, sameAsPrev bool) {
+	ok, key, value = i.it.Next()
+	if ok {
+		sameAsPrev = i.any && bytes.Equal(i.prev, value)
+		i.prev, i.any = value, true
+	}
+	return
+}
+
+// Like Start, but flags each value that is equal to the one before
+// it. Values come in key order, and the values of a duplicate key in
+// the order they were put, so sameAsPrev marks runs of neighbouring
+// keys with the same value. The previous value is not copied: values
+// stay valid until the tree is modified, which the iterator does not
+// allow anyway.
+func (b *Btree) StartDedupValues(prefix []byte) DedupIter {
+	return &dedupIter{it: b.Start(prefix).(*btreeIter)}
+}
+
+// Iterates over keys and values, and the keys that were deleted.
+type TombstoneIter interface {
+	// like indexes.Iter, but deleted tells whether key was
+	// deleted, in which case value is nil.
+	Next() (ok bool, key []byte, value []byte, deleted bool)
+}
+
+type tombstoneIter struct {
+	it *btreeIter
+}
+
+func (i tombstoneIter) Next() (ok bool, key []byte, value []byte, deleted bool) {
+	ok, key, ref := i.it.nextRef()
+	if !ok {
+		return false, nil, nil, false
+	}
+	if ref == tombstone {
+		return true, key, nil, true
+	}
+	return true, key, i.it.b.readValue(key, ref), false
+}
+
+// Like Start, but also yields the keys that were deleted, flagged as
+// such. Delete leaves a tombstone in the key's leaf, which stays there
+// until the key is put again or Sweep or Rebuild removes it, so a
+// consumer can replicate deletes by scanning with this before calling
+// Sweep. Get, Start and everything else skip tombstones.
+func (b *Btree) StartWithTombstones(prefix []byte) TombstoneIter {
+	it := b.Start(prefix).(*btreeIter)
+	it.tombstones = true
+	return tombstoneIter{it}
+}
+
+// Like Start, but resets and reuses the caller's iterator and its
+// internal slices instead of allocating new ones. Use it in hot
+// loops doing many short scans.
+func (b *Btree) StartReuse(prefix []byte, it *ReusableIter) {
+	if prefix == nil {
+		prefix = []byte{}
+	}
+
+	it.prefix = prefix
+	it.page, it.err = b.tryLeaf(prefix, &it.pageRefs)
+	it.b = b
+	it.done = false
+	it.mods = b.mods
+	it.last, it.lastN = nil, 0
+	it.dupKey, it.dups = nil, nil
+	it.from, it.yielded, it.total = prefix, 0, -1
+	if it.err == nil {
+		it.startPage()
+	}
+	if b.opts.Observer != nil {
+		b.opts.Observer.OnIterStart()
+	}
+}
+
+// Split the last of pageRefs to make room for key, then insert it
+// with ref, and value if that is inline.
+func (b *Btree) split(key []byte, ref int, value []byte, pageRefs []int) {
+	if b.opts.RotateToSiblings && b.pager.Get(pageRefs[len(pageRefs)-1]).IsLeaf() {
+		var done bool
+		if done, pageRefs = b.rotate(key, ref, value, pageRefs); done {
+			return
+		}
+	}
+
+	if b.timer != nil {
+		start := time.Now()
+		defer func() { b.timer.OnSplitDone(time.Since(start)) }()
+	}
+
+	pageRef := pageRefs[len(pageRefs)-1]
+	page := b.pager.Get(pageRef)
+
+	parentRef := pageRefs[len(pageRefs)-2]
+	parent := b.pager.Get(parentRef)
+
+	// Split the page
+	newPageRef, newPage := b.pager.New(page.IsLeaf())
+	policy := SplitMiddle
+	if b.opts.Split == SplitRight {
+		if last, _ := page.GetKey(page.Size() - 1); keyLess(last, key) {
+			policy = SplitRight
+		}
+	}
+	splitKey := page.Split(newPageRef, newPage, policy)
+	b.splits++
+	if b.opts.OnSplit != nil {
+		b.opts.OnSplit(splitKey, page.IsLeaf())
+	}
+	if b.opts.Observer != nil {
+		b.opts.Observer.OnSplit()
+	}
+
+	if n := page.NextPage(); n != -1 {
+		b.pager.Get(n).SetPrevPage(newPageRef)
+	}
+	newPage.SetNextPage(page.NextPage())
+	newPage.SetPrevPage(pageRef)
+	page.SetNextPage(newPageRef)
+
+	// Insert the key, decide in which of the resulting pages it
+	// must go. After a split there must be space, unless the key
+	// does not fit in a page at all, and splitting again would
+	// never end.
+	target := newPage
+	if keyLess(key, splitKey) {
+		target = page
+	}
+	if !b.insert(target, key, ref, value) {
+		panic(fmt.Sprintf("No room for a key of %d bytes in a page of %d keys after splitting", len(key), target.Size()))
+	}
+
+	ok := parent.Insert(splitKey, newPageRef)
+	if !ok {
+		if parentRef == b.root {
+			if len(pageRefs) != 2 {
+				panic("insane")
+			}
+			oldRootRef := b.root
+			newRootRef, newRoot := b.pager.New(false)
+			newRoot.SetFirst(oldRootRef)
+			b.root = newRootRef
+			b.rootPromotions++
+			b.split(splitKey, newPageRef, nil, []int{newRootRef, parentRef})
+		} else {
+			b.split(splitKey, newPageRef, nil, pageRefs[:len(pageRefs)-1])
+		}
+	}
+}
+
+// Make room for key in the full leaf at the end of pageRefs by moving
+// its last key to the leaf after it, or its first key to the one
+// before it, if that leaf has the same parent and room for it. The
+// parent's key for the leaf on the right of the two becomes that
+// leaf's new first key. Returns true if key went in, otherwise the
+// pageRefs of the leaf that has to split to take it, which is a
+// sibling if the moved key made key belong there.
+func (b *Btree) rotate(key []byte, ref int, value []byte, pageRefs []int) (done bool, _ []int) {
+	leafRef := pageRefs[len(pageRefs)-1]
+	leaf := b.pager.Get(leafRef)
+	parent := b.pager.Get(pageRefs[len(pageRefs)-2])
+	if leaf.Size() < 2 {
+		return false, pageRefs
+	}
+	pos := childPos(parent, leafRef)
+
+	// the position in parent of the leaf on the right of the two
+	moved := -1
+	if pos+1 < parent.Size() {
+		_, sibRef := parent.GetKey(pos + 1)
+		sib := b.pager.Get(sibRef)
+		k, r, v := b.leafEntry(leaf, leaf.Size()-1)
+		if b.insert(sib, k, r, v) {
+			if replaceKey(parent, pos+1, k) {
+				leaf.Truncate(leaf.Size() - 1)
+				moved = pos + 1
+			} else {
+				b.dropFirst(sib)
+			}
+		}
+	}
+	if moved == -1 && pos > 0 {
+		_, sibRef := parent.GetKey(pos - 1)
+		sib := b.pager.Get(sibRef)
+		k, r, v := b.leafEntry(leaf, 0)
+		second, _ := leaf.GetKey(1)
+		if b.insert(sib, k, r, v) {
+			if replaceKey(parent, pos, copyBytes(second)) {
+				b.dropFirst(leaf)
+				moved = pos
+			} else {
+				sib.Truncate(sib.Size() - 1)
+			}
+		}
+	}
+	if moved == -1 {
+		return false, pageRefs
+	}
+	b.rotations++
+
+	sep, targetRef := parent.GetKey(moved)
+	if keyLess(key, sep) {
+		_, targetRef = parent.GetKey(moved - 1)
+	}
+	if b.insert(b.pager.Get(targetRef), key, ref, value) {
+		return true, pageRefs
+	}
+	return false, append(append([]int(nil), pageRefs[:len(pageRefs)-1]...), targetRef)
+}
+
+// The position of the child ref in the internal page parent.
+func childPos(parent Page, ref int) int {
+	for i := 0; i < parent.Size(); i++ {
+		if _, r := parent.GetKey(i); r == ref {
+			return i
+		}
+	}
+	panic("insane")
+}
+
+// A copy of entry i of leaf, with its inline value if it has one.
+func (b *Btree) leafEntry(leaf Page, i int) (key []byte, ref int, value []byte) {
+	k, ref := leaf.GetKey(i)
+	if isInline(ref) {
+		value = copyBytes(inlineValue(k, ref))
+	}
+	return copyBytes(k), ref, value
+}
+
+// Drop the first key of leaf.
+func (b *Btree) dropFirst(leaf Page) {
+	n := leaf.Size()
+	keys, refs, values := make([][]byte, 0, n-1), make([]int, 0, n-1), make([][]byte, 0, n-1)
+	for i := 1; i < n; i++ {
+		k, r, v := b.leafEntry(leaf, i)
+		keys, refs, values = append(keys, k), append(refs, r), append(values, v)
+	}
+	leaf.Truncate(0)
+	for i := range keys {
+		b.insert(leaf, keys[i], refs[i], values[i])
+	}
+}
+
+// Replace key i of the internal page with key, keeping its ref.
+// Returns false and leaves the page as it was if the longer key does
+// not fit.
+func replaceKey(page Page, i int, key []byte) bool {
+	var keys [][]byte
+	var refs []int
+	for j := i; j < page.Size(); j++ {
+		k, r := page.GetKey(j)
+		keys, refs = append(keys, copyBytes(k)), append(refs, r)
+	}
+
+	insertAll := func(keys [][]byte) bool {
+		page.Truncate(i)
+		for j := range keys {
+			if !page.Insert(keys[j], refs[j]) {
+				return false
+			}
+		}
+		return true
+	}
+	old := keys[0]
+	keys[0] = key
+	if insertAll(keys) {
+		return true
+	}
+	keys[0] = old
+	insertAll(keys)
+	return false
+}
+
+func (b *Btree) Put(key []byte, valuev []byte) (replaced bool) {
+	start := b.startTimer()
+	replaced = b.put(key, valuev, false)
+	b.observePut(start, replaced)
+	return
+}
+
+// Tell the observer, if any, about a put that started at start.
+func (b *Btree) observePut(start time.Time, replaced bool) {
+	if b.opts.Observer != nil {
+		b.opts.Observer.OnPut(replaced)
+	}
+	if b.timer != nil {
+		b.timer.OnPutDone(time.Since(start), replaced)
+	}
+}
+
+// The time now if the observer wants to know how long operations
+// take, the zero time otherwise.
+func (b *Btree) startTimer() (start time.Time) {
+	if b.timer != nil {
+		start = time.Now()
+	}
+	return
+}
+
+// Like Put, but returns an OpError instead of panicking when the key
+// is empty or longer than MaxKeySize, or the value longer than
+// Options.MaxValueSize.
+func (b *Btree) PutE(key []byte, value []byte) (replaced bool, err error) {
+	if err = b.ValidateKey(key); err != nil {
+		return false, opError("Put", key, err)
+	}
+	if err = b.checkValueSize(len(value)); err != nil {
+		return false, opError("Put", key, err)
+	}
+	return b.Put(key, value), nil
+}
+
+// Like Get, but returns an OpError instead of panicking when the key
+// is empty, and for keys longer than MaxKeySize, which no put takes.
+func (b *Btree) GetE(key []byte) (ok bool, value []byte, err error) {
+	if err = b.ValidateKey(key); err != nil {
+		return false, nil, opError("Get", key, err)
+	}
+	defer func() { err = opError("Get", key, err) }()
+	defer readError(&err)
+	ok, value = b.Get(key)
+	return
+}
+
+// Like Delete, but returns an OpError instead of panicking when the
+// key is empty, and for keys longer than MaxKeySize, which no put
+// takes.
+func (b *Btree) DeleteE(key []byte) (deleted bool, err error) {
+	if err = b.ValidateKey(key); err != nil {
+		return false, opError("Delete", key, err)
+	}
+	return b.Delete(key), nil
+}
+
+// Check key against the rules the puts enforce, without touching the
+// tree: ErrEmptyKey for an empty or nil key, ErrKeyTooLong for one
+// longer than MaxKeySize, nil if Put would take it. For validating
+// a batch up front instead of failing part way through it.
+func (b *Btree) ValidateKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	return checkKeySize(key)
+}
+
+func checkKeySize(key []byte) error {
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLong
+	}
+	return nil
+}
+
+func (b *Btree) checkValueSize(n int) error {
+	if b.opts.MaxValueSize > 0 && n > b.opts.MaxValueSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// Like Put, but the tree takes ownership of value instead of copying
+// it. The caller must not modify or reuse value afterwards. Saves an
+// allocation per key when loading from buffers that are about to be
+// discarded anyway. Values large enough for overflow pages are still
+// copied.
+func (b *Btree) PutOwned(key []byte, value []byte) (replaced bool) {
+	start := b.startTimer()
+	replaced = b.put(key, value, true)
+	b.observePut(start, replaced)
+	return
+}
+
+func (b *Btree) put(key []byte, valuev []byte, owned bool) (replaced bool) {
+	if key == nil || len(key) == 0 || valuev == nil {
+		panic("Illegal nil key or value")
+	}
+	if err := checkKeySize(key); err != nil {
+		panic(err)
+	}
+	if err := b.checkValueSize(len(valuev)); err != nil {
+		panic(err)
+	}
+
+	finds, comparisons := b.pager.Counters()
+	b.mods++
+	if b.expired(key) {
+		// an expired key starts over, without its old values
+		b.Delete(key)
+	} else if b.expiries != nil {
+		delete(b.expiries, string(key))
+	}
+
+	replaced, k, pageRefs := b.search(key)
+	if replaced && k.Ref() != tombstone && b.dups != nil {
+		// Add another value
+		b.dups[k.Ref()] = append(b.dups[k.Ref()], b.storeValue(valuev, owned))
+		b.size++
+		b.countOp(opPut, finds, comparisons)
+		return false
+	}
+	if replaced && k.Ref() != tombstone {
+		// Overwrite the old value
+		if b.opts.OnOverwrite != nil {
+			b.opts.OnOverwrite(key, b.value(k.Get(), k.Ref()), valuev)
+		}
+		ref := b.replaceValue(k.Ref(), valuev, owned)
+		b.setRef(key, k.Ref(), ref, valuev, pageRefs)
+		b.stamp(key, ref)
+		b.countOp(opPut, finds, comparisons)
+		return true
+	}
+
+	b.insertNew(key, valuev, owned, replaced, pageRefs)
+	b.countOp(opPut, finds, comparisons)
+	return false
+}
+
+// Put value under key only if key does not exist yet. Returns false,
+// leaving the tree as it was, if it does. Needs only the one search,
+// and does not touch the existing value.
+func (b *Btree) PutIfAbsent(key []byte, value []byte) (inserted bool) {
+	if key == nil || len(key) == 0 || value == nil {
+		panic("Illegal nil key or value")
+	}
+	if err := checkKeySize(key); err != nil {
+		panic(err)
+	}
+	if err := b.checkValueSize(len(value)); err != nil {
+		panic(err)
+	}
+
+	start := b.startTimer()
+	finds, comparisons := b.pager.Counters()
+	if b.expired(key) {
+		// an expired key is absent, drop it and its expiry
+		b.Delete(key)
+	}
+	ok, k, pageRefs := b.search(key)
+	if ok && k.Ref() != tombstone {
+		b.countOp(opGet, finds, comparisons)
+		return false
+	}
+
+	b.mods++
+	b.insertNew(key, value, false, ok, pageRefs)
+	b.observePut(start, false)
+	b.countOp(opPut, finds, comparisons)
+	return true
+}
+
+// Store value and insert key into its leaf, the last of pageRefs,
+// splitting it if need be. If tombstoned, key was found as a
+// tombstone, which it revives in place.
+func (b *Btree) insertNew(key []byte, value []byte, owned bool, tombstoned bool, pageRefs []int) {
+	vref := b.storeValue(value, owned)
+	page := b.pager.Get(pageRefs[len(pageRefs)-1])
+	if !b.insert(page, key, vref, value) {
+		b.split(key, vref, value, pageRefs)
+	}
+	b.stamp(key, vref)
+	if tombstoned {
+		b.tombstones--
+	}
+	b.size++
+}
+
+func (b *Btree) Append(key []byte, value []byte) {
+	b.AppendR(key, value)
+}
+
+// Like Append, but reports whether the key was created rather than
+// appended to.
+func (b *Btree) AppendR(key []byte, value []byte) (created bool) {
+	created, err := b.appendE(key, value)
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+// Like Append, but returns an OpError instead of panicking when the
+// key is empty or longer than MaxKeySize, or the value would grow
+// longer than Options.MaxValueSize. The value is left as it was.
+func (b *Btree) AppendE(key []byte, value []byte) error {
+	if err := b.ValidateKey(key); err != nil {
+		return opError("Append", key, err)
+	}
+	_, err := b.appendE(key, value)
+	return opError("Append", key, err)
+}
+
+func (b *Btree) appendE(key []byte, value []byte) (created bool, err error) {
+	if key == nil || len(key) == 0 || value == nil {
+		panic("Illegal nil key or value")
+	}
+	if err = checkKeySize(key); err != nil {
+		return
+	}
+	if b.expired(key) {
+		// appending to an expired key starts it over
+		b.Delete(key)
+	}
 
-		pageRefs = append(pageRefs, ref)
+	ok, k, pageRefs := b.search(key)
+	n := len(value)
+	if ok && k.Ref() != tombstone {
+		n += b.valueLen(k.Ref())
+	}
+	if err = b.checkValueSize(n); err != nil {
+		return
 	}
 
+	b.mods++
+	if ok && (isInline(k.Ref()) || b.versions != nil && k.Ref() != tombstone) {
+		// a new value, leaving an old version as it was
+		at, ttl := b.expiries[string(key)]
+		b.put(key, append(b.value(k.Get(), k.Ref()), value...), true)
+		if ttl {
+			b.expiries[string(key)] = at
+		}
+	} else if ok && k.Ref() != tombstone {
+		var old []byte
+		if b.opts.OnOverwrite != nil {
+			old = b.value(nil, k.Ref())
+		}
+		// appending leaves old as it was
+		ref := b.appendValue(k.Ref(), value)
+		b.setRef(key, k.Ref(), ref, nil, pageRefs)
+		if b.opts.OnOverwrite != nil {
+			b.opts.OnOverwrite(key, old, b.value(nil, ref))
+		}
+	} else {
+		if b.Put(key, value) {
+			panic("Did not expect to have to replace the value")
+		}
+		created = true
+	}
 	return
 }
 
-func (b *Btree) Get(key []byte) (ok bool, value []byte) {
+// Get all values of key, in the order they were put. Without
+// AllowDuplicates that is at most one value.
+func (b *Btree) GetAll(key []byte) (values [][]byte) {
 	if key == nil || len(key) == 0 {
 		panic("Illegal key nil")
 	}
 
 	ok, k, _ := b.search(key)
-	if ok {
-		value = b.values[k.Ref()]
+	if !ok || k.Ref() == tombstone || b.expired(key) {
+		return nil
+	}
+	values = append(values, b.readValue(k.Get(), k.Ref()))
+	for _, r := range b.dups[k.Ref()] {
+		values = append(values, b.readValue(nil, r))
 	}
-
 	return
 }
 
-func (b *Btree) Start(prefix []byte) (it indexes.Iter) {
-	if prefix == nil {
+// Point key at newRef in its leaf, the last of pageRefs, if it moved
+// from oldRef. An inline newRef is always written, with value.
+func (b *Btree) setRef(key []byte, oldRef, newRef int, value []byte, pageRefs []int) {
+	if isInline(newRef) {
+		if !b.pager.Get(pageRefs[len(pageRefs)-1]).InsertInline(key, value) {
+			b.split(key, newRef, value, pageRefs)
+		}
+		return
+	}
+	if newRef != oldRef {
+		b.pager.Get(pageRefs[len(pageRefs)-1]).Insert(key, newRef)
+		if dups, ok := b.dups[oldRef]; ok {
+			delete(b.dups, oldRef)
+			b.dups[newRef] = dups
+		}
+	}
+}
+
+// Exchange the values of two keys, returning false and doing nothing
+// if either does not exist. Values in the value log and overflow
+// pages are not copied, the two leaves just swap their refs, taking
+// all the values of duplicate keys along. Inline values, and the
+// values of Versioned trees, are put again instead. Either way an
+// expiry from PutWithTTL stays with its key, not its value, and
+// Options.OnOverwrite is called for keyA and then keyB.
+func (b *Btree) SwapValues(keyA, keyB []byte) (bothExisted bool) {
+	if keyA == nil || len(keyA) == 0 || keyB == nil || len(keyB) == 0 {
 		panic("Illegal key nil")
 	}
 
-	_, _, pageRefs := b.search(prefix)
+	ok, k, pageRefs := b.search(keyA)
+	if !ok || k.Ref() == tombstone || b.expired(keyA) {
+		return false
+	}
+	refA, leafA := k.Ref(), pageRefs[len(pageRefs)-1]
+	// an inline value is only there until the next search
+	inlineA := copyBytes(inlineValue(k.Get(), refA))
 
-	ref := pageRefs[len(pageRefs)-1]
-	page := b.pager.Get(ref)
+	ok, k, pageRefs = b.search(keyB)
+	if !ok || k.Ref() == tombstone || b.expired(keyB) {
+		return false
+	}
+	refB, leafB := k.Ref(), pageRefs[len(pageRefs)-1]
 
-	return &btreeIter{prefix, page.Start(prefix), page, b, false}
-}
+	if isInline(refA) || isInline(refB) || b.versions != nil {
+		// their bytes are in the leaves, or their refs in the
+		// versions too
+		valueA := inlineA
+		if !isInline(refA) {
+			valueA = copyBytes(b.value(nil, refA))
+		}
+		valueB := copyBytes(b.value(k.Get(), refB))
+		// put drops the expiries
+		atA, ttlA := b.expiries[string(keyA)]
+		atB, ttlB := b.expiries[string(keyB)]
+		b.put(keyA, valueB, true)
+		b.put(keyB, valueA, true)
+		if ttlA {
+			b.expiries[string(keyA)] = atA
+		}
+		if ttlB {
+			b.expiries[string(keyB)] = atB
+		}
+		return true
+	}
 
-func (b *Btree) split(key []byte, ref int, pageRefs []int) {
-	pageRef := pageRefs[len(pageRefs)-1]
-	page := b.pager.Get(pageRef)
+	if b.opts.OnOverwrite != nil {
+		valueA, valueB := b.value(nil, refA), b.value(nil, refB)
+		b.opts.OnOverwrite(keyA, valueA, valueB)
+		b.opts.OnOverwrite(keyB, valueB, valueA)
+	}
+	b.mods++
+	b.pager.Get(leafA).Insert(keyA, refB)
+	b.pager.Get(leafB).Insert(keyB, refA)
+	return true
+}
 
-	parentRef := pageRefs[len(pageRefs)-2]
-	parent := b.pager.Get(parentRef)
+// Delete a key. Returns false if it did not exist. The value is
+// dropped, but the key stays in its leaf as a tombstone, which Get
+// and iteration skip, until the next Sweep.
+func (b *Btree) Delete(key []byte) (deleted bool) {
+	if key == nil || len(key) == 0 {
+		panic("Illegal key nil")
+	}
 
-	// Split the page
-	newPageRef, newPage := b.pager.New(page.IsLeaf())
-	splitKey := page.Split(newPageRef, newPage)
+	expired := b.expired(key)
+	if b.expiries != nil {
+		delete(b.expiries, string(key))
+	}
+	ok, k, pageRefs := b.search(key)
+	if !ok || k.Ref() == tombstone {
+		return false
+	}
 
-	newPage.SetNextPage(page.NextPage())
-	page.SetNextPage(newPageRef)
+	b.mods++
+	deleted = !expired
+	ref := k.Ref()
+	page := b.pager.Get(pageRefs[len(pageRefs)-1])
+	page.Insert(key, tombstone)
 
-	// Insert the key, decide in which of the resulting pages it
-	// must go. Don't bother checking ok, after split there must
-	// be space.
-	if keyLess(key, splitKey) {
-		page.Insert(key, ref)
-	} else {
-		newPage.Insert(key, ref)
+	if b.versions == nil {
+		b.dropValue(ref)
 	}
-
-	ok := parent.Insert(splitKey, newPageRef)
-	if !ok {
-		if parentRef == b.root {
-			if len(pageRefs) != 2 {
-				panic("insane")
-			}
-			oldRootRef := b.root
-			newRootRef, newRoot := b.pager.New(false)
-			newRoot.SetFirst(oldRootRef)
-			b.root = newRootRef
-			b.split(splitKey, newPageRef, []int{newRootRef, parentRef})
-		} else {
-			b.split(splitKey, newPageRef, pageRefs[:len(pageRefs)-1])
+	b.stamp(key, tombstone)
+	b.size--
+	b.tombstones++
+	if dups, ok := b.dups[ref]; ok {
+		for _, r := range dups {
+			b.dropValue(r)
 		}
+		b.size -= int64(len(dups))
+		delete(b.dups, ref)
 	}
+
+	return
 }
 
-func (b *Btree) Put(key []byte, valuev []byte) (replaced bool) {
-	if key == nil || len(key) == 0 || valuev == nil {
-		panic("Illegal nil key or value")
+// Keep the first n values, in key order, and delete the rest. The
+// leaves past the cut are unlinked and released whole, instead of
+// leaving tombstones. Does nothing if the tree has at most n values.
+// Expired keys count as values, as in Size.
+func (b *Btree) TruncateTo(n int64) {
+	if n < 0 {
+		panic(fmt.Sprint("Illegal negative size ", n))
 	}
-
-	replaced, k, pageRefs := b.search(key)
-	if replaced {
-		// Overwrite the old value
-		b.values[k.Ref()] = append(b.values[k.Ref()][:0], valuev...)
+	if n >= b.size {
 		return
 	}
 
-	// TODO factor out allocating space for values to the pager?
-	value := copyBytes(valuev)
-
-	vref := len(b.values)
-	pageRef := pageRefs[len(pageRefs)-1]
-	page := b.pager.Get(pageRef)
-	ok := page.Insert(key, vref)
+	// find the first key to drop, counting expired keys like Size
+	it := b.Start(nil).(*btreeIter)
+	it.expired = true
+	for ; n > 0; n-- {
+		it.nextRef()
+	}
+	ok, cut, _ := it.nextRef()
+	if it.lastN > 1 {
+		// the cut falls among the values of a duplicate key: keep
+		// the ones before it
+		_, k, _ := b.search(cut)
+		dups := b.dups[k.Ref()]
+		for _, r := range dups[it.lastN-2:] {
+			b.dropValue(r)
+		}
+		b.size -= int64(len(dups) - (it.lastN - 2))
+		b.dups[k.Ref()] = dups[:it.lastN-2]
+		it.dups = nil
+		ok, cut, _ = it.nextRef()
+	}
+	b.mods++
+	b.lastLeaf = -1
 	if !ok {
-		b.split(key, vref, pageRefs)
+		return
 	}
+	cut = copyBytes(cut)
 
-	b.values = append(b.values, []byte{})
-	b.values[vref] = append(b.values[vref], value...)
+	// cut each level of the tree right of the path to cut
+	_, _, pageRefs := b.search(cut)
+	pageRefs = append([]int(nil), pageRefs...)
+	for level, ref := range pageRefs {
+		page := b.pager.Get(ref)
+		for r := page.NextPage(); r != -1; {
+			right := b.pager.Get(r)
+			if right.IsLeaf() {
+				b.dropEntries(right, 0)
+			}
+			next := right.NextPage()
+			b.pager.Release(r)
+			r = next
+		}
+		page.SetNextPage(-1)
 
-	b.size++
+		if page.IsLeaf() {
+			pos := leafPos(page, cut)
+			b.dropEntries(page, pos)
+			page.Truncate(pos)
+			break
+		}
+		for i := 0; i < page.Size(); i++ {
+			if _, r := page.GetKey(i); r == pageRefs[level+1] {
+				page.Truncate(i + 1)
+				break
+			}
+		}
+	}
+}
+
+// Drop the values of the keys in leaf from pos on, as if each was
+// deleted, before they are removed from the leaf.
+func (b *Btree) dropEntries(leaf Page, pos int) {
+	for i := pos; i < leaf.Size(); i++ {
+		k, r := leaf.GetKey(i)
+		if r == tombstone {
+			b.tombstones--
+			continue
+		}
+		if b.versions != nil {
+			b.stamp(k, tombstone)
+		} else {
+			b.dropValue(r)
+		}
+		b.size--
+		for _, d := range b.dups[r] {
+			b.dropValue(d)
+			b.size--
+		}
+		delete(b.dups, r)
+		if b.expiries != nil {
+			delete(b.expiries, string(k))
+		}
+	}
+}
 
+// Remove all tombstones left by Delete by rebuilding the tree from
+// its live keys with the bulk put. This compacts the pages and the
+// value log. The old pages are released to the pager, for later
+// puts to reuse or Defrag to drop. Returns the number of tombstones
+// removed.
+func (b *Btree) Sweep() (removed int64) {
+	if b.tombstones == 0 {
+		return 0
+	}
+	removed = b.tombstones
+	b.Rebuild()
 	return
 }
 
-func (b *Btree) Append(key []byte, value []byte) {
-	if key == nil || len(key) == 0 || value == nil {
-		panic("Illegal nil key or value")
+// Rebuild the tree from its keys with the bulk put, like Sweep, even
+// if there are no tombstones. Leaves the pages as full as they go,
+// for after a lot of random puts and deletes have left them half
+// empty, and drops the values that were overwritten or deleted from
+// the value log.
+func (b *Btree) Rebuild() {
+	fresh := NewWithPagerAndOptions(b.pager, b.opts)
+	// copying is not a write
+	fresh.versions = nil
+	iter := b.Start([]byte{}).(*btreeIter)
+	var prev []byte
+	for {
+		// the puts copy the values anyway
+		ok, k, ref := iter.nextRef()
+		if !ok {
+			break
+		}
+		v := b.value(k, ref)
+		if prev != nil && bytes.Equal(prev, k) {
+			// another value of a duplicate key
+			fresh.Put(k, v)
+		} else {
+			fresh.PutNext(k, v)
+		}
+		prev = k
 	}
 
-	ok, k, _ := b.search(key)
-	if ok {
-		b.values[k.Ref()] = append(b.values[k.Ref()], value...)
-	} else {
-		if b.Put(key, value) {
-			panic("Did not expect to have to replace the value")
+	if b.versions != nil {
+		b.sweepVersions(fresh)
+	}
+	// the copy skipped the expired keys
+	now := b.now()
+	for k, at := range b.expiries {
+		if now < at {
+			if fresh.expiries == nil {
+				fresh.expiries = make(map[string]int64)
+			}
+			fresh.expiries[k] = at
+		}
+	}
+	// fresh has its own copies of everything
+	b.releasePages(b.root)
+	for _, versions := range b.versions {
+		for _, v := range versions[:len(versions)-1] {
+			b.releaseOverflow(v.ref)
+		}
+	}
+
+	fresh.mods = b.mods + 1
+	*b = *fresh
+}
+
+// Release the page ref and the pages under it, and the overflow pages
+// of the values their leaves refer to.
+func (b *Btree) releasePages(ref int) {
+	page := b.pager.Get(ref)
+	for i := 0; i < page.Size(); i++ {
+		_, r := page.GetKey(i)
+		if !page.IsLeaf() {
+			b.releasePages(r)
+			continue
 		}
+		b.releaseOverflow(r)
+		for _, d := range b.dups[r] {
+			b.releaseOverflow(d)
+		}
+	}
+	b.pager.Release(ref)
+}
+
+func (b *Btree) releaseOverflow(ref int) {
+	if isOverflow(ref) {
+		b.pager.ReleaseOverflow(overflowHead(ref))
 	}
 }
 
+// Make the tree's pages durable, see Pager.Sync. Values in the value
+// log live on the heap, not in pages, so only a tree that keeps all
+// its values inline or in overflow pages survives a crash whole.
+func (b *Btree) Sync() error {
+	return b.pager.Sync()
+}
+
+// Number of keys, not counting deleted ones. Expired keys count until
+// PurgeExpired or Delete deletes them, though Get and iterators skip
+// them.
 func (b *Btree) Size() int64 {
 	return b.size
 }
 
+// Estimate of the number of bytes held by the tree, for capacity
+// monitoring. Values are counted by length, not slice capacity, plus
+// a slice header each. Pages are counted at their full allocated
+// size plus an offset per key, regardless of how full they are.
+func (b *Btree) ByteSize() int64 {
+	stats := b.pager.Stats()
+	pages := int64(stats.NumInternalPages + stats.NumLeafPages + stats.NumOverflowPages)
+	headers := int64(b.values.len()) * int64(unsafe.Sizeof([]byte{}))
+	offsets := b.size * int64(unsafe.Sizeof(int(0)))
+	return b.valueBytes + headers + pages*pageSize + offsets
+}
+
 // recursively check sorting inside pages and that child pages
 // only have keys that are greater than or equal to the keys
-// that reference them.
-func (b *Btree) checkPage(page Page, checkMinKey bool, minKey []byte, ref int, depth int) error {
+// that reference them. Appends the leaves it finds to leaves, in
+// order.
+func (b *Btree) checkPage(page Page, checkMinKey bool, minKey []byte, ref int, depth int, leaves *[]int) error {
 	if page.IsLeaf() {
+		*leaves = append(*leaves, ref)
 		prev := []byte{}
 		for i := 0; i < page.Size(); i++ {
 			k, r := page.GetKey(i)
 			if !keyLess(prev, k) {
-				return fmt.Errorf("Expect strict ordering, got violation %v >= %v", prev, k)
+				return fmt.Errorf("Page %d, depth %d: Expect strict ordering, got violation %v >= %v", ref, depth, prev, k)
 			}
-			if r < 0 {
-				return fmt.Errorf("value reference cannot be < 0")
+			if checkMinKey && keyLess(k, minKey) {
+				return fmt.Errorf("Page %d, depth %d: Expect parent key to be smaller or equal to all in referred to child page: got violation %v > %v", ref, depth, minKey, k)
+			}
+			if r >= b.values.len() {
+				return fmt.Errorf("Page %d, depth %d: value reference %d out of range", ref, depth, r)
 			}
 			prev = k
 		}
 	} else {
 		prevk, prevr := page.GetKey(0)
 		if prevr == -1 && page.Size() > 1 {
-			return fmt.Errorf("Expected internal node to refer to other pages")
+			return fmt.Errorf("Page %d, depth %d: Expected internal node to refer to other pages", ref, depth)
+		}
+		if prevr != -1 {
+			// the leftmost child is bounded by whatever bounds
+			// this page
+			if err := b.checkPage(b.pager.Get(prevr), checkMinKey, minKey, prevr, depth+1, leaves); err != nil {
+				return err
+			}
 		}
 		for i := 1; i < page.Size(); i++ {
 			k, r := page.GetKey(i)
 			if checkMinKey && !keyLess(minKey, k) {
-				return fmt.Errorf("Expect parent key to be smaller or equal to all in referred to child page: got violation %v >= %v", prevk, minKey)
+				return fmt.Errorf("Page %d, depth %d: Expect parent key to be smaller or equal to all in referred to child page: got violation %v >= %v", ref, depth, minKey, k)
 			}
 			if !keyLess(prevk, k) {
-				return fmt.Errorf("Expect strict ordering, got violation %v >= %v", prevk, k)
+				return fmt.Errorf("Page %d, depth %d: Expect strict ordering, got violation %v >= %v", ref, depth, prevk, k)
 			}
 			if r < 0 {
-				return fmt.Errorf("value reference cannot be < 0")
+				return fmt.Errorf("Page %d, depth %d: page reference cannot be < 0", ref, depth)
 			}
-			if err := b.checkPage(b.pager.Get(r), true, k, r, depth+1); err != nil {
+			if err := b.checkPage(b.pager.Get(r), true, k, r, depth+1, leaves); err != nil {
 				return err
 			}
+			prevk = k
 		}
 	}
 
 	return nil
 }
 
+// Check that following NextPage from the leftmost leaf visits
+// exactly the given leaves in order, each once and each with keys
+// greater than the ones before it, and that PrevPage leads back.
+func (b *Btree) checkLeafChain(leaves []int) error {
+	ref := b.root
+	for page := b.pager.Get(ref); !page.IsLeaf(); page = b.pager.Get(ref) {
+		ref = page.First()
+	}
+
+	numLeaves := b.pager.Stats().NumLeafPages
+	if len(leaves) != numLeaves {
+		return fmt.Errorf("Leaf chain: tree refers to %d leaves, pager has %d", len(leaves), numLeaves)
+	}
+
+	visited := make(map[int]bool)
+	prev := -1
+	var prevKey []byte
+	for i := 0; i < len(leaves); i++ {
+		if visited[ref] {
+			return fmt.Errorf("Leaf chain: cycle back to page %d after page %d", ref, prev)
+		}
+		visited[ref] = true
+		if ref != leaves[i] {
+			return fmt.Errorf("Leaf chain: expected leaf %d after page %d, got %d", leaves[i], prev, ref)
+		}
+
+		page := b.pager.Get(ref)
+		if page.PrevPage() != prev {
+			return fmt.Errorf("Leaf chain: page %d refers back to %d, expected %d", ref, page.PrevPage(), prev)
+		}
+		if page.Size() > 0 {
+			first, _ := page.GetKey(0)
+			if prevKey != nil && !keyLess(prevKey, first) {
+				return fmt.Errorf("Leaf chain: first key %v of page %d not greater than last key %v of page %d", first, ref, prevKey, prev)
+			}
+			prevKey, _ = page.GetKey(page.Size() - 1)
+		}
+
+		prev, ref = ref, page.NextPage()
+	}
+	if ref != -1 {
+		if visited[ref] {
+			return fmt.Errorf("Leaf chain: cycle back to page %d after page %d", ref, prev)
+		}
+		return fmt.Errorf("Leaf chain: expected last leaf %d to end the chain, got next page %d", prev, ref)
+	}
+	return nil
+}
+
 func (b *Btree) CheckConsistency() error {
+	root := b.pager.Get(b.root)
+	leaves := make([]int, 0)
+	if err := b.checkPage(root, false, []byte{}, b.root, 0, &leaves); err != nil {
+		return err
+	}
+	if err := b.checkLeafChain(leaves); err != nil {
+		return err
+	}
 
 	count := int64(0)
 
-	iter := b.Start([]byte{})
+	// expired keys count in Size until they are purged
+	iter := b.Start([]byte{}).(*btreeIter)
+	iter.expired = true
 	prev := []byte{}
 	for {
-		ok, k, _ := iter.Next()
+		ok, k, _ := iter.nextRef()
 		if !ok {
 			break
 		}
 		if k == nil || len(k) == 0 {
 			return fmt.Errorf("Got empty key %v", k)
 		}
-		if !keyLess(prev, k) {
+		if !keyLess(prev, k) && !(b.dups != nil && bytes.Equal(prev, k)) {
 			return fmt.Errorf("Expect strict ordering, got violation %v >= %v", prev, k)
 		}
+		prev = k
 		count++
 	}
 
@@ -273,11 +1627,135 @@ func (b *Btree) CheckConsistency() error {
 		return fmt.Errorf("Expected %d, got %d", b.Size(), count)
 	}
 
-	root := b.pager.Get(b.root)
-	return b.checkPage(root, false, []byte{}, 0, 0)
+	return nil
+}
+
+// A cheap, partial CheckConsistency: checks that the leaf chain ends
+// at both ends, then walks sampleRate times as many random paths
+// from the root as there are leaves, checking each page on the way
+// against its checksum, the order of its keys, the bounds its parent
+// sets and the depth of the leaves. Run it often and CheckConsistency
+// when it finds something.
+func (b *Btree) QuickCheck(sampleRate float64) error {
+	if sampleRate <= 0 || sampleRate > 1 {
+		panic(fmt.Sprint("Illegal sample rate ", sampleRate))
+	}
+
+	depth := 0
+	first, last := b.pager.Get(b.root), b.pager.Get(b.root)
+	for ; !first.IsLeaf(); depth++ {
+		first = b.pager.Get(first.First())
+		_, r := last.GetKey(last.Size() - 1)
+		last = b.pager.Get(r)
+	}
+	if !last.IsLeaf() {
+		return fmt.Errorf("Expected all leaves at depth %d, the rightmost is deeper", depth)
+	}
+	if first.PrevPage() != -1 {
+		return fmt.Errorf("Expected nothing before the leftmost leaf, got page %d", first.PrevPage())
+	}
+	if last.NextPage() != -1 {
+		return fmt.Errorf("Expected nothing after the rightmost leaf, got page %d", last.NextPage())
+	}
+
+	n := int(math.Ceil(sampleRate * float64(b.pager.Stats().NumLeafPages)))
+	for i := 0; i < n; i++ {
+		if err := b.checkRandomPath(depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check the pages on a random path from the root to a leaf at depth.
+func (b *Btree) checkRandomPath(depth int) error {
+	// keys are at least lo and below hi, nil for no bound
+	var lo, hi []byte
+	ref := b.root
+	for d := 0; ; d++ {
+		page := b.pager.Get(ref)
+		if err := page.Verify(); err != nil {
+			return &CorruptPageError{ref, err}
+		}
+		if page.IsLeaf() != (d == depth) {
+			return fmt.Errorf("Page %d, depth %d: Expected leaves at depth %d", ref, d, depth)
+		}
+
+		start := 0
+		if !page.IsLeaf() {
+			start = 1
+		}
+		var prev []byte
+		for i := start; i < page.Size(); i++ {
+			k, _ := page.GetKey(i)
+			if i > start && !keyLess(prev, k) {
+				return fmt.Errorf("Page %d, depth %d: Expect strict ordering, got violation %v >= %v", ref, d, prev, k)
+			}
+			if (lo != nil && keyLess(k, lo)) || (hi != nil && !keyLess(k, hi)) {
+				return fmt.Errorf("Page %d, depth %d: Expected keys from %v up to %v, got %v", ref, d, lo, hi, k)
+			}
+			prev = k
+		}
+		if page.IsLeaf() {
+			return nil
+		}
+
+		i := rand.Intn(page.Size())
+		if i > 0 {
+			k, _ := page.GetKey(i)
+			lo = copyBytes(k)
+		}
+		if i+1 < page.Size() {
+			k, _ := page.GetKey(i + 1)
+			hi = copyBytes(k)
+		}
+		_, ref = page.GetKey(i)
+	}
+}
+
+// Verify every page in the tree against its checksum. Returns a
+// *CorruptPageError for the first page, in depth first order, that
+// fails. Pagers that decode pages from bytes also verify each page
+// as they load it; the in memory pager never decodes, so only this
+// and Options.VerifyReads check it.
+func (b *Btree) Verify() error {
+	return b.verifyPage(b.root)
+}
+
+func (b *Btree) verifyPage(ref int) error {
+	page := b.pager.Get(ref)
+	if err := page.Verify(); err != nil {
+		return &CorruptPageError{ref, err}
+	}
+	for i := 0; i < page.Size(); i++ {
+		_, r := page.GetKey(i)
+		if page.IsLeaf() {
+			if isOverflow(r) {
+				if err := b.verifyOverflow(overflowHead(r)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := b.verifyPage(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Btree) verifyOverflow(ref int) error {
+	for ref != -1 {
+		page := b.pager.Get(ref)
+		if err := page.Verify(); err != nil {
+			return &CorruptPageError{ref, err}
+		}
+		ref = page.NextPage()
+	}
+	return nil
 }
 
-func (b *Btree) appendPage(key []byte, ref int, pageRefs []int) {
+func (b *Btree) appendPage(key []byte, ref int, value []byte, pageRefs []int) {
 	pageRef := pageRefs[len(pageRefs)-1]
 	page := b.pager.Get(pageRef)
 
@@ -286,9 +1764,12 @@ func (b *Btree) appendPage(key []byte, ref int, pageRefs []int) {
 
 	newPageRef, newPage := b.pager.New(page.IsLeaf())
 	page.SetNextPage(newPageRef)
+	newPage.SetPrevPage(pageRef)
 
 	if page.IsLeaf() {
-		newPage.Insert(key, ref)
+		if !b.insert(newPage, key, ref, value) {
+			panic(fmt.Sprintf("No room for a key of %d bytes in an empty page", len(key)))
+		}
 	} else {
 		newPage.SetFirst(ref)
 	}
@@ -300,9 +1781,10 @@ func (b *Btree) appendPage(key []byte, ref int, pageRefs []int) {
 			newRoot.SetFirst(b.root)
 			oldRootRef := b.root
 			b.root = newRootRef
-			b.appendPage(key, newPageRef, []int{newRootRef, oldRootRef})
+			b.rootPromotions++
+			b.appendPage(key, newPageRef, nil, []int{newRootRef, oldRootRef})
 		} else {
-			b.appendPage(key, newPageRef, pageRefs[:len(pageRefs)-1])
+			b.appendPage(key, newPageRef, nil, pageRefs[:len(pageRefs)-1])
 		}
 	}
 }
@@ -314,27 +1796,87 @@ func (b *Btree) PutNext(keyv, valuev []byte) {
 	if keyv == nil || len(keyv) == 0 || valuev == nil {
 		panic("Illegal nil key or value")
 	}
+	if err := checkKeySize(keyv); err != nil {
+		panic(err)
+	}
+	if err := b.checkValueSize(len(valuev)); err != nil {
+		panic(err)
+	}
+
+	page, pageRefs := b.lastPath(keyv)
+	b.mods++
+	vref := b.storeValue(valuev, false)
+	key := copyBytes(keyv)
+	ok := b.insert(page, key, vref, valuev)
+	if !ok {
+		b.appendPage(key, vref, valuev, pageRefs)
+	}
+	b.stamp(key, vref)
+	b.size++
+	b.keepTail(pageRefs, ok)
+}
+
+// Like PutNext for each of keys and their values, which the tree
+// keeps as they are. Descends the tree once per leaf it fills instead
+// of once per key.
+func (b *Btree) putNextOwned(keys, values [][]byte) {
+	for i := 0; i < len(keys); {
+		page, pageRefs := b.lastPath(keys[i])
+		b.mods++
+		kept := true
+		for ; i < len(keys); i++ {
+			vref := b.storeValue(values[i], true)
+			if !b.insert(page, keys[i], vref, values[i]) {
+				// the next key needs the new leaf's path
+				b.appendPage(keys[i], vref, values[i], pageRefs)
+				b.stamp(keys[i], vref)
+				b.size++
+				i++
+				kept = false
+				break
+			}
+			b.stamp(keys[i], vref)
+			b.size++
+		}
+		b.keepTail(pageRefs, kept)
+	}
+}
+
+// The last leaf and the path to it, panicking if key does not go
+// after every key above it.
+func (b *Btree) lastPath(key []byte) (page Page, pageRefs []int) {
+	if b.tail != nil && b.tailMods == b.mods {
+		// the last key of the leaf's parent is the largest on the
+		// way down
+		parent := b.pager.Get(b.tail[len(b.tail)-2])
+		if k, _ := parent.GetKey(parent.Size() - 1); !keyLess(k, key) {
+			panic(fmt.Sprint("out of order put:", key))
+		}
+		return b.pager.Get(b.tail[len(b.tail)-1]), b.tail
+	}
 
-	pageRefs := make([]int, 0, 8)
+	pageRefs = make([]int, 0, 8)
 	pageRefs = append(pageRefs, b.root)
-	page := b.pager.Get(b.root)
+	page = b.pager.Get(b.root)
 	for !page.IsLeaf() {
 		k, r := page.GetKey(page.Size() - 1)
-		if !keyLess(k, keyv) {
-			panic(fmt.Sprint("out of order put:", keyv))
+		if !keyLess(k, key) {
+			panic(fmt.Sprint("out of order put:", key))
 		}
 		page = b.pager.Get(r)
 		pageRefs = append(pageRefs, r)
 	}
+	return
+}
 
-	vref := len(b.values)
-	b.values = append(b.values, copyBytes(valuev))
-	key := copyBytes(keyv)
-	ok := page.Insert(key, vref)
-	if !ok {
-		b.appendPage(key, vref, pageRefs)
+// Remember pageRefs as the path to the last leaf for the next
+// PutNext, if the put that just used it left it as it was.
+func (b *Btree) keepTail(pageRefs []int, ok bool) {
+	if ok {
+		b.tail, b.tailMods = pageRefs, b.mods
+	} else {
+		b.tail = nil
 	}
-	b.size++
 }
 
 func spaces(n int) string {
@@ -362,14 +1904,87 @@ func (b *Btree) Dump(out io.Writer) {
 	b.dumpPage(out, b.root, 0)
 }
 
+// Finds and comparisons made by one type of operation. A find is a
+// binary search for a key inside a page.
+type OpStats struct {
+	Finds       int
+	Comparisons int
+}
+
+// Average number of key comparisons per find. Pages are searched with
+// a binary search, so expect about log2 of the number of keys per
+// page; much more than that points at a key distribution that makes
+// Insert fall back from appending to searching.
+func (s OpStats) ComparisonsPerFind() float64 {
+	if s.Finds == 0 {
+		return 0
+	}
+	return float64(s.Comparisons) / float64(s.Finds)
+}
+
+// Finds and Comparisons are cumulative counters over all operations,
+// Get, Put and Start break them down for those operations. Start
+// only counts the descent to the first key, not the iteration. All
+// of these are reset by ResetStats. Splits and RootPromotions count
+// page splits and new roots, i.e. the tree growing a level, since
+// the tree was built or last swept. The rest describe the current
+// state of the tree.
 type BtreeStats struct {
 	Finds            int
 	Comparisons      int
+	Get              OpStats
+	Put              OpStats
+	Start            OpStats
 	FillRate         float64
 	NumInternalPages int
 	NumLeafPages     int
+	NumOverflowPages int
+
+	// released pages the pager keeps for reuse, see Defrag
+	FreePages int
+
+	DeadValueBytes int64
+	Splits         int64
+	RootPromotions int64
+
+	// keys moved to a sibling leaf instead of splitting, with
+	// Options.RotateToSiblings, counted like Splits
+	Rotations int64
+
+	// Gets that found their leaf in the Options.CacheLastLeaf cache
+	// and those that had to search from the root
+	LeafCacheHits, LeafCacheMisses int64
 }
 
 func (b *Btree) Stats() BtreeStats {
-	return b.pager.(*inplacePager).Stats()
+	ret := b.pager.Stats()
+	ret.Get = b.opStats[opGet]
+	ret.Put = b.opStats[opPut]
+	ret.Start = b.opStats[opStart]
+	ret.DeadValueBytes = b.deadValueBytes
+	ret.Splits = b.splits
+	ret.RootPromotions = b.rootPromotions
+	ret.Rotations = b.rotations
+	ret.LeafCacheHits, ret.LeafCacheMisses = b.leafCacheHits, b.leafCacheMisses
+	return ret
+}
+
+func (s BtreeStats) ComparisonsPerFind() float64 {
+	return OpStats{s.Finds, s.Comparisons}.ComparisonsPerFind()
+}
+
+// Attribute the pager's finds and comparisons since they were at
+// finds and comparisons to op.
+func (b *Btree) countOp(op int, finds, comparisons int) {
+	f, c := b.pager.Counters()
+	b.opStats[op].Finds += f - finds
+	b.opStats[op].Comparisons += c - comparisons
+}
+
+// Zero the cumulative counters in BtreeStats, e.g. to measure a
+// single operation.
+func (b *Btree) ResetStats() {
+	b.pager.ResetStats()
+	b.opStats = [numOps]OpStats{}
+	b.leafCacheHits, b.leafCacheMisses = 0, 0
 }
@@ -3,8 +3,12 @@ package btree
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"math/rand"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/avisagie/indexes"
 )
@@ -133,6 +137,779 @@ func TestBtreeAppend(t *testing.T) {
 	}
 }
 
+func TestAppendR(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	if !bt.AppendR([]byte{1}, []byte{1}) {
+		t.Fatal("Expected the key to be created")
+	}
+	if bt.AppendR([]byte{1}, []byte{2}) {
+		t.Fatal("Expected to append to the existing key")
+	}
+	bt.Delete([]byte{1})
+	if !bt.AppendR([]byte{1}, []byte{3}) {
+		t.Fatal("Expected a deleted key to be created again")
+	}
+	if ok, v := bt.Get([]byte{1}); !ok || bytes.Compare(v, []byte{3}) != 0 {
+		t.Fatal("Expected [3], got", v)
+	}
+}
+
+func TestSwapValuesOnOverwrite(t *testing.T) {
+	for _, opts := range []Options{{}, {InlineValues: 8}, {Versioned: true}} {
+		var got []string
+		opts.OnOverwrite = func(key, oldValue, newValue []byte) {
+			got = append(got, fmt.Sprintf("%s:%s>%s", key, oldValue, newValue))
+		}
+		bt := NewBtreeWithOptions(opts)
+		bt.Put([]byte("a"), []byte("A"))
+		bt.Put([]byte("b"), []byte("B"))
+		bt.SwapValues([]byte("a"), []byte("b"))
+		if fmt.Sprint(got) != "[a:A>B b:B>A]" {
+			t.Fatal("Expected one call per key with", opts.InlineValues, opts.Versioned, "got", got)
+		}
+	}
+}
+
+func TestSwapValues(t *testing.T) {
+	for i, opts := range []Options{{ShareValues: true}, {InlineValues: 8}, {Versioned: true}} {
+		bt := NewBtreeWithOptions(opts)
+		big := bytes.Repeat([]byte{7}, overflowThreshold+1)
+		bt.Put([]byte("a"), []byte("value of a"))
+		bt.Put([]byte("b"), big)
+		bt.Put([]byte("c"), []byte("c"))
+		_, a := bt.Get([]byte("a"))
+
+		if bt.SwapValues([]byte("a"), []byte("missing")) || bt.SwapValues([]byte("missing"), []byte("a")) {
+			t.Fatal("Expected a swap with a missing key to fail")
+		}
+		if !bt.SwapValues([]byte("a"), []byte("b")) || !bt.SwapValues([]byte("c"), []byte("b")) {
+			t.Fatal("Expected swaps of existing keys to succeed")
+		}
+		if err := bt.CheckConsistency(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string][]byte{"a": big, "b": []byte("c"), "c": []byte("value of a")}
+		for k, v := range want {
+			if ok, got := bt.Get([]byte(k)); !ok || !bytes.Equal(got, v) {
+				t.Fatal(i, "Expected", k, "to have", len(v), "bytes, got", len(got))
+			}
+		}
+		if _, c := bt.Get([]byte("c")); i == 0 && &c[0] != &a[0] {
+			t.Fatal("Expected the value to move without a copy")
+		}
+	}
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	if !bt.PutIfAbsent([]byte{1}, []byte{1}) {
+		t.Fatal("Expected the key to be inserted")
+	}
+	if bt.PutIfAbsent([]byte{1}, []byte{2}) {
+		t.Fatal("Did not expect to insert an existing key")
+	}
+	if ok, v := bt.Get([]byte{1}); !ok || bytes.Compare(v, []byte{1}) != 0 {
+		t.Fatal("Expected [1], got", v)
+	}
+	bt.Delete([]byte{1})
+	if !bt.PutIfAbsent([]byte{1}, []byte{3}) {
+		t.Fatal("Expected a deleted key to be inserted again")
+	}
+	if ok, v := bt.Get([]byte{1}); !ok || bytes.Compare(v, []byte{3}) != 0 {
+		t.Fatal("Expected [3], got", v)
+	}
+	if bt.Size() != 1 || bt.tombstones != 0 {
+		t.Fatal("Expected one key and no tombstones, got", bt.Size(), bt.tombstones)
+	}
+
+	buf := &bytes.Buffer{}
+	for i := int64(0); i < 20000; i++ {
+		binary.Write(buf, binary.BigEndian, i/2)
+		bt.PutIfAbsent(buf.Bytes(), buf.Bytes())
+		buf.Reset()
+	}
+	if bt.Size() != 10001 {
+		t.Fatal("Expected 10001 keys, got", bt.Size())
+	}
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRangeOverFunc(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	for i := 0; i < 1000; i++ {
+		bt.Put([]byte{byte(i / 256), byte(i)}, []byte{byte(i)})
+	}
+
+	n := 0
+	for k, v := range bt.All() {
+		if k[1] != v[0] || int(k[0])*256+int(k[1]) != n {
+			t.Fatal("Unexpected key", k, "value", v, "at", n)
+		}
+		n++
+	}
+	if n != 1000 {
+		t.Fatal("Expected 1000 keys, got", n)
+	}
+
+	n = 0
+	for k := range bt.Prefix([]byte{2}) {
+		if k[0] != 2 {
+			t.Fatal("Expected prefix 2, got", k)
+		}
+		n++
+	}
+	if n != 256 {
+		t.Fatal("Expected 256 keys, got", n)
+	}
+
+	n = 0
+	for range bt.All() {
+		n++
+		if n == 10 {
+			break
+		}
+	}
+	if n != 10 {
+		t.Fatal("Expected to stop at 10, got", n)
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	bt := NewBtree()
+	for _, c := range []struct {
+		key  []byte
+		want error
+	}{
+		{nil, ErrEmptyKey},
+		{[]byte{}, ErrEmptyKey},
+		{[]byte{0}, nil},
+		{make([]byte, MaxKeySize), nil},
+		{make([]byte, MaxKeySize+1), ErrKeyTooLong},
+	} {
+		if err := bt.ValidateKey(c.key); err != c.want {
+			t.Error("Expected", c.want, "for a key of", len(c.key), "bytes, got", err)
+		}
+		if c.want == nil {
+			if _, err := bt.PutE(c.key, []byte{1}); err != nil {
+				t.Error("Expected PutE to take a valid key, got", err)
+			}
+		}
+	}
+}
+
+func TestOpError(t *testing.T) {
+	bt := NewBtree()
+	long := make([]byte, MaxKeySize+1)
+	_, err := bt.PutE(long, []byte{1})
+	var opErr *OpError
+	if !errors.As(err, &opErr) || opErr.Op != "Put" || !bytes.Equal(opErr.Key, long) || !errors.Is(err, ErrKeyTooLong) {
+		t.Fatal("Expected an OpError for the long key, got", err)
+	}
+
+	for name, f := range map[string]func() error{
+		"PutE":    func() error { _, err := bt.PutE(nil, []byte{1}); return err },
+		"GetE":    func() error { _, _, err := bt.GetE([]byte{}); return err },
+		"DeleteE": func() error { _, err := bt.DeleteE(nil); return err },
+		"AppendE": func() error { return bt.AppendE(nil, []byte{1}) },
+	} {
+		if err := f(); !errors.Is(err, ErrEmptyKey) {
+			t.Error("Expected", name, "to fail with ErrEmptyKey, got", err)
+		}
+	}
+	if _, _, err := bt.GetE(long); !errors.Is(err, ErrKeyTooLong) {
+		t.Fatal("Expected GetE to fail with ErrKeyTooLong, got", err)
+	}
+
+	bt.Put([]byte("a"), []byte{1})
+	if ok, v, err := bt.GetE([]byte("a")); !ok || v[0] != 1 || err != nil {
+		t.Fatal("Expected to get the value, got", ok, v, err)
+	}
+	if deleted, err := bt.DeleteE([]byte("a")); !deleted || err != nil {
+		t.Fatal("Expected to delete the key, got", deleted, err)
+	}
+}
+
+func TestMaxKeySize(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	expectPanic := func(name string, f func()) {
+		defer func() {
+			if r := recover(); r != ErrKeyTooLong {
+				t.Error("Expected", name, "to panic with ErrKeyTooLong, got", r)
+			}
+		}()
+		f()
+	}
+
+	long := make([]byte, MaxKeySize+1)
+	if _, err := bt.PutE(long, []byte{1}); !errors.Is(err, ErrKeyTooLong) {
+		t.Fatal("Expected ErrKeyTooLong, got", err)
+	}
+	if err := bt.AppendE(long, []byte{1}); !errors.Is(err, ErrKeyTooLong) {
+		t.Fatal("Expected ErrKeyTooLong, got", err)
+	}
+	expectPanic("Put", func() { bt.Put(long, []byte{1}) })
+	expectPanic("PutIfAbsent", func() { bt.PutIfAbsent(long, []byte{1}) })
+	expectPanic("Append", func() { bt.Append(long, []byte{1}) })
+	expectPanic("PutNext", func() { bt.PutNext(long, []byte{1}) })
+	if bt.Size() != 0 {
+		t.Fatal("Did not expect any keys, got", bt.Size())
+	}
+
+	// keys at the limit split like any other
+	for i := 0; i < 100; i++ {
+		k := bytes.Repeat([]byte{byte(i)}, MaxKeySize)
+		if _, err := bt.PutE(k, k[:10]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bt.Size() != 100 {
+		t.Fatal("Expected 100 keys, got", bt.Size())
+	}
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSplitOversizedKey(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	_, _, pageRefs := bt.search([]byte{1})
+	defer func() {
+		r := recover()
+		if s, ok := r.(string); !ok || !strings.HasPrefix(s, "No room for a key") {
+			t.Fatal("Expected a panic about the key not fitting, got", r)
+		}
+	}()
+	bt.split(make([]byte, pageSize), 0, nil, pageRefs)
+}
+
+func TestOnOverwrite(t *testing.T) {
+	for _, opts := range []Options{{}, {InlineValues: 8}} {
+		var calls []string
+		opts.OnOverwrite = func(key, oldValue, newValue []byte) {
+			calls = append(calls, fmt.Sprintf("%s:%s>%s", key, oldValue, newValue))
+		}
+		bt := NewInMemoryBtreeWithOptions(opts).(*Btree)
+		bt.Put([]byte("a"), []byte("1"))
+		bt.PutIfAbsent([]byte("b"), []byte("1"))
+		bt.Append([]byte("c"), []byte("1"))
+		if len(calls) != 0 {
+			t.Fatal("Did not expect calls for new keys, got", calls)
+		}
+
+		bt.Put([]byte("a"), []byte("2"))
+		bt.PutIfAbsent([]byte("b"), []byte("2"))
+		bt.Append([]byte("c"), []byte("2"))
+		bt.Delete([]byte("a"))
+		bt.Put([]byte("a"), []byte("3"))
+		want := []string{"a:1>2", "c:1>12"}
+		if fmt.Sprint(calls) != fmt.Sprint(want) {
+			t.Fatal("Expected", want, "got", calls)
+		}
+	}
+}
+
+func TestStartDedupValues(t *testing.T) {
+	bt := NewInMemoryBtreeWithOptions(Options{AllowDuplicates: true}).(*Btree)
+	bt.Put([]byte("a"), []byte("1"))
+	bt.Put([]byte("b"), []byte("1"))
+	bt.Put([]byte("c"), []byte("2"))
+	bt.Put([]byte("c"), []byte("2"))
+	bt.Put([]byte("d"), []byte("1"))
+	bt.Put([]byte("e"), []byte("1"))
+
+	var got []bool
+	it := bt.StartDedupValues(nil)
+	for {
+		ok, _, _, same := it.Next()
+		if !ok {
+			break
+		}
+		got = append(got, same)
+	}
+	want := []bool{false, true, false, true, false, true}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatal("Expected", want, "got", got)
+	}
+}
+
+func TestRemaining(t *testing.T) {
+	bt := NewBtree()
+	for i := 0; i < 30000; i++ {
+		bt.Put([]byte(fmt.Sprintf("%c%05d", 'a'+i%3, i)), []byte{1})
+	}
+
+	it := bt.Start([]byte("b")).(RemainingIter)
+	for n := int64(10000); ; n-- {
+		if r := it.Remaining(); r < n*9/10-500 || r > n*11/10+500 {
+			t.Fatal("Expected about", n, "left, got", r)
+		}
+		if ok, _, _ := it.Next(); !ok {
+			break
+		}
+	}
+	if r := it.Remaining(); r != 0 {
+		t.Fatal("Expected nothing left at the end, got", r)
+	}
+}
+
+func TestDone(t *testing.T) {
+	bt := NewBtree()
+	for i := 0; i < 1000; i++ {
+		bt.Put([]byte(fmt.Sprintf("%04d", i)), []byte{1})
+	}
+	odd := func(key, value []byte) bool { return key[3]%2 == 1 }
+	for name, it := range map[string]indexes.Iter{
+		"Start":         bt.Start([]byte("01")),
+		"Range":         bt.Range([]byte("0100"), []byte("0200")),
+		"RangeReverse":  bt.RangeReverse([]byte("0100"), []byte("0200")),
+		"StartPrefixes": bt.StartPrefixes([][]byte{[]byte("01"), []byte("03")}),
+		"StartFilter":   bt.StartFilter([]byte("01"), odd),
+		"StartAfter":    bt.StartAfter([]byte("0990")),
+		"Start(nil)":    bt.Start(nil),
+	} {
+		n := 0
+		for {
+			if it.Done() {
+				t.Fatal(name, "done after", n, "keys before Next returned false")
+			}
+			if ok, _, _ := it.Next(); !ok {
+				break
+			}
+			n++
+		}
+		if !it.Done() || n == 0 {
+			t.Fatal(name, "not done after", n, "keys")
+		}
+	}
+}
+
+func TestStartWithTombstones(t *testing.T) {
+	bt := NewBtree()
+	bt.Put([]byte("a1"), []byte("1"))
+	bt.Put([]byte("a2"), []byte("2"))
+	bt.Put([]byte("a3"), []byte("3"))
+	bt.Put([]byte("b1"), []byte("4"))
+	bt.Delete([]byte("a2"))
+	bt.Delete([]byte("b1"))
+
+	scan := func() (got []string) {
+		it := bt.StartWithTombstones([]byte("a"))
+		for {
+			ok, k, v, deleted := it.Next()
+			if !ok {
+				break
+			}
+			got = append(got, fmt.Sprintf("%s=%s/%v", k, v, deleted))
+		}
+		return
+	}
+	want := []string{"a1=1/false", "a2=/true", "a3=3/false"}
+	if got := scan(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatal("Expected", want, "got", got)
+	}
+	if ok, _ := bt.Get([]byte("a2")); ok {
+		t.Fatal("Expected Get to skip the tombstone")
+	}
+	if ok, k, _ := bt.Start([]byte("a2")).Next(); ok {
+		t.Fatal("Expected Start to skip the tombstone, got", string(k))
+	}
+
+	bt.Sweep()
+	want = []string{"a1=1/false", "a3=3/false"}
+	if got := scan(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatal("Expected", want, "after Sweep, got", got)
+	}
+}
+
+func TestKeysPerPage(t *testing.T) {
+	check := func(name string, bt *Btree, keysPerPage int) {
+		for _, i := range rand.Perm(500) {
+			bt.Put([]byte(fmt.Sprintf("%04d", i)), []byte{1})
+		}
+		for i := 500; i < 600; i++ {
+			bt.Put([]byte(fmt.Sprintf("%04d", i)), []byte{1})
+		}
+		if err := bt.CheckConsistency(); err != nil {
+			t.Fatal(name, err)
+		}
+		if bt.Size() != 600 || bt.Stats().Splits < 600/4 {
+			t.Fatal(name, "expected 600 keys and many splits, got", bt.Size(), bt.Stats().Splits)
+		}
+		for ref, page := range bt.pager.(*inplacePager).pages {
+			if page != nil && page.Size() > keysPerPage {
+				t.Fatal(name, "expected at most", keysPerPage, "keys in page", ref, "got", page.Size())
+			}
+		}
+	}
+	check("plain", NewTestBtree(4), 4)
+	check("prefix", NewInMemoryBtreeWithOptions(Options{KeysPerPage: 4, LeafFormat: PrefixCompressed}).(*Btree), 4)
+	check("right", NewInMemoryBtreeWithOptions(Options{KeysPerPage: 5, Split: SplitRight}).(*Btree), 5)
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected KeysPerPage 3 to panic")
+		}
+	}()
+	NewTestBtree(3)
+}
+
+func TestNewBtree(t *testing.T) {
+	var index indexes.Index = NewBtree()
+	index.Put([]byte{1}, []byte{2})
+	bt := NewBtreeWithOptions(Options{AllowDuplicates: true})
+	bt.Put([]byte{1}, []byte{2})
+	bt.Put([]byte{1}, []byte{3})
+	if index.Size() != 1 || bt.Size() != 2 || bt.Stats().NumLeafPages != 1 {
+		t.Fatal("Expected the options to apply, got", index.Size(), bt.Size())
+	}
+}
+
+// A Pager that counts the pages in use.
+type countingPager struct {
+	*inplacePager
+	live int
+}
+
+func (p *countingPager) New(isLeaf bool) (int, Page) {
+	p.live++
+	return p.inplacePager.New(isLeaf)
+}
+
+func (p *countingPager) Release(ref int) {
+	p.live--
+	p.inplacePager.Release(ref)
+}
+
+var errFault = errors.New("Injected fault")
+
+// A Pager that fails the failAt'th Get after it is armed. The Pager
+// interface has no way for Get to return an error, so it panics with
+// errFault, as a pager that cannot read a page has to.
+type faultPager struct {
+	Pager
+	failAt, gets int
+}
+
+func (p *faultPager) arm(failAt int) {
+	p.failAt, p.gets = failAt, 0
+}
+
+func (p *faultPager) Get(ref int) Page {
+	if p.failAt > 0 {
+		p.gets++
+		if p.gets == p.failAt {
+			p.failAt = 0
+			panic(errFault)
+		}
+	}
+	return p.Pager.Get(ref)
+}
+
+// Run f and return what it panicked with.
+func recovered(f func()) (r interface{}) {
+	defer func() { r = recover() }()
+	f()
+	return
+}
+
+func TestFaultPager(t *testing.T) {
+	pager := &faultPager{Pager: newInplacePager()}
+	bt := NewWithPager(pager)
+	for i := 0; i < 10000; i++ {
+		bt.Put([]byte(fmt.Sprintf("%05d", i)), []byte{byte(i)})
+	}
+
+	for failAt := 1; failAt <= 2; failAt++ {
+		pager.arm(failAt)
+		if r := recovered(func() { bt.Get([]byte("05000")) }); r != errFault {
+			t.Fatal("Expected Get to fail on read", failAt, "got", r)
+		}
+	}
+	it := bt.Start(nil).(ErrIter)
+	pager.arm(3)
+	n := 0
+	for ok, _, _ := it.Next(); ok; ok, _, _ = it.Next() {
+		n++
+	}
+	if it.Err() != errFault || it.Done() || n == 0 || n == 10000 {
+		t.Fatal("Expected the iteration to stop early with the fault, got", it.Err(), it.Done(), n)
+	}
+	if ok, _, _ := it.Next(); ok || it.Err() != errFault {
+		t.Fatal("Expected the iteration to stay stopped")
+	}
+
+	for name, it := range map[string]indexes.Iter{
+		"Range":      bt.Range([]byte("0"), []byte("1")),
+		"StartAfter": bt.StartAfter([]byte("00010")),
+		"Prefixes":   bt.StartPrefixes([][]byte{[]byte("0"), []byte("1")}),
+		"Filter":     bt.StartFilter(nil, func(key, value []byte) bool { return true }),
+		"TimeRange":  bt.StartTimeRange([]byte("0"), []byte("1")),
+	} {
+		pager.arm(1)
+		for ok, _, _ := it.Next(); ok; ok, _, _ = it.Next() {
+		}
+		if it.Done() || it.(ErrIter).Err() != errFault {
+			t.Fatal("Expected", name, "to stop with the fault, got", it.Done(), it.(ErrIter).Err())
+		}
+	}
+
+	var reused ReusableIter
+	bt.StartReuse(nil, &reused)
+	pager.arm(1)
+	for ok, _, _ := reused.Next(); ok; ok, _, _ = reused.Next() {
+	}
+	if reused.Err() != errFault {
+		t.Fatal("Expected the reused iterator to fail, got", reused.Err())
+	}
+	bt.StartReuse(nil, &reused)
+	if reused.Err() != nil {
+		t.Fatal("Expected StartReuse to clear the error")
+	}
+
+	// failed reads must leave the tree as it was
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10000; i++ {
+		if ok, v := bt.Get([]byte(fmt.Sprintf("%05d", i))); !ok || v[0] != byte(i) {
+			t.Fatal("Expected", i, "to survive the faults, got", ok, v)
+		}
+	}
+}
+
+func TestNewWithPager(t *testing.T) {
+	pager := &countingPager{inplacePager: newInplacePager()}
+	bt := NewWithPager(pager)
+	if pager.live != 2 {
+		t.Fatal("Expected a root and a leaf, got", pager.live)
+	}
+	for i := 0; i < 10000; i++ {
+		bt.Put([]byte(fmt.Sprintf("%05d", i)), []byte{1})
+	}
+	for i := 0; i < 10000; i += 3 {
+		bt.Delete([]byte(fmt.Sprintf("%05d", i)))
+	}
+	bt.Put([]byte("big"), make([]byte, 2*pageSize))
+	bt.Sweep()
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bt.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	s := bt.Stats()
+	if n := s.NumLeafPages + s.NumInternalPages; pager.live != n {
+		t.Fatal("Expected Sweep to release the old pages, got", pager.live, "in use for", n)
+	}
+	if s.NumOverflowPages != 2 {
+		t.Fatal("Expected Sweep to release the old overflow pages, got", s.NumOverflowPages)
+	}
+}
+
+func TestEmptyTree(t *testing.T) {
+	emptied := NewBtree()
+	for i := 0; i < 10000; i++ {
+		emptied.Put([]byte(fmt.Sprintf("%05d", i)), []byte{1})
+	}
+	for i := 0; i < 10000; i++ {
+		emptied.Delete([]byte(fmt.Sprintf("%05d", i)))
+	}
+	swept := NewBtree()
+	swept.Put([]byte{1}, []byte{1})
+	swept.Delete([]byte{1})
+	swept.Sweep()
+
+	trees := []*Btree{emptied, swept}
+	for _, opts := range []Options{{}, {LeafFormat: PrefixCompressed}, {AllowDuplicates: true}, {CacheLastLeaf: true}} {
+		trees = append(trees, NewBtreeWithOptions(opts))
+	}
+	for _, bt := range trees {
+		for _, k := range [][]byte{{0}, {1, 2, 3}, {255, 255}} {
+			if ok, v := bt.Get(k); ok || v != nil {
+				t.Fatal("Did not expect to find", k, "got", v)
+			}
+			if v := bt.GetAll(k); v != nil {
+				t.Fatal("Did not expect values for", k, "got", v)
+			}
+			for _, it := range []indexes.Iter{bt.Start(k), bt.StartAfter(k), bt.Range(k, nil), bt.RangeReverse([]byte{}, k)} {
+				if ok, key, _ := it.Next(); ok {
+					t.Fatal("Did not expect a key, got", key)
+				}
+			}
+			if bt.OpenCursor(k).Next() {
+				t.Fatal("Did not expect the cursor to move")
+			}
+			if bt.Delete(k) {
+				t.Fatal("Did not expect to delete", k)
+			}
+		}
+		if ok, _, _ := bt.Start(nil).Next(); ok {
+			t.Fatal("Did not expect a key")
+		}
+		if n := bt.CountRange([]byte{}, []byte{255}, true, true); n != 0 {
+			t.Fatal("Expected no keys, got", n)
+		}
+		if h := bt.Histogram(4); len(h) != 0 {
+			t.Fatal("Expected no boundaries, got", h)
+		}
+		if err := bt.CheckConsistency(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTruncateTo(t *testing.T) {
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%06d", i)) }
+	for _, opts := range []Options{{}, {LeafFormat: PrefixCompressed}, {InlineValues: 8}, {KeysPerPage: 4}} {
+		for _, n := range []int64{0, 1, 777, 4499, 4500, 9000} {
+			bt := NewBtreeWithOptions(opts)
+			for i := 0; i < 5000; i++ {
+				bt.Put(key(i), key(i))
+			}
+			bt.Put(key(5), make([]byte, 2*pageSize))
+			bt.Put(key(3000), make([]byte, 2*pageSize))
+			for i := 0; i < 5000; i += 10 {
+				bt.Delete(key(i))
+			}
+
+			bt.TruncateTo(n)
+			want := n
+			if want > 4500 {
+				want = 4500
+			}
+			if bt.Size() != want {
+				t.Fatal("Expected", want, "keys, got", bt.Size())
+			}
+			if err := bt.CheckConsistency(); err != nil {
+				t.Fatal(err)
+			}
+			count := int64(0)
+			for k, v := range bt.All() {
+				if len(v) != 2*pageSize && !bytes.Equal(k, v) {
+					t.Fatal("Unexpected value", v, "for", k)
+				}
+				count++
+			}
+			if count != want {
+				t.Fatal("Expected to iterate over", want, "keys, got", count)
+			}
+			if n == 777 && bt.tombstones != 87 {
+				t.Fatal("Expected the tombstones before the cut to stay, got", bt.tombstones)
+			}
+			if n == 777 && bt.Stats().NumOverflowPages != 2 {
+				t.Fatal("Expected the overflow pages past the cut to go, got", bt.Stats().NumOverflowPages)
+			}
+			bt.Put(key(1000000), []byte{1})
+			if err := bt.CheckConsistency(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	bt := NewBtreeWithOptions(Options{AllowDuplicates: true})
+	for i := 0; i < 5; i++ {
+		bt.Put([]byte{1}, []byte{byte(i)})
+		bt.Put([]byte{2}, []byte{byte(i)})
+	}
+	bt.TruncateTo(7)
+	if v := bt.GetAll([]byte{2}); bt.Size() != 7 || len(v) != 2 || v[1][0] != 1 {
+		t.Fatal("Expected to keep the first two values of the second key, got", bt.Size(), v)
+	}
+}
+
+type countingObserver struct {
+	hits, misses, puts, replaces, splits, iters int
+}
+
+func (o *countingObserver) OnGet(hit bool) {
+	if hit {
+		o.hits++
+	} else {
+		o.misses++
+	}
+}
+
+func (o *countingObserver) OnPut(replaced bool) {
+	if replaced {
+		o.replaces++
+	} else {
+		o.puts++
+	}
+}
+
+func (o *countingObserver) OnSplit()     { o.splits++ }
+func (o *countingObserver) OnIterStart() { o.iters++ }
+
+func TestObserver(t *testing.T) {
+	o := &countingObserver{}
+	bt := NewBtreeWithOptions(Options{Observer: o})
+	for i := 0; i < 10000; i++ {
+		bt.Put([]byte(fmt.Sprintf("%05d", i)), []byte{1})
+	}
+	bt.Put([]byte("00001"), []byte{2})
+	bt.PutIfAbsent([]byte("00002"), []byte{2})
+	bt.PutIfAbsent([]byte("x"), []byte{2})
+	bt.Get([]byte("00001"))
+	bt.Get([]byte("y"))
+	bt.Start(nil)
+	bt.StartReuse(nil, &ReusableIter{})
+
+	want := countingObserver{hits: 1, misses: 1, puts: 10001, replaces: 1, splits: int(bt.Stats().Splits), iters: 2}
+	if *o != want || o.splits == 0 {
+		t.Fatal("Expected", want, "got", *o)
+	}
+}
+
+type timingObserver struct {
+	countingObserver
+	gets, puts, splits int
+	total              time.Duration
+}
+
+func (o *timingObserver) OnGetDone(d time.Duration, hit bool)      { o.gets++; o.total += d }
+func (o *timingObserver) OnPutDone(d time.Duration, replaced bool) { o.puts++; o.total += d }
+func (o *timingObserver) OnSplitDone(d time.Duration)              { o.splits++; o.total += d }
+
+func TestTimingObserver(t *testing.T) {
+	o := &timingObserver{}
+	bt := NewBtreeWithOptions(Options{Observer: o})
+	for i := 0; i < 10000; i++ {
+		bt.Put([]byte(fmt.Sprintf("%05d", i)), []byte{1})
+	}
+	bt.PutIfAbsent([]byte("00002"), []byte{2})
+	bt.PutIfAbsent([]byte("x"), []byte{2})
+	bt.Get([]byte("00001"))
+
+	if o.gets != 1 || o.puts != 10001 || o.splits != o.countingObserver.splits || o.splits == 0 || o.total <= 0 {
+		t.Fatal("Expected a timing for every get, put and split, got", o.gets, o.puts, o.splits, o.total)
+	}
+}
+
+func TestStartFilter(t *testing.T) {
+	bt := NewBtree()
+	for i := 0; i < 1000; i++ {
+		bt.Put([]byte(fmt.Sprintf("%c%03d", 'a'+i%2, i)), []byte{byte(i % 10)})
+	}
+	it := bt.StartFilter([]byte("a"), func(key, value []byte) bool { return value[0] == 4 })
+	n := 0
+	for {
+		ok, k, v := it.Next()
+		if !ok {
+			break
+		}
+		if k[0] != 'a' || v[0] != 4 {
+			t.Fatal("Did not expect", string(k), v)
+		}
+		n++
+	}
+	if n != 100 {
+		t.Fatal("Expected 100 keys, got", n)
+	}
+}
+
 func TestBtreeOverride(t *testing.T) {
 	index := NewInMemoryBtree()
 	ok, value := index.Get([]byte{1, 2, 3})
@@ -224,7 +1001,7 @@ func TestShortIter(t *testing.T) {
 	}
 }
 
-func fill(t *testing.T, index indexes.Index) (keys [][]byte) {
+func fill(t testing.TB, index indexes.Index) (keys [][]byte) {
 	buffer := &bytes.Buffer{}
 	count := int32(0)
 
@@ -347,3 +1124,765 @@ func TestBulk(t *testing.T) {
 	t.Log("Bulk filled used pages:", len(bt.pager.(*inplacePager).pages))
 	t.Log("Random filled used pages:", len(index1.(*Btree).pager.(*inplacePager).pages))
 }
+
+func TestPutNextTail(t *testing.T) {
+	bt := NewBtree()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%06d", i)) }
+	for i := 0; i < 100000; i += 2 {
+		bt.PutNext(key(i), key(i))
+		// puts behind the tail split the pages on its path
+		if i%100 == 0 {
+			bt.Put(key(i/2+1), key(i/2+1))
+		}
+		if i%1000 == 0 {
+			bt.Delete(key(i))
+		}
+	}
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100000; i += 2 {
+		if ok, v := bt.Get(key(i)); ok != (i%1000 != 0) || ok && string(v) != string(key(i)) {
+			t.Fatal("Expected", string(key(i)), "got", ok, string(v))
+		}
+	}
+}
+
+func BenchmarkPutNext10M(b *testing.B) {
+	const n = 10000000
+	k := make([]byte, 8)
+	v := make([]byte, 8)
+	for i := 0; i < b.N; i++ {
+		bt := NewBtree()
+		for j := 0; j < n; j++ {
+			binary.BigEndian.PutUint64(k, uint64(j))
+			bt.PutNext(k, v)
+		}
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	index := NewInMemoryBtree()
+	bt := index.(*Btree)
+	empty := bt.ByteSize()
+	if empty <= 0 {
+		t.Fatal("Expected the empty tree to hold some pages, got", empty)
+	}
+
+	bt.Put([]byte{1}, make([]byte, 1000))
+	if bt.ByteSize() < empty+1000 {
+		t.Fatal("Expected value bytes to be counted:", empty, bt.ByteSize())
+	}
+
+	bt.Put([]byte{1}, make([]byte, 10))
+	bt.Append([]byte{1}, make([]byte, 5))
+	if bt.valueBytes != 15 {
+		t.Fatal("Expected 15 value bytes after overwrite and append, got", bt.valueBytes)
+	}
+
+	fill(t, index)
+	if bt.ByteSize() <= empty+int64(bt.Size())*8 {
+		t.Fatal("Expected ByteSize to grow with the tree:", bt.ByteSize())
+	}
+}
+
+func TestStartReuse(t *testing.T) {
+	index := NewInMemoryBtree()
+	fill(t, index)
+	bt := index.(*Btree)
+
+	var it ReusableIter
+	for _, prefix := range [][]byte{{4}, {}, {4, 1}, {200, 200, 200, 200, 200}} {
+		expected := index.Start(prefix)
+		bt.StartReuse(prefix, &it)
+		for {
+			ok1, k1, v1 := expected.Next()
+			ok2, k2, v2 := it.Next()
+			if ok1 != ok2 || bytes.Compare(k1, k2) != 0 || bytes.Compare(v1, v2) != 0 {
+				t.Fatal("Not the same:", prefix, ok1, ok2, k1, k2, v1, v2)
+			}
+			if !ok1 {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkStart(b *testing.B) {
+	index := NewInMemoryBtree()
+	fill(b, index)
+	prefix := []byte{4, 1}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := index.Start(prefix)
+		for ok, _, _ := it.Next(); ok; ok, _, _ = it.Next() {
+		}
+	}
+}
+
+func BenchmarkStartReuse(b *testing.B) {
+	index := NewInMemoryBtree()
+	fill(b, index)
+	bt := index.(*Btree)
+	prefix := []byte{4, 1}
+
+	var it ReusableIter
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bt.StartReuse(prefix, &it)
+		for ok, _, _ := it.Next(); ok; ok, _, _ = it.Next() {
+		}
+	}
+}
+
+func TestSearchScratch(t *testing.T) {
+	index := NewInMemoryBtree()
+	keys := fill(t, index)
+	bt := index.(*Btree)
+
+	// Appending to existing and new keys does nested searches
+	// through Put. Neither may clobber the other's pageRefs.
+	for i, k := range keys {
+		if i%2 == 0 {
+			bt.Append(k, []byte{1})
+		} else {
+			k2 := append(copyBytes(k), 1)
+			bt.Append(k2, k2)
+		}
+	}
+
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if bt.Size() != int64(len(keys)+len(keys)/2) {
+		t.Fatal("Expected", len(keys)+len(keys)/2, "got", bt.Size())
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	index := NewInMemoryBtree()
+	keys := fill(b, index)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index.Get(keys[i%len(keys)])
+	}
+}
+
+func TestCacheLastLeaf(t *testing.T) {
+	bt := NewInMemoryBtreeWithOptions(Options{CacheLastLeaf: true}).(*Btree)
+	key := func(i int) []byte {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, uint64(i))
+		return k
+	}
+	for i := 0; i < 100000; i += 2 {
+		bt.Put(key(i), key(i))
+	}
+
+	check := func() {
+		for i := 0; i < 100000; i++ {
+			ok, v := bt.Get(key(i))
+			if ok != (i%2 == 0) || (ok && !bytes.Equal(v, key(i))) {
+				t.Fatal("Unexpected", ok, v, "for", i)
+			}
+		}
+	}
+	check()
+	if s := bt.Stats(); s.LeafCacheHits < 10*s.LeafCacheMisses {
+		t.Fatal("Expected mostly hits for keys in order, got", s.LeafCacheHits, s.LeafCacheMisses)
+	}
+
+	// split the cached leaf, then move it
+	bt.Get(key(50000))
+	for i := 50001; i < 52000; i += 2 {
+		bt.Put(key(i), key(i))
+	}
+	for i := 0; i < 100000; i += 100 {
+		bt.Delete(key(i))
+	}
+	bt.Sweep()
+	bt.Get(key(50002))
+	bt.Defrag()
+	for i := 0; i < 100000; i++ {
+		ok, _ := bt.Get(key(i))
+		want := (i%2 == 0 || (i > 50000 && i < 52000)) && i%100 != 0
+		if ok != want {
+			t.Fatal("Expected", want, "for", i)
+		}
+	}
+}
+
+func BenchmarkGetZipf(b *testing.B) {
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprint("cached=", cached), func(b *testing.B) {
+			bt := NewInMemoryBtreeWithOptions(Options{CacheLastLeaf: cached}).(*Btree)
+			keys := make([][]byte, 100000)
+			for i := range keys {
+				keys[i] = make([]byte, 8)
+				binary.BigEndian.PutUint64(keys[i], uint64(i))
+				bt.Put(keys[i], keys[i])
+			}
+			zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.5, 1, uint64(len(keys)-1))
+			lookups := make([][]byte, 1<<16)
+			for i := range lookups {
+				lookups[i] = keys[zipf.Uint64()]
+			}
+
+			bt.ResetStats()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bt.Get(lookups[i%len(lookups)])
+			}
+			s := bt.Stats()
+			if cached {
+				b.ReportMetric(float64(s.LeafCacheHits)/float64(s.LeafCacheHits+s.LeafCacheMisses), "hit-rate")
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	index := NewInMemoryBtree()
+	fill(t, index)
+	bt := index.(*Btree)
+	if err := bt.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	pager := bt.pager.(*inplacePager)
+	ref := len(pager.pages) - 1
+	pager.pages[ref].(*inplacePage).data[0] ^= 0xFF
+	err := bt.Verify()
+	if cpe, ok := err.(*CorruptPageError); !ok || cpe.Ref != ref {
+		t.Fatal("Expected page", ref, "to be corrupt, got", err)
+	}
+}
+
+func TestVerifyReads(t *testing.T) {
+	pager := newInplacePager()
+	bt := NewWithPagerAndOptions(pager, Options{VerifyReads: true})
+	for i := 0; i < 10000; i++ {
+		bt.Put([]byte(fmt.Sprintf("%05d", i)), []byte{byte(i)})
+	}
+	if _, _, err := bt.GetE([]byte("05000")); err != nil {
+		t.Fatal(err)
+	}
+
+	// every path goes through the root
+	root := pager.pages[bt.root].(*inplacePage)
+	root.data[root.offsets[1]+2] ^= 0xFF
+	var cpe *CorruptPageError
+	if _, _, err := bt.GetE([]byte("05000")); !errors.As(err, &cpe) || cpe.Ref != bt.root || !errors.Is(err, ErrChecksum) {
+		t.Fatal("Expected GetE to find the root corrupt, got", err)
+	}
+	if r := recovered(func() { bt.Get([]byte("05000")) }); r == nil {
+		t.Fatal("Expected Get to panic on the corrupt root")
+	}
+	var reused ReusableIter
+	bt.StartReuse(nil, &reused)
+	for name, it := range map[string]indexes.Iter{
+		"Start":      bt.Start(nil),
+		"Range":      bt.Range([]byte("0"), []byte("1")),
+		"StartAfter": bt.StartAfter([]byte("00010")),
+		"Prefixes":   bt.StartPrefixes([][]byte{[]byte("0"), []byte("1")}),
+		"Filter":     bt.StartFilter(nil, func(key, value []byte) bool { return true }),
+		"TimeRange":  bt.StartTimeRange([]byte("0"), []byte("1")),
+		"Reuse":      &reused,
+	} {
+		if ok, _, _ := it.Next(); ok || it.Done() || !errors.Is(it.(ErrIter).Err(), ErrChecksum) {
+			t.Fatal("Expected", name, "to stop on the corrupt root, got", it.(ErrIter).Err())
+		}
+	}
+
+	root.data[root.offsets[1]+2] ^= 0xFF
+	if ok, v, err := bt.GetE([]byte("05000")); !ok || err != nil || v[0] != byte(5000%256) {
+		t.Fatal("Expected to read again once the root is restored, got", ok, v, err)
+	}
+}
+
+func TestQuickCheck(t *testing.T) {
+	bt := NewBtree()
+	if err := bt.QuickCheck(1); err != nil {
+		t.Fatal(err)
+	}
+	fill(t, bt)
+	for _, rate := range []float64{0.01, 0.5, 1} {
+		if err := bt.QuickCheck(rate); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every path goes through the root
+	pager := bt.pager.(*inplacePager)
+	root := pager.pages[bt.root].(*inplacePage)
+	root.data[root.offsets[1]+8] ^= 0xFF
+	if _, ok := bt.QuickCheck(0.01).(*CorruptPageError); !ok {
+		t.Fatal("Expected a corrupt root")
+	}
+	root.data[root.offsets[1]+8] ^= 0xFF
+
+	last := bt.pager.Get(bt.root)
+	for !last.IsLeaf() {
+		_, r := last.GetKey(last.Size() - 1)
+		last = bt.pager.Get(r)
+	}
+	last.SetNextPage(bt.root)
+	if err := bt.QuickCheck(0.01); err == nil {
+		t.Fatal("Expected a broken leaf chain")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	index := NewInMemoryBtree()
+	keys := fill(t, index)
+	bt := index.(*Btree)
+
+	if bt.Delete([]byte{200, 200, 200, 200, 200}) {
+		t.Fatal("Did not expect to delete a missing key")
+	}
+
+	deleted := make(map[string]bool)
+	for i, k := range keys {
+		if i%3 != 0 {
+			continue
+		}
+		if !bt.Delete(k) {
+			t.Fatal("Expected to delete", k)
+		}
+		if bt.Delete(k) {
+			t.Fatal("Did not expect to delete", k, "twice")
+		}
+		deleted[string(k)] = true
+	}
+
+	check := func() {
+		if bt.Size() != int64(len(keys)-len(deleted)) {
+			t.Fatal("Expected", len(keys)-len(deleted), "got", bt.Size())
+		}
+		for _, k := range keys {
+			ok, v := bt.Get(k)
+			if ok == deleted[string(k)] {
+				t.Fatal("Expected", k, "deleted:", deleted[string(k)], "got", ok, v)
+			}
+		}
+		if err := bt.CheckConsistency(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check()
+
+	// revive one
+	if bt.Put(keys[0], keys[0]) {
+		t.Fatal("Did not expect reviving a deleted key to replace it")
+	}
+	delete(deleted, string(keys[0]))
+	check()
+
+	removed := bt.Sweep()
+	if removed != int64(len(deleted)) {
+		t.Fatal("Expected to sweep", len(deleted), "got", removed)
+	}
+	check()
+	if bt.Sweep() != 0 {
+		t.Fatal("Expected nothing left to sweep")
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	bt := NewBtree()
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		k := []byte(fmt.Sprint(r.Intn(20000)))
+		bt.Put(k, k)
+	}
+	before := bt.Checksum()
+	fill := bt.Stats().FillRate
+
+	bt.Rebuild()
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if bt.Checksum() != before {
+		t.Fatal("Expected the same keys and values after Rebuild")
+	}
+	t.Log("fill rate", fill, "->", bt.Stats().FillRate)
+	if after := bt.Stats().FillRate; after < 0.75 || after <= fill {
+		t.Fatal("Expected Rebuild to fill the pages, got", after, "from", fill)
+	}
+}
+
+func TestStartSizes(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	bt.Put([]byte{1, 1}, []byte{1})
+	bt.Put([]byte{1, 2}, make([]byte, 2*pageSize))
+	bt.Put([]byte{1, 3}, []byte{})
+	bt.Put([]byte{2, 1}, []byte{1, 2, 3})
+	bt.Delete([]byte{1, 1})
+
+	expected := []int{2 * pageSize, 0}
+	it := bt.StartSizes([]byte{1})
+	for i := 0; ; i++ {
+		ok, k, n := it.Next()
+		if !ok {
+			if i != len(expected) {
+				t.Fatal("Expected", len(expected), "keys, got", i)
+			}
+			break
+		}
+		if i >= len(expected) || n != expected[i] {
+			t.Fatal("Unexpected size", k, n)
+		}
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	index := NewInMemoryBtree()
+	keys := fill(t, index)
+	bt := index.(*Btree)
+
+	before := bt.Stats()
+	bt.ResetStats()
+	after := bt.Stats()
+	if after.Finds != 0 || after.Comparisons != 0 {
+		t.Fatal("Expected counters to be reset:", after)
+	}
+	if after.NumLeafPages != before.NumLeafPages || after.NumInternalPages != before.NumInternalPages || after.FillRate != before.FillRate {
+		t.Fatal("Did not expect structural stats to change:", before, after)
+	}
+
+	bt.Get(keys[0])
+	if bt.Stats().Finds == 0 {
+		t.Fatal("Expected Get to count finds")
+	}
+}
+
+func TestOpStats(t *testing.T) {
+	index := NewInMemoryBtree()
+	keys := fill(t, index)
+	bt := index.(*Btree)
+	bt.ResetStats()
+
+	for _, k := range keys[:100] {
+		bt.Get(k)
+	}
+	bt.Start([]byte{4})
+
+	stats := bt.Stats()
+	if stats.Put.Finds != 0 {
+		t.Fatal("Expected no puts since the reset, got", stats.Put)
+	}
+	if stats.Get.Finds < 100 || stats.Start.Finds == 0 {
+		t.Fatal("Expected Get and Start to be counted, got", stats.Get, stats.Start)
+	}
+	if stats.Get.Finds+stats.Start.Finds != stats.Finds || stats.Get.Comparisons+stats.Start.Comparisons != stats.Comparisons {
+		t.Fatal("Expected the breakdown to add up:", stats)
+	}
+	if cpf := stats.Get.ComparisonsPerFind(); cpf < 1 || cpf > 20 {
+		t.Fatal("Expected about log2 of the keys per page comparisons per find, got", cpf)
+	}
+	t.Log(stats.ComparisonsPerFind(), stats.Get.ComparisonsPerFind(), stats.Start.ComparisonsPerFind())
+}
+
+func TestCheckConsistencyLeafChain(t *testing.T) {
+	index := NewInMemoryBtree()
+	fill(t, index)
+	bt := index.(*Btree)
+	pager := bt.pager.(*inplacePager)
+
+	// find a leaf in the middle of the chain and make it skip its
+	// successor
+	var leaf Page
+	for _, p := range pager.pages {
+		if p.IsLeaf() && p.NextPage() != -1 && pager.pages[p.NextPage()].NextPage() != -1 {
+			leaf = p
+			break
+		}
+	}
+	next := leaf.NextPage()
+	leaf.SetNextPage(pager.pages[next].NextPage())
+
+	err := bt.CheckConsistency()
+	if err == nil || !strings.HasPrefix(err.Error(), "Leaf chain") {
+		t.Fatal("Expected the broken leaf chain to be caught, got", err)
+	}
+	t.Log(err)
+
+	// and loop back to itself
+	leaf.SetNextPage(pager.pages[next].PrevPage())
+	err = bt.CheckConsistency()
+	if err == nil || !strings.HasPrefix(err.Error(), "Leaf chain: cycle") {
+		t.Fatal("Expected the cycle to be caught, got", err)
+	}
+	t.Log(err)
+
+	leaf.SetNextPage(next)
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a key out of order deep in the tree must say where it is
+	first, _ := leaf.GetKey(0)
+	last, _ := leaf.GetKey(leaf.Size() - 1)
+	copy(last, first)
+	err = bt.CheckConsistency()
+	if err == nil || !strings.HasPrefix(err.Error(), "Page ") {
+		t.Fatal("Expected the out of order key to be caught, got", err)
+	}
+	t.Log(err)
+}
+
+func TestAllowDuplicates(t *testing.T) {
+	bt := NewInMemoryBtreeWithOptions(Options{AllowDuplicates: true}).(*Btree)
+	keys := fill(t, bt)
+	for _, k := range keys[:1000] {
+		if bt.Put(k, []byte{1}) {
+			t.Fatal("Did not expect a duplicate to replace")
+		}
+	}
+	bt.Put(keys[0], []byte{2})
+	if bt.Size() != int64(len(keys)+1001) {
+		t.Fatal("Expected", len(keys)+1001, "got", bt.Size())
+	}
+
+	values := bt.GetAll(keys[0])
+	if len(values) != 3 || bytes.Compare(values[0], keys[0]) != 0 || values[1][0] != 1 || values[2][0] != 2 {
+		t.Fatal("Expected all values in insertion order, got", values)
+	}
+	if ok, v := bt.Get(keys[0]); !ok || bytes.Compare(v, keys[0]) != 0 {
+		t.Fatal("Expected Get to return the first value, got", ok, v)
+	}
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	it := bt.Start(keys[0])
+	for ok, _, _ := it.Next(); ok; ok, _, _ = it.Next() {
+		n++
+	}
+	if n != 3 {
+		t.Fatal("Expected iteration to yield the key 3 times, got", n)
+	}
+
+	bt.Delete(keys[0])
+	if bt.Size() != int64(len(keys)+998) || bt.GetAll(keys[0]) != nil {
+		t.Fatal("Expected Delete to remove all values, got", bt.Size(), bt.GetAll(keys[0]))
+	}
+
+	bt.Sweep()
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if len(bt.GetAll(keys[1])) != 2 || bt.Size() != int64(len(keys)+998) {
+		t.Fatal("Expected Sweep to keep duplicates, got", bt.GetAll(keys[1]), bt.Size())
+	}
+
+	unique := NewInMemoryBtree().(*Btree)
+	unique.Put([]byte{1}, []byte{1})
+	unique.Put([]byte{1}, []byte{2})
+	if values := unique.GetAll([]byte{1}); len(values) != 1 || values[0][0] != 2 {
+		t.Fatal("Expected the default to keep unique keys, got", values)
+	}
+}
+
+func TestSplitRight(t *testing.T) {
+	fillRate := func(opts Options) float64 {
+		bt := NewInMemoryBtreeWithOptions(opts).(*Btree)
+		buf := &bytes.Buffer{}
+		for i := int64(0); i < 100000; i++ {
+			binary.Write(buf, binary.BigEndian, i)
+			bt.Put(buf.Bytes(), buf.Bytes())
+			buf.Reset()
+		}
+		if err := bt.CheckConsistency(); err != nil {
+			t.Fatal(err)
+		}
+		return bt.Stats().FillRate
+	}
+
+	middle := fillRate(Options{})
+	right := fillRate(Options{Split: SplitRight})
+	t.Log("middle:", middle, "right:", right)
+	if right < 0.9 || right <= middle {
+		t.Fatal("Expected SplitRight to fill pages for increasing keys, got", right, "vs", middle)
+	}
+
+	// random inserts must still work
+	index := NewInMemoryBtreeWithOptions(Options{Split: SplitRight})
+	fill(t, index)
+}
+
+func TestRotateToSiblings(t *testing.T) {
+	fillRate := func(opts Options, n int) float64 {
+		bt := NewBtreeWithOptions(opts)
+		r := rand.New(rand.NewSource(1))
+		want := map[string][]byte{}
+		for i := 0; i < n; i++ {
+			k := []byte(fmt.Sprint(r.Int63()))
+			v := k[:r.Intn(len(k))]
+			bt.Put(k, v)
+			want[string(k)] = v
+		}
+		if err := bt.CheckConsistency(); err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range want {
+			if ok, got := bt.Get([]byte(k)); !ok || !bytes.Equal(got, v) {
+				t.Fatal("Expected", v, "for", k, "got", ok, got)
+			}
+		}
+		if opts.RotateToSiblings && bt.Stats().Rotations == 0 {
+			t.Fatal("Expected keys to move to siblings")
+		}
+		return bt.Stats().FillRate
+	}
+
+	split := fillRate(Options{}, 20000)
+	rotate := fillRate(Options{RotateToSiblings: true}, 20000)
+	t.Log("split:", split, "rotate:", rotate)
+	if rotate <= split {
+		t.Fatal("Expected rotating to fill pages better, got", rotate, "vs", split)
+	}
+	fillRate(Options{RotateToSiblings: true, InlineValues: 8}, 20000)
+	fillRate(Options{RotateToSiblings: true, KeysPerPage: 8}, 2000)
+	fillRate(Options{RotateToSiblings: true, LeafFormat: PrefixCompressed}, 5000)
+}
+
+func TestOnSplit(t *testing.T) {
+	var leafSplits, internalSplits [][]byte
+	onSplit := func(splitKey []byte, leaf bool) {
+		if leaf {
+			leafSplits = append(leafSplits, copyBytes(splitKey))
+		} else {
+			internalSplits = append(internalSplits, copyBytes(splitKey))
+		}
+	}
+	bt := NewInMemoryBtreeWithOptions(Options{OnSplit: onSplit}).(*Btree)
+	buf := &bytes.Buffer{}
+	for i := int64(0); i < 100000; i++ {
+		binary.Write(buf, binary.BigEndian, i)
+		bt.Put(buf.Bytes(), buf.Bytes())
+		buf.Reset()
+	}
+
+	if int64(len(leafSplits)+len(internalSplits)) != bt.Stats().Splits {
+		t.Fatal("Expected a call per split, got", len(leafSplits)+len(internalSplits), bt.Stats().Splits)
+	}
+
+	// each leaf split starts a leaf
+	boundaries := make(map[string]bool)
+	for _, k := range bt.LeafBoundaries() {
+		boundaries[string(k)] = true
+	}
+	for _, k := range leafSplits {
+		if !boundaries[string(k)] {
+			t.Fatal("Expected split key", k, "to start a leaf")
+		}
+	}
+
+	// the first page to split held the first 1023 keys and split
+	// in the middle
+	first := int64(binary.BigEndian.Uint64(leafSplits[0]))
+	t.Log("first split at", first)
+	if first < 400 || first > 600 {
+		t.Fatal("Expected the first split near the middle of the page, got", first)
+	}
+}
+
+func TestStartNil(t *testing.T) {
+	index := NewInMemoryBtree()
+	keys := fill(t, index)
+
+	count := 0
+	it := index.Start(nil)
+	for ok, _, _ := it.Next(); ok; ok, _, _ = it.Next() {
+		count++
+	}
+	if count != len(keys) {
+		t.Fatal("Expected", len(keys), "got", count)
+	}
+}
+
+func TestSplitStats(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	// long keys, so that the root fills up quickly
+	for _, i := range rand.Perm(1000) {
+		k := make([]byte, 1000)
+		binary.BigEndian.PutUint32(k, uint32(i))
+		bt.Put(k, k)
+	}
+
+	stats := bt.Stats()
+	// every split adds a page, apart from the initial root and
+	// leaf, and every new root does too
+	pages := int64(stats.NumLeafPages + stats.NumInternalPages)
+	if stats.Splits+stats.RootPromotions+2 != pages {
+		t.Fatal("Expected splits and new roots to account for all pages:", stats)
+	}
+	if stats.RootPromotions == 0 {
+		t.Fatal("Expected the tree to have grown", stats)
+	}
+
+	bt.ResetStats()
+	if bt.Stats().Splits != stats.Splits {
+		t.Fatal("Did not expect ResetStats to reset Splits")
+	}
+}
+
+func TestConcurrentModification(t *testing.T) {
+	expectPanic := func(name string, f func()) {
+		defer func() {
+			if r := recover(); r != "concurrent modification" {
+				t.Error("Expected", name, "to panic with concurrent modification, got", r)
+			}
+		}()
+		f()
+	}
+
+	bt := NewInMemoryBtree().(*Btree)
+	fill(t, bt)
+
+	iter := bt.Start(nil)
+	iter.Next()
+	bt.Put([]byte{1, 2, 3, 4, 5}, []byte{1})
+	expectPanic("Put", func() { iter.Next() })
+
+	iter = bt.Start(nil)
+	bt.Append([]byte{1, 2, 3, 4, 5}, []byte{2})
+	expectPanic("Append", func() { iter.Next() })
+
+	iter = bt.Start(nil)
+	bt.Delete([]byte{1, 2, 3, 4, 5})
+	expectPanic("Delete", func() { iter.Next() })
+
+	sizes := bt.StartSizes(nil)
+	bt.Sweep()
+	expectPanic("Sweep", func() { sizes.Next() })
+
+	c := bt.OpenCursor(nil)
+	c.Next()
+	bt.Put([]byte{1, 2, 3, 4, 5}, []byte{1})
+	expectPanic("the cursor", func() { c.Prev() })
+	if !c.Seek([]byte{1}) || !c.Next() {
+		t.Fatal("Expected Seek to reposition the cursor")
+	}
+
+	// a failed Delete changes nothing
+	iter = bt.Start(nil)
+	bt.Delete([]byte{1, 2, 3, 4, 6})
+	iter.Next()
+
+	unchecked := NewInMemoryBtreeWithOptions(Options{UncheckedIteration: true}).(*Btree)
+	unchecked.Put([]byte{1}, []byte{1})
+	iter = unchecked.Start(nil)
+	unchecked.Put([]byte{2}, []byte{2})
+	if ok, _, _ := iter.Next(); !ok {
+		t.Fatal("Expected the unchecked iterator to keep going")
+	}
+}
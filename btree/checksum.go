@@ -0,0 +1,29 @@
+package btree
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+// Return a hash of the keys and values in the tree, in order. Trees
+// with the same contents have the same checksum, however they were
+// built and whatever their pages look like. Every key and value is
+// hashed after its length, so that moving bytes from a key to its
+// value changes the checksum. This walks every key, so it is linear
+// in the size of the tree.
+func (b *Btree) Checksum() uint64 {
+	h := fnv.New64a()
+	var n [binary.MaxVarintLen64]byte
+	it := b.Start([]byte{})
+	for {
+		ok, k, v := it.Next()
+		if !ok {
+			break
+		}
+		h.Write(n[:binary.PutUvarint(n[:], uint64(len(k)))])
+		h.Write(k)
+		h.Write(n[:binary.PutUvarint(n[:], uint64(len(v)))])
+		h.Write(v)
+	}
+	return h.Sum64()
+}
@@ -0,0 +1,48 @@
+package btree
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	key := func(i int) []byte {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, uint64(i))
+		return k
+	}
+
+	put := NewInMemoryBtree().(*Btree)
+	for _, i := range rand.Perm(20000) {
+		put.Put(key(i), key(i*3))
+	}
+	next := NewInMemoryBtree().(*Btree)
+	for i := 0; i < 20000; i++ {
+		next.PutNext(key(i), key(i*3))
+	}
+	if put.Checksum() != next.Checksum() {
+		t.Fatal("Expected equal checksums for equal contents")
+	}
+
+	// deleted keys do not count
+	next.Put(key(20000), []byte{1})
+	next.Delete(key(20000))
+	if put.Checksum() != next.Checksum() {
+		t.Fatal("Expected a deleted key to leave the checksum alone")
+	}
+
+	next.Put(key(7), key(8))
+	if put.Checksum() == next.Checksum() {
+		t.Fatal("Expected a changed value to change the checksum")
+	}
+
+	// length framing
+	a := NewInMemoryBtree().(*Btree)
+	a.Put([]byte{1, 2}, []byte{3})
+	b := NewInMemoryBtree().(*Btree)
+	b.Put([]byte{1}, []byte{2, 3})
+	if a.Checksum() == b.Checksum() {
+		t.Fatal("Expected different checksums for different splits of the same bytes")
+	}
+}
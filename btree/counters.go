@@ -0,0 +1,44 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/avisagie/indexes"
+)
+
+// Integer counters kept in an index, as 8 byte big-endian values. A
+// key that was never incremented counts 0. Counters wrap around on
+// overflow, like int64 addition does. Don't mix this with other puts
+// on the same keys. Like the index, not safe for concurrent use: Incr
+// is a Get followed by a Put. Use Options.InlineValues of at least 8
+// to keep the counters in the leaves.
+type Counters struct {
+	index indexes.Index
+}
+
+func NewCounters(index indexes.Index) *Counters {
+	return &Counters{index}
+}
+
+// Add delta to the counter of key and return its new value.
+func (c *Counters) Incr(key []byte, delta int64) int64 {
+	n := c.Value(key) + delta
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(n))
+	c.index.Put(key, buf[:])
+	return n
+}
+
+// The counter of key. Panics if key has a value that is not a
+// counter.
+func (c *Counters) Value(key []byte) int64 {
+	ok, value := c.index.Get(key)
+	if !ok {
+		return 0
+	}
+	if len(value) != 8 {
+		panic(fmt.Sprint("Not a counter: value of ", len(value), " bytes"))
+	}
+	return int64(binary.BigEndian.Uint64(value))
+}
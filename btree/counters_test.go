@@ -0,0 +1,33 @@
+package btree
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	c := NewCounters(NewBtreeWithOptions(Options{InlineValues: 8}))
+	if n := c.Value([]byte("a")); n != 0 {
+		t.Fatal("Expected 0 for a new counter, got", n)
+	}
+	for i := 0; i < 100; i++ {
+		c.Incr([]byte("a"), 2)
+		c.Incr([]byte("b"), -1)
+	}
+	if c.Value([]byte("a")) != 200 || c.Value([]byte("b")) != -100 {
+		t.Fatal("Expected 200 and -100, got", c.Value([]byte("a")), c.Value([]byte("b")))
+	}
+
+	c.Incr([]byte("max"), math.MaxInt64)
+	if n := c.Incr([]byte("max"), 1); n != math.MinInt64 {
+		t.Fatal("Expected to wrap around, got", n)
+	}
+
+	c.index.Put([]byte("c"), []byte{1})
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected a value that is not a counter to panic")
+		}
+	}()
+	c.Value([]byte("c"))
+}
@@ -0,0 +1,49 @@
+package btree
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"io"
+)
+
+// Bulk load CSV rows with base64 encoded keys and values in the given
+// columns. The rows must be in strictly increasing key order, since
+// they are loaded with PutNext; an out of order row is an error. The
+// input is read a row at a time.
+func LoadCSV(r io.Reader, keyCol, valCol int) (*Btree, error) {
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = -1
+	in.ReuseRecord = true
+
+	b := NewBtree()
+	prev := []byte{}
+	for line := 1; ; line++ {
+		record, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if keyCol >= len(record) || valCol >= len(record) {
+			return nil, fmt.Errorf("Line %d: expected at least %d columns, got %d", line, max(keyCol, valCol)+1, len(record))
+		}
+
+		key, err := base64.StdEncoding.DecodeString(record[keyCol])
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: key: %v", line, err)
+		}
+		value, err := base64.StdEncoding.DecodeString(record[valCol])
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: value: %v", line, err)
+		}
+		if !keyLess(prev, key) {
+			return nil, fmt.Errorf("Line %d: key %v out of order after %v", line, key, prev)
+		}
+
+		b.PutNext(key, value)
+		prev = key
+	}
+	return b, nil
+}
@@ -0,0 +1,39 @@
+package btree
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLoadCSV(t *testing.T) {
+	// AQ== is {1}, Ag== is {2}, Aw== is {3}
+	bt, err := LoadCSV(strings.NewReader("x,AQ==,Aw==\ny,Ag==,Ag==\nz,Aw==,\n"), 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt.Size() != 3 {
+		t.Fatal("Expected 3 keys, got", bt.Size())
+	}
+	if ok, v := bt.Get([]byte{1}); !ok || bytes.Compare(v, []byte{3}) != 0 {
+		t.Fatal("Expected {3}, got", ok, v)
+	}
+	if ok, v := bt.Get([]byte{3}); !ok || len(v) != 0 {
+		t.Fatal("Expected an empty value, got", ok, v)
+	}
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		"Ag==,AQ==\nAQ==,AQ==\n",
+		"AQ==,AQ==\nAQ==,AQ==\n",
+		",AQ==\n",
+		"AQ==\n",
+		"!!,AQ==\n",
+	} {
+		if _, err := LoadCSV(strings.NewReader(s), 0, 1); err == nil {
+			t.Error("Expected an error for", s)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package btree
+
+// A cursor over the keys with a prefix that can move in both
+// directions, using the links between leaves. It starts out
+// unpositioned: the first Next moves to the first key with the
+// prefix and the first Prev to the last one. Moving past either end
+// leaves it unpositioned again, so that Next starts over from the
+// first key and Prev from the last. Like iterators, Next and Prev
+// panic with "concurrent modification" if the tree changed since the
+// cursor was opened or last moved by Seek.
+type Cursor struct {
+	b      *Btree
+	prefix []byte
+
+	// the current leaf and position in it, page is nil when
+	// unpositioned
+	page Page
+	pos  int
+
+	// which value of a duplicate key: 0 is the key's own value, i
+	// is the i-th extra value
+	dup int
+
+	// the tree's mods when the cursor was opened or last sought
+	mods uint64
+}
+
+// Open a cursor over the keys that start with prefix. A nil prefix,
+// like an empty one, covers the whole tree.
+func (b *Btree) OpenCursor(prefix []byte) *Cursor {
+	if prefix == nil {
+		prefix = []byte{}
+	}
+	return &Cursor{b: b, prefix: prefix, mods: b.mods}
+}
+
+// Move to the next key, or the next value of the current key if it
+// has duplicates. Returns false when there is none.
+func (c *Cursor) Next() bool {
+	c.check()
+	if c.page == nil {
+		return c.Seek(c.prefix)
+	}
+	if _, r := c.page.GetKey(c.pos); c.dup < len(c.b.dups[r]) {
+		c.dup++
+		return true
+	}
+	c.pos++
+	return c.forward()
+}
+
+// Move to the previous key, or the previous value of the current
+// key if it has duplicates. Returns false when there is none.
+func (c *Cursor) Prev() bool {
+	c.check()
+	if c.page == nil {
+		return c.last()
+	}
+	if c.dup > 0 {
+		c.dup--
+		return true
+	}
+	c.pos--
+	return c.backward()
+}
+
+// Move to the first key with the prefix that is greater than or
+// equal to key. Returns false when there is none, leaving the cursor
+// unpositioned.
+func (c *Cursor) Seek(key []byte) bool {
+	if !keyLess(c.prefix, key) {
+		key = c.prefix
+	}
+	c.mods = c.b.mods
+	_, _, pageRefs := c.b.search(key)
+	c.page = c.b.pager.Get(pageRefs[len(pageRefs)-1])
+	c.pos = leafPos(c.page, key)
+	return c.forward()
+}
+
+// The key the cursor is at, nil when unpositioned. Only valid until
+// the tree is changed.
+func (c *Cursor) Key() []byte {
+	if c.page == nil {
+		return nil
+	}
+	k, _ := c.page.GetKey(c.pos)
+	return k
+}
+
+// The value the cursor is at, nil when unpositioned.
+func (c *Cursor) Value() []byte {
+	if c.page == nil {
+		return nil
+	}
+	k, r := c.page.GetKey(c.pos)
+	if c.dup > 0 {
+		return c.b.readValue(nil, c.b.dups[r][c.dup-1])
+	}
+	return c.b.readValue(k, r)
+}
+
+func (c *Cursor) check() {
+	if c.mods != c.b.mods && !c.b.opts.UncheckedIteration {
+		panic("concurrent modification")
+	}
+}
+
+// Move to the last key with the prefix.
+func (c *Cursor) last() bool {
+	end := prefixEnd(c.prefix)
+	if end == nil {
+		page := c.b.pager.Get(c.b.root)
+		for !page.IsLeaf() {
+			_, r := page.GetKey(page.Size() - 1)
+			page = c.b.pager.Get(r)
+		}
+		c.page, c.pos = page, page.Size()-1
+	} else {
+		_, _, pageRefs := c.b.search(end)
+		c.page = c.b.pager.Get(pageRefs[len(pageRefs)-1])
+		c.pos = leafPos(c.page, end) - 1
+	}
+	return c.backward()
+}
+
+// Settle on the first live key at or after the current position.
+func (c *Cursor) forward() bool {
+	for {
+		if c.pos >= c.page.Size() {
+			n := c.page.NextPage()
+			if n == -1 {
+				break
+			}
+			c.page, c.pos = c.b.pager.Get(n), 0
+			continue
+		}
+		k, r := c.page.GetKey(c.pos)
+		if !prefixMatches(k, c.prefix) {
+			break
+		}
+		if r != tombstone && !c.b.expired(k) {
+			c.dup = 0
+			return true
+		}
+		c.pos++
+	}
+	c.page = nil
+	return false
+}
+
+// Settle on the last value of the first live key at or before the
+// current position.
+func (c *Cursor) backward() bool {
+	for {
+		if c.pos < 0 {
+			p := c.page.PrevPage()
+			if p == -1 {
+				break
+			}
+			c.page = c.b.pager.Get(p)
+			c.pos = c.page.Size() - 1
+			continue
+		}
+		k, r := c.page.GetKey(c.pos)
+		if !prefixMatches(k, c.prefix) {
+			break
+		}
+		if r != tombstone && !c.b.expired(k) {
+			c.dup = len(c.b.dups[r])
+			return true
+		}
+		c.pos--
+	}
+	c.page = nil
+	return false
+}
@@ -0,0 +1,110 @@
+package btree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCursor(t *testing.T) {
+	index := NewInMemoryBtree()
+	fill(t, index)
+	bt := index.(*Btree)
+
+	var keys [][]byte
+	iter := bt.Start(nil)
+	for ok, k, _ := iter.Next(); ok; ok, k, _ = iter.Next() {
+		keys = append(keys, copyBytes(k))
+	}
+
+	c := bt.OpenCursor(nil)
+	for i := 0; c.Next(); i++ {
+		if bytes.Compare(c.Key(), keys[i]) != 0 {
+			t.Fatal("Expected", keys[i], "at", i, "got", c.Key())
+		}
+		if ok, v := bt.Get(c.Key()); !ok || bytes.Compare(v, c.Value()) != 0 {
+			t.Fatal("Expected the value of", c.Key())
+		}
+	}
+	if c.Key() != nil || c.Value() != nil {
+		t.Fatal("Expected an unpositioned cursor after the end")
+	}
+
+	n := 0
+	for i := len(keys) - 1; c.Prev(); i-- {
+		if bytes.Compare(c.Key(), keys[i]) != 0 {
+			t.Fatal("Expected", keys[i], "at", i, "got", c.Key())
+		}
+		n++
+	}
+	if n != len(keys) {
+		t.Fatal("Expected", len(keys), "keys backwards, got", n)
+	}
+
+	// back and forth
+	if !c.Seek(keys[100]) || !c.Prev() || bytes.Compare(c.Key(), keys[99]) != 0 {
+		t.Fatal("Expected to step back to", keys[99])
+	}
+	if !c.Next() || !c.Next() || bytes.Compare(c.Key(), keys[101]) != 0 {
+		t.Fatal("Expected to step forward to", keys[101])
+	}
+}
+
+func TestCursorPrefix(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	for _, k := range []string{"a", "b\x00", "b\x01", "b\xff", "b\xff\xff", "c"} {
+		bt.Put([]byte(k), []byte(k))
+	}
+	bt.Delete([]byte("b\x01"))
+
+	for prefix, want := range map[string][]string{
+		"b":     {"b\x00", "b\xff", "b\xff\xff"},
+		"b\xff": {"b\xff", "b\xff\xff"},
+		"x":     nil,
+		"":      {"a", "b\x00", "b\xff", "b\xff\xff", "c"},
+	} {
+		c := bt.OpenCursor([]byte(prefix))
+		var got []string
+		for c.Prev() {
+			got = append([]string{string(c.Key())}, got...)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("Expected %q for prefix %q, got %q", want, prefix, got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("Expected %q for prefix %q, got %q", want, prefix, got)
+			}
+		}
+	}
+
+	c := bt.OpenCursor([]byte("b"))
+	if !c.Seek([]byte("a")) || string(c.Key()) != "b\x00" {
+		t.Fatal("Expected Seek before the prefix to go to its first key, got", c.Key())
+	}
+	if !c.Seek([]byte("b\x01")) || string(c.Key()) != "b\xff" {
+		t.Fatal("Expected Seek to skip the deleted key, got", c.Key())
+	}
+	if c.Seek([]byte("c")) {
+		t.Fatal("Expected Seek after the prefix to fail, got", c.Key())
+	}
+}
+
+func TestCursorDuplicates(t *testing.T) {
+	bt := NewInMemoryBtreeWithOptions(Options{AllowDuplicates: true}).(*Btree)
+	bt.Put([]byte("a"), []byte("1"))
+	bt.Put([]byte("b"), []byte("2"))
+	bt.Put([]byte("b"), []byte("3"))
+	bt.Put([]byte("c"), []byte("4"))
+
+	c := bt.OpenCursor(nil)
+	var got []byte
+	for c.Next() {
+		got = append(got, c.Value()...)
+	}
+	for c.Prev() {
+		got = append(got, c.Value()...)
+	}
+	if string(got) != "12344321" {
+		t.Fatal("Expected every value both ways, got", string(got))
+	}
+}
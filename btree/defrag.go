@@ -0,0 +1,96 @@
+package btree
+
+// Compact the pager's pages, dropping the ones that were released,
+// and rewrite all references to pages that moved. Returns the number
+// of pages reclaimed. Iterators started before Defrag panic if they
+// are used after it.
+func (b *Btree) Defrag() (reclaimed int) {
+	moved, reclaimed := b.pager.Defrag()
+	b.mods++
+	b.lastLeaf = -1
+	if len(moved) == 0 {
+		return
+	}
+
+	fix := func(ref int) int {
+		if n, ok := moved[ref]; ok {
+			return n
+		}
+		return ref
+	}
+
+	// rebuilt as the leaves are fixed, as moving the head of a first
+	// value's chain changes the ref its duplicates are keyed by
+	var dups map[int][]int
+	if b.dups != nil {
+		dups = make(map[int][]int, len(b.dups))
+	}
+	b.root = fix(b.root)
+	b.defragPage(b.root, fix, dups)
+	if b.dups != nil {
+		b.dups = dups
+	}
+
+	// the leaves fixed the chains of the last versions
+	for _, versions := range b.versions {
+		for i, v := range versions {
+			if !isOverflow(v.ref) {
+				continue
+			}
+			if i == len(versions)-1 {
+				versions[i].ref = overflowRef(fix(overflowHead(v.ref)))
+			} else {
+				versions[i].ref = b.fixOverflow(v.ref, fix)
+			}
+		}
+	}
+	return
+}
+
+// Rewrite the links of the overflow chain ref refers to, and return
+// the ref of its moved head.
+func (b *Btree) fixOverflow(ref int, fix func(int) int) int {
+	head := fix(overflowHead(ref))
+	for o := b.pager.Get(head); o.NextPage() != -1; o = b.pager.Get(o.NextPage()) {
+		o.SetNextPage(fix(o.NextPage()))
+	}
+	return overflowRef(head)
+}
+
+func (b *Btree) defragPage(ref int, fix func(int) int, dups map[int][]int) {
+	page := b.pager.Get(ref)
+	if n := page.NextPage(); n != -1 {
+		page.SetNextPage(fix(n))
+	}
+	if p := page.PrevPage(); p != -1 {
+		page.SetPrevPage(fix(p))
+	}
+
+	for i := 0; i < page.Size(); i++ {
+		k, r := page.GetKey(i)
+		if page.IsLeaf() {
+			newRef := r
+			if isOverflow(r) {
+				newRef = b.fixOverflow(r, fix)
+				page.Insert(k, newRef)
+			}
+			if d, ok := b.dups[r]; ok {
+				for j, dr := range d {
+					if isOverflow(dr) {
+						d[j] = b.fixOverflow(dr, fix)
+					}
+				}
+				dups[newRef] = d
+			}
+			continue
+		}
+
+		r = fix(r)
+		if i == 0 {
+			page.SetFirst(r)
+		} else {
+			page.Insert(k, r)
+		}
+		b.defragPage(r, fix, dups)
+	}
+}
@@ -0,0 +1,118 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDefrag(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	key := func(i int) []byte {
+		k := make([]byte, 4)
+		binary.BigEndian.PutUint32(k, uint32(i))
+		return k
+	}
+	big := func(i int) []byte {
+		return bytes.Repeat(key(i), pageSize/2)
+	}
+
+	// interleave pages holding large values with the tree's own
+	for i := 0; i < 3000; i++ {
+		if i%10 == 0 {
+			bt.Put(key(i), big(i))
+		} else {
+			bt.Put(key(i), key(i))
+		}
+	}
+	for i := 0; i < 3000; i += 20 {
+		bt.Delete(key(i))
+	}
+	pages := len(bt.pager.(*inplacePager).pages)
+
+	reclaimed := bt.Defrag()
+	if reclaimed == 0 || len(bt.pager.(*inplacePager).pages) != pages-reclaimed {
+		t.Fatal("Expected to reclaim the released pages, got", reclaimed, pages, len(bt.pager.(*inplacePager).pages))
+	}
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bt.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i++ {
+		ok, v := bt.Get(key(i))
+		switch {
+		case i%20 == 0:
+			if ok {
+				t.Fatal("Expected", i, "to be deleted")
+			}
+		case i%10 == 0:
+			if !ok || bytes.Compare(v, big(i)) != 0 {
+				t.Fatal("Expected the large value of", i)
+			}
+		default:
+			if !ok || bytes.Compare(v, key(i)) != 0 {
+				t.Fatal("Expected the value of", i)
+			}
+		}
+	}
+
+	if bt.Defrag() != 0 {
+		t.Fatal("Expected nothing left to reclaim")
+	}
+}
+
+func TestDefragDuplicates(t *testing.T) {
+	bt := NewBtreeWithOptions(Options{AllowDuplicates: true})
+	key := func(i int) []byte {
+		k := make([]byte, 4)
+		binary.BigEndian.PutUint32(k, uint32(i))
+		return k
+	}
+	big := func(i, n int) []byte {
+		return bytes.Repeat([]byte{byte(i), byte(n)}, pageSize)
+	}
+
+	for i := 0; i < 1000; i++ {
+		bt.Put(key(i), big(i, 0))
+		if i%3 == 0 {
+			bt.Put(key(i), big(i, 1))
+			bt.Put(key(i), key(i))
+		}
+	}
+	for i := 0; i < 1000; i += 4 {
+		bt.Delete(key(i))
+	}
+	size := bt.Size()
+	bt.Rebuild()
+	if bt.Defrag() == 0 {
+		t.Fatal("Expected to reclaim pages")
+	}
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bt.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if bt.Size() != size {
+		t.Fatal("Expected", size, "values, got", bt.Size())
+	}
+	for i := 0; i < 1000; i++ {
+		values := bt.GetAll(key(i))
+		switch {
+		case i%4 == 0:
+			if len(values) != 0 {
+				t.Fatal("Expected", i, "to be deleted, got", len(values))
+			}
+		case i%3 == 0:
+			if len(values) != 3 || !bytes.Equal(values[0], big(i, 0)) || !bytes.Equal(values[1], big(i, 1)) || !bytes.Equal(values[2], key(i)) {
+				t.Fatal("Expected the three values of", i, "got", len(values))
+			}
+		default:
+			if len(values) != 1 || !bytes.Equal(values[0], big(i, 0)) {
+				t.Fatal("Expected the value of", i, "got", len(values))
+			}
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package btree
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Write the tree in a text format that ParseDump reads back into a
+// tree of the same shape. Every page is a line, "leaf" or
+// "internal", indented with one tab per level. The children of an
+// internal page follow it one level deeper, each but the first
+// preceded by its quoted separator key. The entries of a leaf follow
+// it one level deeper as a quoted key and its quoted values, or
+// "deleted" for a deleted key:
+//
+//	internal
+//		leaf
+//			"a" "1"
+//			"b" deleted
+//		"c" leaf
+//			"c" "3"
+//
+// Meant for constructing corner cases in tests by hand, not for
+// large indexes.
+func (b *Btree) DumpStructured(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	if err := b.dumpStructuredPage(out, b.root, 0, nil); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+func (b *Btree) dumpStructuredPage(out *bufio.Writer, ref, depth int, sep []byte) error {
+	page := b.pager.Get(ref)
+	line := spaces(depth)
+	if sep != nil {
+		line += strconv.Quote(string(sep)) + " "
+	}
+	if page.IsLeaf() {
+		line += "leaf"
+	} else {
+		line += "internal"
+	}
+	if _, err := fmt.Fprintln(out, line); err != nil {
+		return err
+	}
+
+	for i := 0; i < page.Size(); i++ {
+		k, r := page.GetKey(i)
+		if !page.IsLeaf() {
+			if i == 0 {
+				k = nil
+			}
+			if err := b.dumpStructuredPage(out, r, depth+1, k); err != nil {
+				return err
+			}
+			continue
+		}
+
+		line := spaces(depth+1) + strconv.Quote(string(k))
+		if r == tombstone {
+			line += " deleted"
+		} else {
+			line += " " + strconv.Quote(string(b.value(k, r)))
+			for _, d := range b.dups[r] {
+				line += " " + strconv.Quote(string(b.value(nil, d)))
+			}
+		}
+		if _, err := fmt.Fprintln(out, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type dumpLine struct {
+	no, depth int
+	words     []string
+	quoted    []bool
+}
+
+type dumpParser struct {
+	b      *Btree
+	lines  []dumpLine
+	pos    int
+	levels [][]int
+}
+
+// Read a tree written by DumpStructured, or written by hand in the
+// same format, with exactly the pages it describes. A key with more
+// than one value turns on AllowDuplicates. The result is checked
+// with CheckConsistency.
+func ParseDump(r io.Reader) (*Btree, error) {
+	p := &dumpParser{
+		b: &Btree{
+			pager:    newInplacePager(),
+			pageRefs: make([]int, 0, 8),
+		},
+	}
+
+	scanner := bufio.NewScanner(r)
+	for no := 1; scanner.Scan(); no++ {
+		text := scanner.Text()
+		trimmed := strings.TrimLeft(text, "\t")
+		if strings.TrimSpace(trimmed) == "" {
+			continue
+		}
+		l := dumpLine{no: no, depth: len(text) - len(trimmed)}
+		if err := l.split(trimmed); err != nil {
+			return nil, err
+		}
+		p.lines = append(p.lines, l)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(p.lines) == 0 {
+		return nil, fmt.Errorf("Empty dump")
+	}
+
+	root := p.lines[0]
+	if root.depth != 0 || len(root.words) != 1 || root.quoted[0] {
+		return nil, fmt.Errorf("Line %d: Expected the root page", root.no)
+	}
+	p.pos++
+	ref, err := p.page(0, root)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("Line %d: Expected a single root page", p.lines[p.pos].no)
+	}
+
+	b := p.b
+	if b.pager.Get(ref).IsLeaf() {
+		// the tree always has an internal root
+		var root Page
+		b.root, root = b.pager.New(false)
+		root.SetFirst(ref)
+	} else {
+		b.root = ref
+	}
+
+	for _, level := range p.levels {
+		for i := 1; i < len(level); i++ {
+			b.pager.Get(level[i-1]).SetNextPage(level[i])
+			b.pager.Get(level[i]).SetPrevPage(level[i-1])
+		}
+	}
+
+	if err := b.CheckConsistency(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Split a line into words, unquoting the quoted ones.
+func (l *dumpLine) split(text string) error {
+	for text = strings.TrimSpace(text); text != ""; text = strings.TrimSpace(text) {
+		if text[0] != '"' {
+			word := strings.Fields(text)[0]
+			l.words = append(l.words, word)
+			l.quoted = append(l.quoted, false)
+			text = text[len(word):]
+			continue
+		}
+		q, err := strconv.QuotedPrefix(text)
+		if err != nil {
+			return fmt.Errorf("Line %d: %v", l.no, err)
+		}
+		word, _ := strconv.Unquote(q)
+		l.words = append(l.words, word)
+		l.quoted = append(l.quoted, true)
+		text = text[len(q):]
+	}
+	return nil
+}
+
+// Create the page that header describes and fill it from the lines
+// below it.
+func (p *dumpParser) page(depth int, header dumpLine) (ref int, err error) {
+	kind := header.words[len(header.words)-1]
+	if kind != "leaf" && kind != "internal" {
+		return 0, fmt.Errorf("Line %d: Expected leaf or internal, got %q", header.no, kind)
+	}
+	ref, page := p.b.pager.New(kind == "leaf")
+	for len(p.levels) <= depth {
+		p.levels = append(p.levels, nil)
+	}
+	p.levels[depth] = append(p.levels[depth], ref)
+
+	children := 0
+	for p.pos < len(p.lines) && p.lines[p.pos].depth > depth {
+		l := p.lines[p.pos]
+		p.pos++
+		if l.depth != depth+1 {
+			return 0, fmt.Errorf("Line %d: Expected indentation %d, got %d", l.no, depth+1, l.depth)
+		}
+
+		if page.IsLeaf() {
+			if err := p.entry(page, l); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		var sep []byte
+		switch {
+		case len(l.words) == 1 && !l.quoted[0]:
+		case len(l.words) == 2 && l.quoted[0] && !l.quoted[1]:
+			sep = []byte(l.words[0])
+		default:
+			return 0, fmt.Errorf("Line %d: Expected a child page", l.no)
+		}
+		if children == 0 && sep != nil {
+			return 0, fmt.Errorf("Line %d: The first child page takes no key", l.no)
+		}
+		if children > 0 && len(sep) == 0 {
+			return 0, fmt.Errorf("Line %d: Expected a key for the child page", l.no)
+		}
+
+		child, err := p.page(depth+1, l)
+		if err != nil {
+			return 0, err
+		}
+		if children == 0 {
+			page.SetFirst(child)
+		} else if ok, _ := page.Search(sep); ok {
+			return 0, fmt.Errorf("Line %d: Duplicate key %q", l.no, sep)
+		} else if !page.Insert(sep, child) {
+			return 0, fmt.Errorf("Line %d: Page full", l.no)
+		}
+		children++
+	}
+
+	if !page.IsLeaf() && children == 0 {
+		return 0, fmt.Errorf("Line %d: Internal page without child pages", header.no)
+	}
+	return ref, nil
+}
+
+// Add the leaf entry on l to page.
+func (p *dumpParser) entry(page Page, l dumpLine) error {
+	b := p.b
+	if len(l.words) < 2 || !l.quoted[0] {
+		return fmt.Errorf("Line %d: Expected a key and its values", l.no)
+	}
+	key := []byte(l.words[0])
+	if len(key) == 0 {
+		return fmt.Errorf("Line %d: Got empty key", l.no)
+	}
+	if ok, _ := page.Search(key); ok {
+		return fmt.Errorf("Line %d: Duplicate key %q", l.no, key)
+	}
+
+	var (
+		ref   int
+		value []byte
+	)
+	if len(l.words) == 2 && !l.quoted[1] && l.words[1] == "deleted" {
+		ref = tombstone
+		b.tombstones++
+	} else {
+		for i, quoted := range l.quoted[1:] {
+			if !quoted {
+				return fmt.Errorf("Line %d: Expected a quoted value, got %s", l.no, l.words[i+1])
+			}
+		}
+		value = []byte(l.words[1])
+		ref = b.storeValue(value, true)
+		if len(l.words) > 2 && b.dups == nil {
+			b.opts.AllowDuplicates = true
+			b.dups = make(map[int][]int)
+		}
+		for _, v := range l.words[2:] {
+			b.dups[ref] = append(b.dups[ref], b.storeValue([]byte(v), true))
+		}
+		b.size += int64(len(l.words) - 1)
+	}
+
+	if !b.insert(page, key, ref, value) {
+		return fmt.Errorf("Line %d: Page full", l.no)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package btree
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDumpStructured(t *testing.T) {
+	index := NewInMemoryBtree()
+	fill(t, index)
+	bt := index.(*Btree)
+
+	var buf bytes.Buffer
+	if err := bt.DumpStructured(&buf); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseDump(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Size() != bt.Size() {
+		t.Fatal("Expected", bt.Size(), "keys, got", parsed.Size())
+	}
+
+	var again bytes.Buffer
+	if err := parsed.DumpStructured(&again); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != again.String() {
+		t.Fatal("Expected the parsed tree to dump the same")
+	}
+}
+
+func TestParseDump(t *testing.T) {
+	dump := `
+internal
+	leaf
+		"a" "1"
+		"b" deleted
+	"c" leaf
+		"c" "3"
+		"d" "4"
+	"e" leaf
+		"x\x00" ""
+`
+	bt, err := ParseDump(strings.NewReader(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt.Size() != 4 {
+		t.Fatal("Expected 4 keys, got", bt.Size())
+	}
+	if stats := bt.Stats(); stats.NumLeafPages != 3 || stats.NumInternalPages != 1 {
+		t.Fatal("Expected 3 leaves under the root, got", stats.NumLeafPages, stats.NumInternalPages)
+	}
+	if ok, _ := bt.Get([]byte("b")); ok {
+		t.Fatal("Expected b to be deleted")
+	}
+	if ok, v := bt.Get([]byte("x\x00")); !ok || len(v) != 0 {
+		t.Fatal("Expected an empty value")
+	}
+
+	var want []string
+	iter := bt.Start(nil)
+	for ok, k, _ := iter.Next(); ok; ok, k, _ = iter.Next() {
+		want = append(want, string(k))
+	}
+	if strings.Join(want, ",") != "a,c,d,x\x00" {
+		t.Fatal("Unexpected keys", want)
+	}
+
+	dups, err := ParseDump(strings.NewReader("leaf\n\t\"a\" \"1\" \"2\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values := dups.GetAll([]byte("a")); len(values) != 2 || !dups.opts.AllowDuplicates {
+		t.Fatal("Expected two values for a, got", values)
+	}
+}
+
+func TestParseDumpErrors(t *testing.T) {
+	bad := map[string]string{
+		"empty":            "",
+		"leaf outside":     "internal\n\t\"a\" \"1\"\n",
+		"first key":        "internal\n\t\"a\" leaf\n",
+		"missing key":      "internal\n\tleaf\n\tleaf\n",
+		"no children":      "internal\n",
+		"indentation":      "internal\n\t\tleaf\n",
+		"duplicate":        "leaf\n\t\"a\" \"1\"\n\t\"a\" \"2\"\n",
+		"unquoted":         "leaf\n\t\"a\" 1\n",
+		"bad quote":        "leaf\n\t\"a \"1\"\n",
+		"unordered leaves": "internal\n\tleaf\n\t\t\"b\" \"1\"\n\t\"b\" leaf\n\t\t\"a\" \"1\"\n",
+		"two roots":        "leaf\nleaf\n",
+	}
+	for name, dump := range bad {
+		if _, err := ParseDump(strings.NewReader(dump)); err == nil {
+			t.Error("Expected an error for", name)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package btree
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/avisagie/indexes"
+)
+
+// A read only copy of a tree, made by Freeze. The keys and values lie
+// end to end in two arrays, in key order, with the offsets where each
+// one ends in two more, so it costs no pages, no slice header per
+// value and no pointers to chase: a scan reads memory front to back
+// and a Get is a binary search over the offsets. It can't be changed,
+// only frozen anew from a tree.
+type FrozenIndex struct {
+	keys, values       []byte
+	keyEnds, valueEnds []int
+
+	share bool
+}
+
+// Copy the live keys and values into a FrozenIndex, leaving the tree
+// as it is. A key with duplicate values comes once per value, as
+// iterators yield it. Keys with a TTL are copied as they are now and
+// do not expire in the copy. Its reads copy values like the tree's,
+// unless the tree has Options.ShareValues.
+func (b *Btree) Freeze() *FrozenIndex {
+	f := &FrozenIndex{share: b.opts.ShareValues}
+	f.keyEnds = make([]int, 0, b.size)
+	f.valueEnds = make([]int, 0, b.size)
+	it := b.seek([]byte{})
+	for {
+		ok, k, r := it.nextRef()
+		if !ok {
+			break
+		}
+		f.keys = append(f.keys, k...)
+		f.values = append(f.values, b.value(k, r)...)
+		f.keyEnds = append(f.keyEnds, len(f.keys))
+		f.valueEnds = append(f.valueEnds, len(f.values))
+	}
+	f.keys = f.keys[:len(f.keys):len(f.keys)]
+	f.values = f.values[:len(f.values):len(f.values)]
+	return f
+}
+
+func (f *FrozenIndex) key(i int) []byte {
+	start := 0
+	if i > 0 {
+		start = f.keyEnds[i-1]
+	}
+	return f.keys[start:f.keyEnds[i]:f.keyEnds[i]]
+}
+
+func (f *FrozenIndex) value(i int) []byte {
+	start := 0
+	if i > 0 {
+		start = f.valueEnds[i-1]
+	}
+	v := f.values[start:f.valueEnds[i]:f.valueEnds[i]]
+	if f.share {
+		return v
+	}
+	return copyBytes(v)
+}
+
+// The position of the first key not less than key.
+func (f *FrozenIndex) search(key []byte) int {
+	return sort.Search(len(f.keyEnds), func(i int) bool {
+		return bytes.Compare(f.key(i), key) >= 0
+	})
+}
+
+func (f *FrozenIndex) Get(key []byte) (ok bool, value []byte) {
+	if key == nil || len(key) == 0 {
+		panic("Illegal key nil")
+	}
+	i := f.search(key)
+	if i == len(f.keyEnds) || !bytes.Equal(f.key(i), key) {
+		return false, nil
+	}
+	return true, f.value(i)
+}
+
+func (f *FrozenIndex) Contains(key []byte) bool {
+	ok, _ := f.Get(key)
+	return ok
+}
+
+func (f *FrozenIndex) Size() int64 {
+	return int64(len(f.keyEnds))
+}
+
+// The bytes the index takes, for comparing with the tree's ByteSize.
+func (f *FrozenIndex) ByteSize() int64 {
+	return int64(len(f.keys) + len(f.values) + 8*(len(f.keyEnds)+len(f.valueEnds)))
+}
+
+func (f *FrozenIndex) Min() (ok bool, key []byte, value []byte) {
+	if len(f.keyEnds) == 0 {
+		return
+	}
+	return true, f.key(0), f.value(0)
+}
+
+func (f *FrozenIndex) Max() (ok bool, key []byte, value []byte) {
+	n := len(f.keyEnds)
+	if n == 0 {
+		return
+	}
+	return true, f.key(n - 1), f.value(n - 1)
+}
+
+type frozenIter struct {
+	f      *FrozenIndex
+	i, end int
+	done   bool
+}
+
+func (i *frozenIter) Next() (ok bool, key []byte, value []byte) {
+	if i.i >= i.end {
+		i.done = true
+		return false, nil, nil
+	}
+	key, value = i.f.key(i.i), i.f.value(i.i)
+	i.i++
+	return true, key, value
+}
+
+func (i *frozenIter) Done() bool {
+	return i.done
+}
+
+// Iterate over the keys that start with prefix, in key order.
+func (f *FrozenIndex) Start(prefix []byte) indexes.Iter {
+	it := &frozenIter{f: f, i: f.search(prefix), end: len(f.keyEnds)}
+	if end := prefixEnd(prefix); end != nil {
+		it.end = f.search(end)
+	}
+	return it
+}
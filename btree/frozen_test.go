@@ -0,0 +1,89 @@
+package btree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFreeze(t *testing.T) {
+	bt := NewBtreeWithOptions(Options{AllowDuplicates: true})
+	keys := fill(t, bt)
+	bt.Put(keys[0], []byte("dup"))
+	frozen := bt.Freeze()
+	var _ ReadOnlyIndex = frozen
+
+	if frozen.Size() != bt.Size() {
+		t.Fatal("Expected", bt.Size(), "values, got", frozen.Size())
+	}
+	for _, prefix := range [][]byte{nil, {4}, {4, 1}, {0xff}} {
+		expected, it := bt.Start(prefix), frozen.Start(prefix)
+		for {
+			ok1, k1, v1 := expected.Next()
+			ok2, k2, v2 := it.Next()
+			if ok1 != ok2 || !bytes.Equal(k1, k2) || !bytes.Equal(v1, v2) {
+				t.Fatal("Not the same:", prefix, ok1, ok2, k1, k2, v1, v2)
+			}
+			if !ok1 {
+				break
+			}
+		}
+		if !it.Done() {
+			t.Fatal("Expected the iteration to be done")
+		}
+	}
+
+	for _, k := range keys {
+		ok, v := frozen.Get(k)
+		if !ok || !bytes.Equal(v, k) {
+			t.Fatal("Expected", k, "got", ok, v)
+		}
+	}
+	if frozen.Contains([]byte{200, 200, 200, 200, 200}) {
+		t.Fatal("Did not expect a missing key")
+	}
+	ok1, k1, _ := bt.Max()
+	ok2, k2, _ := frozen.Max()
+	if ok1 != ok2 || !bytes.Equal(k1, k2) {
+		t.Fatal("Expected max", k1, "got", k2)
+	}
+
+	_, v := frozen.Get(keys[1])
+	v[0]++
+	if _, again := frozen.Get(keys[1]); again[0] == v[0] {
+		t.Fatal("Expected Get to return a copy")
+	}
+
+	if frozen.ByteSize() >= bt.ByteSize()/2 {
+		t.Fatal("Expected the frozen index to be much smaller than", bt.ByteSize(), "got", frozen.ByteSize())
+	}
+	if ok, _, _ := NewBtree().Freeze().Min(); ok {
+		t.Fatal("Expected no min in an empty index")
+	}
+}
+
+func BenchmarkScanBtree(b *testing.B) {
+	bt := NewBtreeWithOptions(Options{ShareValues: true})
+	fill(b, bt)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := bt.Start(nil)
+		for ok, _, _ := it.Next(); ok; ok, _, _ = it.Next() {
+		}
+	}
+}
+
+func BenchmarkScanFrozen(b *testing.B) {
+	bt := NewBtreeWithOptions(Options{ShareValues: true})
+	fill(b, bt)
+	frozen := bt.Freeze()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := frozen.Start(nil)
+		for ok, _, _ := it.Next(); ok; ok, _, _ = it.Next() {
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package btree
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// The key of n as 8 bytes big-endian, so that integer keys sort in
+// numeric order.
+func Uint64Key(n uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, n)
+	return key
+}
+
+// The ranges of integers from lo to hi, both included, that have no
+// Uint64Key in the tree, in order, each as its first and last
+// integer. Keys that are not 8 bytes long are ignored. Returns nil
+// if lo > hi or there are no gaps. Scans the keys in the range once.
+func (b *Btree) FindGaps(lo, hi uint64) (gaps [][2]uint64) {
+	if lo > hi {
+		return nil
+	}
+	var end []byte
+	if hi < math.MaxUint64 {
+		end = Uint64Key(hi + 1)
+	}
+
+	// the next integer expected
+	next, more := lo, true
+	it := b.Range(Uint64Key(lo), end)
+	for more {
+		ok, k, _ := it.Next()
+		if !ok {
+			break
+		}
+		if len(k) != 8 {
+			continue
+		}
+		n := binary.BigEndian.Uint64(k)
+		if n > next {
+			gaps = append(gaps, [2]uint64{next, n - 1})
+		}
+		next, more = n+1, n < hi
+	}
+	if more {
+		gaps = append(gaps, [2]uint64{next, hi})
+	}
+	return
+}
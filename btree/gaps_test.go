@@ -0,0 +1,34 @@
+package btree
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestFindGaps(t *testing.T) {
+	bt := NewBtree()
+	for _, n := range []uint64{3, 4, 5, 8, 10, 11, math.MaxUint64} {
+		bt.Put(Uint64Key(n), []byte{1})
+	}
+	bt.Put([]byte{0, 0, 0, 0, 0, 0, 0, 6, 1}, []byte{1})
+
+	for _, c := range []struct {
+		lo, hi uint64
+		want   string
+	}{
+		{0, 12, "[[0 2] [6 7] [9 9] [12 12]]"},
+		{3, 5, "[]"},
+		{4, 4, "[]"},
+		{6, 7, "[[6 7]]"},
+		{5, 3, "[]"},
+		{11, math.MaxUint64, fmt.Sprint([][2]uint64{{12, math.MaxUint64 - 1}})},
+	} {
+		if got := fmt.Sprint(bt.FindGaps(c.lo, c.hi)); got != c.want {
+			t.Error("Expected", c.want, "for", c.lo, c.hi, "got", got)
+		}
+	}
+	if got := NewBtree().FindGaps(0, math.MaxUint64); fmt.Sprint(got) != fmt.Sprint([][2]uint64{{0, math.MaxUint64}}) {
+		t.Error("Expected an empty tree to be one gap, got", got)
+	}
+}
@@ -0,0 +1,87 @@
+package btree
+
+import (
+	"bytes"
+
+	"github.com/avisagie/indexes"
+)
+
+// Iterates over groups of consecutive keys that share a prefix.
+type GroupIter interface {
+	// Return the next group and an iterator over its keys and
+	// values. Moving on to the next group skips whatever is left
+	// of the previous group's members. ok is false when done.
+	Next() (ok bool, group []byte, members indexes.Iter)
+}
+
+type groupIter struct {
+	it        indexes.Iter
+	prefixLen int
+	members   *groupMembers
+
+	// the next key and value to hand out
+	ok         bool
+	key, value []byte
+}
+
+type groupMembers struct {
+	g     *groupIter
+	group []byte
+	done  bool
+}
+
+// Iterate over the whole tree in groups of keys that share their
+// first prefixLen bytes. A key shorter than prefixLen is grouped by
+// the whole key, so it is in a group of its own, ahead of the group
+// of longer keys it is a prefix of.
+func (b *Btree) StartGroups(prefixLen int) GroupIter {
+	if prefixLen < 0 {
+		panic("Illegal negative prefix length")
+	}
+	g := &groupIter{it: b.Start([]byte{}), prefixLen: prefixLen}
+	g.advance()
+	return g
+}
+
+func (g *groupIter) groupOf(key []byte) []byte {
+	if len(key) < g.prefixLen {
+		return key
+	}
+	return key[:g.prefixLen]
+}
+
+func (g *groupIter) advance() {
+	g.ok, g.key, g.value = g.it.Next()
+}
+
+func (g *groupIter) Next() (ok bool, group []byte, members indexes.Iter) {
+	if g.members != nil {
+		for ok, _, _ := g.members.Next(); ok; ok, _, _ = g.members.Next() {
+		}
+	}
+	if !g.ok {
+		return false, nil, nil
+	}
+
+	g.members = &groupMembers{g, copyBytes(g.groupOf(g.key)), false}
+	return true, g.members.group, g.members
+}
+
+func (m *groupMembers) Next() (ok bool, key []byte, value []byte) {
+	g := m.g
+	if m.done {
+		return
+	}
+	if !g.ok || !bytes.Equal(g.groupOf(g.key), m.group) {
+		// a group cut short by an error is not done
+		m.done = g.ok || g.it.Done()
+		return
+	}
+	ok, key, value = true, g.key, g.value
+	g.advance()
+	return
+}
+
+func (m *groupMembers) Done() bool {
+	return m.done
+}
@@ -0,0 +1,57 @@
+package btree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStartGroups(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	for _, k := range [][]byte{{1}, {1, 1, 1}, {1, 1, 2}, {1, 2, 1}, {2, 1, 1}, {2, 1}, {3, 3, 3}} {
+		bt.Put(k, k)
+	}
+
+	expected := []struct {
+		group []byte
+		n     int
+	}{
+		{[]byte{1}, 1},
+		{[]byte{1, 1}, 2},
+		{[]byte{1, 2}, 1},
+		{[]byte{2, 1}, 2},
+		{[]byte{3, 3}, 1},
+	}
+
+	g := bt.StartGroups(2)
+	for i := 0; ; i++ {
+		ok, group, members := g.Next()
+		if !ok {
+			if i != len(expected) {
+				t.Fatal("Expected", len(expected), "groups, got", i)
+			}
+			break
+		}
+		if i >= len(expected) || bytes.Compare(group, expected[i].group) != 0 {
+			t.Fatal("Unexpected group", i, group)
+		}
+
+		// leave the second group's members for Next to skip
+		if i == 1 {
+			continue
+		}
+		n := 0
+		for {
+			ok, k, v := members.Next()
+			if !ok {
+				break
+			}
+			if !bytes.HasPrefix(k, group) || bytes.Compare(k, v) != 0 {
+				t.Fatal("Unexpected member of", group, k, v)
+			}
+			n++
+		}
+		if n != expected[i].n {
+			t.Fatal("Expected", expected[i].n, "members of", group, "got", n)
+		}
+	}
+}
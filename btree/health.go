@@ -0,0 +1,58 @@
+package btree
+
+// Defaults for the thresholds in Options that Health compares with.
+const (
+	DefaultMinFillRate       = 0.5
+	DefaultMaxDeadValueRatio = 0.5
+	DefaultMaxTombstoneRatio = 0.25
+)
+
+// A summary of how much space a tree wastes, with what to do about it.
+type HealthReport struct {
+	// as in BtreeStats
+	FillRate float64
+
+	// the share of the bytes of the value log held by values that
+	// were overwritten or deleted
+	DeadValueRatio float64
+
+	// the share of the keys in the leaves that are tombstones
+	TombstoneRatio float64
+
+	// Sweep would remove enough tombstones to be worth it
+	NeedsSweep bool
+
+	// the pages are too empty or the value log too dead, and only
+	// Rebuild repacks them. Rebuild also does what Sweep does.
+	NeedsRebuild bool
+}
+
+// Check the tree against the thresholds in Options, e.g. to decide
+// when to Sweep or Rebuild. Costs a look at every page, not at any
+// keys or values.
+func (b *Btree) Health() (h HealthReport) {
+	stats := b.pager.Stats()
+	h.FillRate = stats.FillRate
+	if total := b.valueBytes + b.deadValueBytes; total > 0 {
+		h.DeadValueRatio = float64(b.deadValueBytes) / float64(total)
+	}
+	if total := b.size + b.tombstones; total > 0 {
+		h.TombstoneRatio = float64(b.tombstones) / float64(total)
+	}
+
+	minFill := orDefault(b.opts.MinFillRate, DefaultMinFillRate)
+	maxDead := orDefault(b.opts.MaxDeadValueRatio, DefaultMaxDeadValueRatio)
+	maxTombstones := orDefault(b.opts.MaxTombstoneRatio, DefaultMaxTombstoneRatio)
+
+	h.NeedsSweep = h.TombstoneRatio > maxTombstones
+	// a tree with a single leaf is as packed as it gets
+	h.NeedsRebuild = (stats.NumLeafPages > 1 && h.FillRate < minFill) || h.DeadValueRatio > maxDead
+	return
+}
+
+func orDefault(x, def float64) float64 {
+	if x == 0 {
+		return def
+	}
+	return x
+}
@@ -0,0 +1,38 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	bt := NewBtree()
+	if h := bt.Health(); h.NeedsSweep || h.NeedsRebuild {
+		t.Fatal("Expected an empty tree to be healthy, got", h)
+	}
+
+	for _, i := range rand.Perm(20000) {
+		bt.Put([]byte(fmt.Sprint(i)), []byte{1})
+	}
+	for i := 0; i < 10000; i++ {
+		bt.Delete([]byte(fmt.Sprint(i)))
+	}
+	h := bt.Health()
+	if !h.NeedsSweep || h.TombstoneRatio != 0.5 || h.DeadValueRatio != 0.5 {
+		t.Fatal("Expected half the keys to be tombstones, got", h)
+	}
+
+	bt.Rebuild()
+	if h := bt.Health(); h.NeedsSweep || h.NeedsRebuild || h.DeadValueRatio != 0 {
+		t.Fatal("Expected a rebuilt tree to be healthy, got", h)
+	}
+
+	strict := NewBtreeWithOptions(Options{MinFillRate: 0.99})
+	for _, i := range rand.Perm(20000) {
+		strict.Put([]byte(fmt.Sprint(i)), []byte{1})
+	}
+	if h := strict.Health(); !h.NeedsRebuild || h.NeedsSweep {
+		t.Fatal("Expected the threshold to ask for a Rebuild, got", h)
+	}
+}
@@ -0,0 +1,140 @@
+package btree
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Return up to buckets-1 keys that split the tree into buckets of
+// about equal numbers of keys: the first bucket has the keys below the
+// first boundary, the last the keys from the last boundary on. Trees
+// with fewer keys than buckets get fewer boundaries, one per key after
+// the first. This walks every key, so it is linear in the size of the
+// tree.
+func (b *Btree) Histogram(buckets int) (boundaries [][]byte) {
+	if buckets <= 1 || b.Size() == 0 {
+		return nil
+	}
+	step := b.Size() / int64(buckets)
+	if step == 0 {
+		step = 1
+	}
+
+	var prev []byte
+	it := b.Start([]byte{}).(*btreeIter)
+	for n := int64(0); len(boundaries) < buckets-1; n++ {
+		ok, k, _ := it.nextRef()
+		if !ok {
+			break
+		}
+		if n == 0 {
+			prev = copyBytes(k)
+		}
+		if n == 0 || n%step != 0 {
+			continue
+		}
+		// all values of a duplicate key stay in one bucket
+		if bytes.Equal(prev, k) {
+			continue
+		}
+		prev = copyBytes(k)
+		boundaries = append(boundaries, prev)
+	}
+	return
+}
+
+// The first key of each leaf page, in order, one per leaf, for
+// sharding on page edges. A first key may be a deleted one, and the
+// only leaf of an empty tree gives an empty key.
+func (b *Btree) LeafBoundaries() (boundaries [][]byte) {
+	ref := b.root
+	for page := b.pager.Get(ref); !page.IsLeaf(); page = b.pager.Get(ref) {
+		ref = page.First()
+	}
+
+	for ref != -1 {
+		page := b.pager.Get(ref)
+		k := []byte{}
+		if page.Size() > 0 {
+			k, _ = page.GetKey(0)
+		}
+		boundaries = append(boundaries, copyBytes(k))
+		ref = page.NextPage()
+	}
+	return
+}
+
+// A summary of a distribution of sizes in bytes. The zero value is
+// the empty distribution.
+type Histogram struct {
+	Count    int64
+	Min, Max int
+	Mean     float64
+
+	// half and 99% of the sizes are at most these
+	P50, P99 int
+}
+
+// Counts sizes to build a Histogram from. Exact, keeping a count per
+// distinct size rather than every size.
+type histogramBuilder struct {
+	counts map[int]int64
+	n, sum int64
+}
+
+func (h *histogramBuilder) add(size int) {
+	if h.counts == nil {
+		h.counts = make(map[int]int64)
+	}
+	h.counts[size]++
+	h.n++
+	h.sum += int64(size)
+}
+
+func (h *histogramBuilder) histogram() (ret Histogram) {
+	if h.n == 0 {
+		return
+	}
+	sizes := make([]int, 0, len(h.counts))
+	for size := range h.counts {
+		sizes = append(sizes, size)
+	}
+	sort.Ints(sizes)
+
+	ret.Count = h.n
+	ret.Min, ret.Max = sizes[0], sizes[len(sizes)-1]
+	ret.Mean = float64(h.sum) / float64(h.n)
+	ret.P50, ret.P99 = h.percentile(sizes, 50), h.percentile(sizes, 99)
+	return
+}
+
+// The smallest of sorted sizes that at least p percent of the sizes
+// are at most.
+func (h *histogramBuilder) percentile(sizes []int, p int64) int {
+	rank := (h.n*p + 99) / 100
+	var seen int64
+	for _, size := range sizes {
+		seen += h.counts[size]
+		if seen >= rank {
+			return size
+		}
+	}
+	return sizes[len(sizes)-1]
+}
+
+// Summarize the lengths of the keys and values in the tree, in one
+// pass over it that does not read the values themselves. A duplicate
+// key counts once per value.
+func (b *Btree) SizeHistogram() (keySizes, valueSizes Histogram) {
+	var keys, values histogramBuilder
+	it := b.StartSizes(nil)
+	for {
+		ok, k, n := it.Next()
+		if !ok {
+			break
+		}
+		keys.add(len(k))
+		values.add(n)
+	}
+	return keys.histogram(), values.histogram()
+}
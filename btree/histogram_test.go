@@ -0,0 +1,98 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	key := func(i uint32) []byte {
+		k := make([]byte, 4)
+		binary.BigEndian.PutUint32(k, i)
+		return k
+	}
+	for i := uint32(0); i < 10000; i++ {
+		bt.PutNext(key(i), key(i))
+	}
+
+	boundaries := bt.Histogram(4)
+	if len(boundaries) != 3 {
+		t.Fatal("Expected 3 boundaries, got", len(boundaries))
+	}
+	for i, k := range boundaries {
+		if n := binary.BigEndian.Uint32(k); n != uint32(i+1)*2500 {
+			t.Fatal("Expected boundary", i, "at", (i+1)*2500, "got", n)
+		}
+	}
+
+	small := NewInMemoryBtree().(*Btree)
+	for i := uint32(0); i < 3; i++ {
+		small.Put(key(i), key(i))
+	}
+	if boundaries := small.Histogram(10); len(boundaries) != 2 {
+		t.Fatal("Expected a boundary per key after the first, got", boundaries)
+	}
+	if boundaries := small.Histogram(1); boundaries != nil {
+		t.Fatal("Expected no boundaries for a single bucket, got", boundaries)
+	}
+	if boundaries := NewInMemoryBtree().(*Btree).Histogram(4); boundaries != nil {
+		t.Fatal("Expected no boundaries for an empty tree, got", boundaries)
+	}
+
+	dups := NewInMemoryBtreeWithOptions(Options{AllowDuplicates: true}).(*Btree)
+	for i := 0; i < 10; i++ {
+		dups.Put(key(1), key(1))
+	}
+	dups.Put(key(2), key(2))
+	if boundaries := dups.Histogram(4); len(boundaries) != 1 || binary.BigEndian.Uint32(boundaries[0]) != 2 {
+		t.Fatal("Expected all values of a key in one bucket, got", boundaries)
+	}
+}
+
+func TestLeafBoundaries(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	if boundaries := bt.LeafBoundaries(); len(boundaries) != 1 || len(boundaries[0]) != 0 {
+		t.Fatal("Expected the empty leaf of an empty tree, got", boundaries)
+	}
+
+	fill(t, bt)
+	boundaries := bt.LeafBoundaries()
+	if len(boundaries) != bt.Stats().NumLeafPages {
+		t.Fatal("Expected", bt.Stats().NumLeafPages, "boundaries, got", len(boundaries))
+	}
+	for i := 1; i < len(boundaries); i++ {
+		if !keyLess(boundaries[i-1], boundaries[i]) {
+			t.Fatal("Expected boundaries in order")
+		}
+		_, _, pageRefs := bt.search(boundaries[i])
+		page := bt.pager.Get(pageRefs[len(pageRefs)-1])
+		if first, _ := page.GetKey(0); !bytes.Equal(first, boundaries[i]) {
+			t.Fatal("Expected boundary", i, "to start its leaf")
+		}
+	}
+}
+
+func TestSizeHistogram(t *testing.T) {
+	bt := NewBtree()
+	if k, v := bt.SizeHistogram(); k != (Histogram{}) || v != (Histogram{}) {
+		t.Fatal("Expected empty histograms, got", k, v)
+	}
+
+	// keys of 4 bytes, values of 1 to 100 bytes
+	for i := uint32(1); i <= 100; i++ {
+		k := make([]byte, 4)
+		binary.BigEndian.PutUint32(k, i)
+		bt.Put(k, make([]byte, i))
+	}
+	bt.Put([]byte{1}, make([]byte, 2*pageSize))
+
+	keys, values := bt.SizeHistogram()
+	if want := (Histogram{Count: 101, Min: 1, Max: 4, Mean: float64(4*100+1) / 101, P50: 4, P99: 4}); keys != want {
+		t.Fatal("Expected", want, "got", keys)
+	}
+	if values.Count != 101 || values.Min != 1 || values.Max != 2*pageSize || values.P50 != 51 || values.P99 != 100 {
+		t.Fatal("Unexpected value sizes", values)
+	}
+}
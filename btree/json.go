@@ -0,0 +1,81 @@
+package btree
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// JSON form of a key/value pair. encoding/json writes byte slices as
+// base64, so binary keys and values stay valid JSON.
+type jsonPair struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Write the whole index as a JSON array of {"key":..., "value":...}
+// objects with base64 encoded keys and values, in key order. Meant
+// for debugging and test fixtures, not for large indexes.
+func (b *Btree) ExportJSON(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	if _, err := out.WriteString("["); err != nil {
+		return err
+	}
+
+	iter := b.Start([]byte{})
+	for i := 0; ; i++ {
+		ok, k, v := iter.Next()
+		if !ok {
+			break
+		}
+		if i > 0 {
+			if _, err := out.WriteString(",\n"); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(jsonPair{k, v})
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if _, err := out.WriteString("]\n"); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// Read an index written by ExportJSON. The pairs do not have to be in
+// key order.
+func ImportJSON(r io.Reader) (*Btree, error) {
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil {
+		return nil, err
+	} else if t != json.Delim('[') {
+		return nil, fmt.Errorf("Expected a JSON array, got %v", t)
+	}
+
+	b := NewBtree()
+	for dec.More() {
+		var pair jsonPair
+		if err := dec.Decode(&pair); err != nil {
+			return nil, err
+		}
+		if len(pair.Key) == 0 {
+			return nil, fmt.Errorf("Got empty key")
+		}
+		if pair.Value == nil {
+			pair.Value = []byte{}
+		}
+		b.Put(pair.Key, pair.Value)
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,61 @@
+package btree
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	index := NewInMemoryBtree()
+	fill(t, index)
+	index.Put([]byte{0, 255}, []byte{})
+	bt := index.(*Btree)
+
+	buf := &bytes.Buffer{}
+	if err := bt.ExportJSON(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	bt2, err := ImportJSON(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bt2.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+
+	iter1 := bt.Start([]byte{})
+	iter2 := bt2.Start([]byte{})
+	for {
+		ok1, k1, v1 := iter1.Next()
+		ok2, k2, v2 := iter2.Next()
+		if ok1 != ok2 || bytes.Compare(k1, k2) != 0 || bytes.Compare(v1, v2) != 0 {
+			t.Fatal("Not the same:", ok1, ok2, k1, k2, v1, v2)
+		}
+		if !ok1 {
+			break
+		}
+	}
+}
+
+func TestImportJSONErrors(t *testing.T) {
+	for _, s := range []string{
+		`{"key":"AQ=="}`,
+		`[{"key":"","value":"AQ=="}]`,
+		`[{"key":"AQ==","value":"AQ=="}`,
+		`[{"key":"not base64","value":"AQ=="}]`,
+	} {
+		if _, err := ImportJSON(strings.NewReader(s)); err == nil {
+			t.Error("Expected an error for", s)
+		}
+	}
+
+	bt, err := ImportJSON(strings.NewReader(`[{"key":"Ag==","value":"AQ=="}, {"key":"AQ==","value":null}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, v := bt.Get([]byte{1}); !ok || len(v) != 0 {
+		t.Fatal("Expected an empty value, got", ok, v)
+	}
+}
@@ -0,0 +1,37 @@
+package btree
+
+// A key/value pair owned by the caller, filled in by Iter2.
+type KV struct {
+	Key, Value []byte
+}
+
+// Iterates by copying into a caller owned KV.
+type Iter2 interface {
+	// Copy the next key and value into buf, reusing and growing
+	// its slices as needed. Returns false when done, leaving buf
+	// alone.
+	Next(buf *KV) bool
+}
+
+type kvIter struct {
+	it *btreeIter
+}
+
+func (i kvIter) Next(buf *KV) bool {
+	ok, key, ref := i.it.nextRef()
+	if !ok {
+		return false
+	}
+	buf.Key = append(buf.Key[:0], key...)
+	buf.Value = append(buf.Value[:0], i.it.b.value(key, ref)...)
+	return true
+}
+
+// Like Start, but copies each key and value into a caller owned KV
+// that is reused from one pair to the next, so the caller controls
+// allocation and the copies stay valid while the tree changes. buf
+// is emptied.
+func (b *Btree) StartInto(prefix []byte, buf *KV) Iter2 {
+	buf.Key, buf.Value = buf.Key[:0], buf.Value[:0]
+	return kvIter{b.Start(prefix).(*btreeIter)}
+}
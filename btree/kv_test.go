@@ -0,0 +1,59 @@
+package btree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStartInto(t *testing.T) {
+	index := NewInMemoryBtree()
+	fill(t, index)
+	bt := index.(*Btree)
+
+	var kv KV
+	expected := bt.Start([]byte{4})
+	it := bt.StartInto([]byte{4}, &kv)
+	for {
+		ok1, k, v := expected.Next()
+		ok2 := it.Next(&kv)
+		if ok1 != ok2 {
+			t.Fatal("Not the same:", ok1, ok2)
+		}
+		if !ok1 {
+			break
+		}
+		if bytes.Compare(k, kv.Key) != 0 || bytes.Compare(v, kv.Value) != 0 {
+			t.Fatal("Not the same:", k, v, kv)
+		}
+		// the copies are ours to modify
+		kv.Value[0]++
+	}
+}
+
+func BenchmarkNext(b *testing.B) {
+	index := NewInMemoryBtree()
+	fill(b, index)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := index.Start([]byte{})
+		for ok, _, _ := it.Next(); ok; ok, _, _ = it.Next() {
+		}
+	}
+}
+
+func BenchmarkNextInto(b *testing.B) {
+	index := NewInMemoryBtree()
+	fill(b, index)
+	bt := index.(*Btree)
+
+	var kv KV
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := bt.StartInto([]byte{}, &kv)
+		for it.Next(&kv) {
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package btree
+
+// Iterate over the leaves in key order, yielding the live keys of
+// each leaf with their values at once, for tools that work in batches
+// of a page. A duplicate key comes once per value, leaves with only
+// tombstones are skipped. The keys share their bytes with the tree,
+// as do the values with Options.ShareValues, so like an iterator's
+// they are only valid until it is modified, and the tree must not be
+// modified while this is in use: it panics with "concurrent
+// modification" like iterators do.
+func (b *Btree) LeafPages() func() (ok bool, keys [][]byte, values [][]byte) {
+	page := b.pager.Get(b.root)
+	for !page.IsLeaf() {
+		_, r := page.GetKey(0)
+		page = b.pager.Get(r)
+	}
+	mods := b.mods
+
+	return func() (ok bool, keys [][]byte, values [][]byte) {
+		if mods != b.mods && !b.opts.UncheckedIteration {
+			panic("concurrent modification")
+		}
+		for page != nil {
+			for i := 0; i < page.Size(); i++ {
+				k, r := page.GetKey(i)
+				if r == tombstone || b.expired(k) {
+					continue
+				}
+				keys, values = append(keys, k), append(values, b.readValue(k, r))
+				for _, d := range b.dups[r] {
+					keys, values = append(keys, k), append(values, b.readValue(nil, d))
+				}
+			}
+
+			if n := page.NextPage(); n != -1 {
+				page = b.pager.Get(n)
+			} else {
+				page = nil
+			}
+			if len(keys) > 0 {
+				return true, keys, values
+			}
+		}
+		return false, nil, nil
+	}
+}
+
+// The separator keys of the internal pages level steps below the root,
+// level 0 being the root itself, in key order: natural boundaries for
+// partitioning the keys into ranges, fewer and coarser the higher up
+// the tree. The first key of each internal page is left out, as it
+// only bounds the keys that its parent's separator already does. nil
+// for a level at or below the leaves. The keys are copies.
+func (b *Btree) SeparatorKeys(level int) (keys [][]byte) {
+	if level < 0 {
+		return nil
+	}
+	pages := []int{b.root}
+	for ; len(pages) > 0; level-- {
+		var children []int
+		for _, ref := range pages {
+			page := b.pager.Get(ref)
+			if page.IsLeaf() {
+				return nil
+			}
+			for i := 0; i < page.Size(); i++ {
+				k, r := page.GetKey(i)
+				if level == 0 && i > 0 {
+					keys = append(keys, copyBytes(k))
+				}
+				if r != -1 {
+					children = append(children, r)
+				}
+			}
+		}
+		if level == 0 {
+			return keys
+		}
+		pages = children
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestLeafPages(t *testing.T) {
+	for _, opts := range []Options{{}, {AllowDuplicates: true}, {InlineValues: 8, LeafFormat: PrefixCompressed}} {
+		bt := NewBtreeWithOptions(opts)
+		for i := 0; i < 5000; i++ {
+			k := []byte(fmt.Sprintf("%05d", i))
+			bt.Put(k, k[3:])
+		}
+		for i := 0; i < 5000; i += 3 {
+			bt.Delete([]byte(fmt.Sprintf("%05d", i)))
+		}
+		if opts.AllowDuplicates {
+			bt.Put([]byte("00001"), []byte("dup"))
+		}
+
+		var keys, values [][]byte
+		leaves := 0
+		next := bt.LeafPages()
+		for {
+			ok, k, v := next()
+			if !ok {
+				break
+			}
+			if len(k) == 0 || len(k) != len(v) {
+				t.Fatal("Expected a non-empty leaf with a value per key, got", len(k), len(v))
+			}
+			keys, values = append(keys, k...), append(values, v...)
+			leaves++
+		}
+
+		it := bt.Start(nil)
+		for i := range keys {
+			ok, k, v := it.Next()
+			if !ok || !bytes.Equal(k, keys[i]) || !bytes.Equal(v, values[i]) {
+				t.Fatal("Expected", string(k), string(v), "got", string(keys[i]), string(values[i]))
+			}
+		}
+		if ok, k, _ := it.Next(); ok {
+			t.Fatal("Expected", string(k), "in a leaf")
+		}
+		if leaves < 2 {
+			t.Fatal("Expected several leaves, got", leaves)
+		}
+	}
+}
+
+func TestSeparatorKeys(t *testing.T) {
+	bt := NewTestBtree(MinKeysPerPage)
+	for i := 0; i < 1000; i++ {
+		bt.Put([]byte(fmt.Sprintf("%04d", i)), []byte{1})
+	}
+
+	prev := 0
+	level := 0
+	for ; ; level++ {
+		keys := bt.SeparatorKeys(level)
+		if keys == nil {
+			break
+		}
+		if len(keys) <= prev {
+			t.Fatal("Expected more separators at level", level, "than", prev, "got", len(keys))
+		}
+		for i := 1; i < len(keys); i++ {
+			if bytes.Compare(keys[i-1], keys[i]) >= 0 {
+				t.Fatal("Expected the separators at level", level, "in order, got", keys)
+			}
+		}
+		prev = len(keys)
+	}
+	if level < 3 {
+		t.Fatal("Expected a deeper tree, got", level, "internal levels")
+	}
+	if bt.SeparatorKeys(level+10) != nil || bt.SeparatorKeys(-1) != nil {
+		t.Fatal("Expected no separators past the internal levels")
+	}
+}
@@ -0,0 +1,49 @@
+package btree
+
+import (
+	"bytes"
+
+	"github.com/avisagie/indexes"
+)
+
+// Put every key and value of other into this tree. When all of
+// other's keys are greater than this tree's, as when concatenating
+// partial indexes built over consecutive key ranges, they are
+// appended with the bulk put of PutNext. Otherwise each is Put. On
+// keys in both indexes other's value wins, or with AllowDuplicates
+// is added as another value.
+func (b *Btree) AbsorbSorted(other indexes.Index) {
+	if other == indexes.Index(b) {
+		return
+	}
+
+	iter := other.Start([]byte{})
+	ok, k, v := iter.Next()
+	if !ok {
+		return
+	}
+
+	// PutNext needs keys beyond deleted ones too, and beyond the
+	// separators on the way down, which stay when TruncateTo empties
+	// the last leaf, so compare with the last key of every page on
+	// the way to the last leaf rather than Max
+	bulk := true
+	for page := b.pager.Get(b.root); bulk && page.Size() > 0; {
+		last, r := page.GetKey(page.Size() - 1)
+		bulk = keyLess(last, k)
+		if page.IsLeaf() {
+			break
+		}
+		page = b.pager.Get(r)
+	}
+
+	var prev []byte
+	for ; ok; ok, k, v = iter.Next() {
+		if bulk && (prev == nil || !bytes.Equal(prev, k)) {
+			b.PutNext(k, v)
+		} else {
+			b.Put(k, v)
+		}
+		prev = k
+	}
+}
@@ -0,0 +1,130 @@
+package btree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAbsorbSorted(t *testing.T) {
+	key := func(i int) []byte {
+		return []byte{byte(i >> 8), byte(i)}
+	}
+
+	// concatenation
+	left := NewInMemoryBtree().(*Btree)
+	right := NewInMemoryBtree().(*Btree)
+	for i := 0; i < 20000; i++ {
+		if i < 10000 {
+			left.Put(key(i), key(i))
+		} else {
+			right.Put(key(i), key(i))
+		}
+	}
+	splits := left.Stats().Splits
+	left.AbsorbSorted(right)
+	if left.Size() != 20000 {
+		t.Fatal("Expected 20000 keys, got", left.Size())
+	}
+	if left.Stats().Splits != splits {
+		t.Fatal("Expected the bulk put, got", left.Stats().Splits-splits, "splits")
+	}
+	if err := left.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+
+	// overlapping ranges, other's values win
+	overlap := NewInMemoryBtree().(*Btree)
+	for i := 5000; i < 25000; i += 2 {
+		overlap.Put(key(i), []byte{1})
+	}
+	left.AbsorbSorted(overlap)
+	if left.Size() != 22500 {
+		t.Fatal("Expected 22500 keys, got", left.Size())
+	}
+	for i := 0; i < 25000; i++ {
+		ok, v := left.Get(key(i))
+		switch {
+		case i >= 5000 && i%2 == 0:
+			if !ok || bytes.Compare(v, []byte{1}) != 0 {
+				t.Fatal("Expected the other value for", i, "got", v)
+			}
+		case i < 20000:
+			if !ok || bytes.Compare(v, key(i)) != 0 {
+				t.Fatal("Expected the original value for", i, "got", v)
+			}
+		default:
+			if ok {
+				t.Fatal("Did not expect", i)
+			}
+		}
+	}
+	if err := left.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+
+	// duplicate keys in other
+	dups := NewInMemoryBtreeWithOptions(Options{AllowDuplicates: true}).(*Btree)
+	dups.Put(key(1), []byte{1})
+	dups.Put(key(1), []byte{2})
+	into := NewInMemoryBtreeWithOptions(Options{AllowDuplicates: true}).(*Btree)
+	into.AbsorbSorted(dups)
+	if values := into.GetAll(key(1)); len(values) != 2 {
+		t.Fatal("Expected both values, got", values)
+	}
+
+	// deleted keys beyond other's keys
+	deleted := NewInMemoryBtree().(*Btree)
+	deleted.Put(key(1), key(1))
+	deleted.Put(key(9), key(9))
+	deleted.Delete(key(9))
+	absorb := NewInMemoryBtree().(*Btree)
+	absorb.Put(key(5), key(5))
+	deleted.AbsorbSorted(absorb)
+	if err := deleted.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := deleted.Get(key(5)); !ok || deleted.Size() != 2 {
+		t.Fatal("Expected to absorb a key before a deleted one")
+	}
+
+	left.AbsorbSorted(left)
+	if left.Size() != 22500 {
+		t.Fatal("Expected absorbing itself to change nothing")
+	}
+}
+
+func TestAbsorbSortedAfterTruncate(t *testing.T) {
+	key := func(i int) []byte {
+		return []byte{byte(i >> 8), byte(i)}
+	}
+	bt := NewTestBtree(MinKeysPerPage)
+	for i := 0; i < 100; i += 2 {
+		bt.Put(key(i), key(i))
+	}
+
+	// cut at the first key of the third leaf, leaving it empty
+	next := bt.LeafPages()
+	n := 0
+	for l := 0; l < 2; l++ {
+		_, keys, _ := next()
+		n += len(keys)
+	}
+	_, keys, _ := next()
+	cut := append([]byte(nil), keys[0]...)
+	bt.TruncateTo(int64(n))
+	if bt.Size() != int64(n) {
+		t.Fatal("Expected", n, "keys, got", bt.Size())
+	}
+
+	// a key between the last one left and the cut
+	other := NewBtree()
+	other.Put([]byte{cut[0], cut[1] - 1}, []byte{1})
+	other.Put(cut, []byte{2})
+	bt.AbsorbSorted(other)
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, v := bt.Get([]byte{cut[0], cut[1] - 1}); !ok || v[0] != 1 || bt.Size() != int64(n)+2 {
+		t.Fatal("Expected the absorbed keys, got", ok, v, bt.Size())
+	}
+}
@@ -0,0 +1,65 @@
+package btree
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Position of the first key in a leaf that is greater than or equal
+// to key.
+func leafPos(page Page, key []byte) int {
+	return sort.Search(page.Size(), func(i int) bool {
+		k, _ := page.GetKey(i)
+		return bytes.Compare(k, key) >= 0
+	})
+}
+
+// Find up to n keys on either side of key, not including key itself.
+// Both are ordered nearest first, so before is in descending and
+// after in ascending order. Either may be shorter than n near the
+// ends of the tree.
+func (b *Btree) Neighbors(key []byte, n int) (before, after [][]byte) {
+	if key == nil || len(key) == 0 {
+		panic("Illegal key nil")
+	}
+
+	before = make([][]byte, 0, n)
+	after = make([][]byte, 0, n)
+
+	// only the keys, so the values are never read
+	it := b.seek(append(copyBytes(key), 0))
+	for len(after) < n {
+		ok, k, _ := it.nextRef()
+		if !ok {
+			break
+		}
+		// a duplicate key comes once per value
+		if len(after) > 0 && bytes.Equal(after[len(after)-1], k) {
+			continue
+		}
+		after = append(after, copyBytes(k))
+	}
+
+	_, _, pageRefs := b.search(key)
+	ref := pageRefs[len(pageRefs)-1]
+	page := b.pager.Get(ref)
+	pos := leafPos(page, key) - 1
+	for len(before) < n {
+		if pos < 0 {
+			ref = page.PrevPage()
+			if ref == -1 {
+				break
+			}
+			page = b.pager.Get(ref)
+			pos = page.Size() - 1
+			continue
+		}
+		k, r := page.GetKey(pos)
+		if r != tombstone && !b.expired(k) {
+			before = append(before, copyBytes(k))
+		}
+		pos--
+	}
+
+	return
+}
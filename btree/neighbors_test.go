@@ -0,0 +1,94 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestNeighbors(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	key := func(i uint32) []byte {
+		k := make([]byte, 4)
+		binary.BigEndian.PutUint32(k, i)
+		return k
+	}
+	// even keys, enough to span several leaves, in random order
+	for _, j := range rand.Perm(30000) {
+		bt.Put(key(uint32(2*j)), key(uint32(2*j)))
+	}
+	bt.Delete(key(100))
+
+	check := func(keys [][]byte, from uint32, step int, n int) {
+		if len(keys) != n {
+			t.Fatal("Expected", n, "keys, got", len(keys))
+		}
+		for i, k := range keys {
+			if e := uint32(int(from) + step*i); binary.BigEndian.Uint32(k) != e {
+				t.Fatal("Expected", e, "got", binary.BigEndian.Uint32(k))
+			}
+		}
+	}
+
+	// every leaf boundary near the target gets crossed for some key
+	for i := uint32(1000); i < 4000; i += 2 {
+		before, after := bt.Neighbors(key(i), 300)
+		check(before, i-2, -2, 300)
+		check(after, i+2, 2, 300)
+	}
+
+	before, after := bt.Neighbors(key(101), 2)
+	check(before, 98, -2, 2)
+	check(after, 102, 2, 2)
+
+	before, after = bt.Neighbors(key(2), 5)
+	check(before, 0, -2, 1)
+	check(after, 4, 2, 5)
+
+	before, after = bt.Neighbors(key(59998), 5)
+	check(before, 59996, -2, 5)
+	check(after, 0, 2, 0)
+
+	small := NewInMemoryBtree().(*Btree)
+	before, after = small.Neighbors(key(1), 5)
+	check(before, 0, -2, 0)
+	check(after, 0, 2, 0)
+}
+
+func TestNeighborsDuplicates(t *testing.T) {
+	bt := NewBtreeWithOptions(Options{AllowDuplicates: true})
+	for _, k := range []string{"a", "b", "b", "c", "e", "e", "f"} {
+		bt.Put([]byte(k), []byte(k))
+	}
+	before, after := bt.Neighbors([]byte("c"), 2)
+	if fmt.Sprintf("%s %s", before, after) != "[b a] [e f]" {
+		t.Fatalf("Expected distinct neighbours, got %s %s", before, after)
+	}
+}
+
+// A Pager that counts the values it reads from overflow pages.
+type overflowCountingPager struct {
+	Pager
+	reads int
+}
+
+func (p *overflowCountingPager) ReadOverflow(ref int) []byte {
+	p.reads++
+	return p.Pager.ReadOverflow(ref)
+}
+
+func TestNeighborsSkipsValues(t *testing.T) {
+	pager := &overflowCountingPager{Pager: newInplacePager()}
+	bt := NewWithPager(pager)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		bt.Put([]byte(k), make([]byte, 2*pageSize))
+	}
+	before, after := bt.Neighbors([]byte("b"), 2)
+	if fmt.Sprintf("%s %s", before, after) != "[a] [c d]" {
+		t.Fatalf("Expected [a] [c d], got %s %s", before, after)
+	}
+	if pager.reads != 0 {
+		t.Fatal("Expected Neighbors not to read the values, got", pager.reads)
+	}
+}
@@ -0,0 +1,186 @@
+package btree
+
+import "time"
+
+// Where to split full pages.
+type SplitPolicy int
+
+const (
+	// Split pages in the middle, leaving both halves half full.
+	SplitMiddle SplitPolicy = iota
+
+	// When a key goes to the end of a full page, keep all other
+	// keys in that page and start a new page to the right of it.
+	// Other inserts still split in the middle. This keeps pages
+	// full for keys that are put in increasing order, like
+	// timestamps.
+	SplitRight
+)
+
+// How leaf pages store their keys.
+type LeafFormat int
+
+const (
+	// Store every key whole.
+	PlainLeaves LeafFormat = iota
+
+	// Store each key as the length of the prefix it shares with
+	// the key before it and the rest of its bytes. Saves memory
+	// when neighbouring keys share long prefixes, like URLs, but
+	// costs CPU to rebuild keys on every read.
+	PrefixCompressed
+)
+
+// The smallest Options.KeysPerPage. An internal page needs a key to
+// move up to its parent and one on either side of it.
+const MinKeysPerPage = 4
+
+// Told about operations on a Btree as they happen, for metrics. The
+// tree calls it from the goroutine doing the operation, so it must be
+// quick and must not use the tree.
+type Observer interface {
+	// Get, hit if the key was found
+	OnGet(hit bool)
+
+	// Put, PutOwned and PutIfAbsent when it puts
+	OnPut(replaced bool)
+
+	// a page split, as counted in BtreeStats.Splits
+	OnSplit()
+
+	// Start and StartReuse, and everything built on them
+	OnIterStart()
+}
+
+// An Observer that is also told how long operations took, for latency
+// histograms. The tree only reads the clock if its Observer is one of
+// these.
+type TimingObserver interface {
+	Observer
+
+	// after OnGet
+	OnGetDone(d time.Duration, hit bool)
+
+	// after OnPut, including the splits the put caused
+	OnPutDone(d time.Duration, replaced bool)
+
+	// after OnSplit, including the splits of parent pages it caused
+	OnSplitDone(d time.Duration)
+}
+
+// Options for a Btree. The zero value gives the default behaviour.
+type Options struct {
+	// Turn the tree into a multimap: Put always adds a new value,
+	// even if the key already exists, and iteration yields the key
+	// once per value, in the order they were put. Get returns the
+	// first value, GetAll all of them. Append extends the first
+	// value and Delete removes all of them.
+	AllowDuplicates bool
+
+	// Where to split full pages. Defaults to SplitMiddle.
+	Split SplitPolicy
+
+	// Keep values of up to this many bytes in the leaf pages
+	// themselves, next to their keys, instead of in the value
+	// log. Saves a slice header per key and a pointer chase per
+	// Get for small values like counters. At most MaxInlineValue,
+	// 0 turns it off. Ignored with AllowDuplicates and Versioned.
+	InlineValues int
+
+	// Iterators and cursors panic with "concurrent modification"
+	// when the tree changes while they are in use. This turns the
+	// check off, for callers that know they never do that.
+	UncheckedIteration bool
+
+	// The longest value the tree accepts, 0 for no limit. PutE
+	// and AppendE fail with ErrValueTooLarge for longer values, Put,
+	// PutOwned, Append and PutNext panic with it. Keys are limited
+	// to MaxKeySize.
+	MaxValueSize int
+
+	// How leaf pages store their keys. Defaults to PlainLeaves.
+	LeafFormat LeafFormat
+
+	// The number of values the tree is expected to hold. Sizes
+	// the value log up front, so that loading that many does not
+	// grow and copy it over and over. Only a hint.
+	ExpectedEntries int
+
+	// The number of values in each segment of the value log. The
+	// log grows by a segment at a time, so this bounds how much a
+	// single Put has to copy when it grows. 0 for
+	// DefaultValueSegmentSize.
+	ValueSegmentSize int
+
+	// Called after every page split with the key the page was
+	// split at, the first key of the new page on the right, and
+	// whether the page was a leaf. For tests and tuning; the tree
+	// must not be used from it. With SplitMiddle a page splits at
+	// the first key past half of its bytes.
+	OnSplit func(splitKey []byte, leaf bool)
+
+	// Remember the leaf the last Get found its key in, and look
+	// there first if the next key falls within its keys. Saves the
+	// search from the root for lookups that keep hitting nearby
+	// keys. Costs two comparisons on a miss.
+	CacheLastLeaf bool
+
+	// Keep every value a key had, so that GetAsOf can read the tree
+	// as it was after any earlier write. Every Put, Append and
+	// Delete takes the next sequence number, see Seq. Nothing is
+	// overwritten or dropped, so the tree grows with every write,
+	// not just every new key, until Compact drops the versions that
+	// are no longer needed. Ignored with AllowDuplicates.
+	Versioned bool
+
+	// Called when Put or Append replace the value of a key that
+	// exists, with the value it had and the one it gets, but not
+	// for new keys or the values AllowDuplicates adds. SwapValues
+	// calls it once for each key, however the values are stored.
+	// The callback must not modify the slices, keep them, or use the
+	// tree.
+	OnOverwrite func(key, oldValue, newValue []byte)
+
+	// Split pages when they hold this many keys, even if there is
+	// room for more, and split them in the middle by count instead
+	// of by bytes. For tests that need splits with few keys. At
+	// least MinKeysPerPage, 0 for no limit.
+	KeysPerPage int
+
+	// Told about every Get, put, split and iteration, nil for
+	// nobody. A TimingObserver is also told how long they took.
+	Observer Observer
+
+	// Thresholds for Health: it recommends Rebuild below this
+	// FillRate or above this DeadValueRatio, and Sweep above this
+	// TombstoneRatio. 0 for DefaultMinFillRate,
+	// DefaultMaxDeadValueRatio and DefaultMaxTombstoneRatio.
+	MinFillRate, MaxDeadValueRatio, MaxTombstoneRatio float64
+
+	// Before splitting a full leaf, move its last key to the next
+	// leaf or its first key to the one before it, if that has room
+	// and the same parent, and split only if neither does. Leaves
+	// stay fuller under random puts, at the cost of rewriting the
+	// parent's keys on every move.
+	RotateToSiblings bool
+
+	// Return the tree's own values from Get, GetAll, GetAsOf, Max,
+	// iterators and cursors instead of copies, saving an allocation
+	// and a copy per value read. The values must not be modified
+	// then, and are only valid until the tree is: a Put or Append of
+	// their key may write over them, and values inline in the leaves
+	// move with every change to their page. Values in overflow pages
+	// are copies either way. For read paths that use each value
+	// before the next write, from a single goroutine.
+	ShareValues bool
+
+	// Check every page against its checksum as it is read, and fail
+	// the read with a *CorruptPageError if it does not match: GetE
+	// returns it, Get panics with it and iterators stop with it as
+	// their Err. Costs a pass over each page a read visits.
+	VerifyReads bool
+
+	// The time PutWithTTL's expiries are compared with, nil for
+	// time.Now in Unix seconds.
+	Clock func() int64
+}
@@ -1,5 +1,10 @@
 package btree
 
+import (
+	"errors"
+	"fmt"
+)
+
 const (
 	pageSize    = 16 << 10
 	ramPageSize = 100 // keys per node (must be even...)
@@ -17,6 +22,13 @@ type PageIter interface {
 	Next() (ok bool, key []byte, ref int)
 }
 
+// Implemented by page iterators that can be pointed at another page
+// instead of allocating a new iterator. Returns false if the page is
+// of a type the iterator does not understand.
+type resettablePageIter interface {
+	reset(page Page, prefix []byte) bool
+}
+
 type Page interface {
 	// Insert these bytes and reference as the key. In non-leaf
 	// nodes, the references points to child nodes with keys equal
@@ -27,9 +39,17 @@ type Page interface {
 	// after this operation returns.
 	Insert(k []byte, ref int) (ok bool)
 
+	// Like Insert, but store a value of at most MaxInlineValue
+	// bytes in the leaf itself, right after the key, instead of a
+	// ref. The entry's ref becomes inlineRef(len(value)), and the
+	// value can be read with inlineValue from the key that GetKey,
+	// Search and iterators return.
+	InsertInline(k []byte, value []byte) (ok bool)
+
 	// Returns true and the key if it is found. Returns false and
 	// one key smaller if not found so that btree can use its
 	// reference to figure out in which child page it belongs...
+	// The key is only valid until the next Search on this page.
 	Search(k []byte) (ok bool, key Key)
 
 	IsLeaf() bool
@@ -38,18 +58,32 @@ type Page interface {
 	NextPage() (ref int)
 	SetNextPage(ref int)
 
+	// Return the previous page at this level
+	PrevPage() (ref int)
+	SetPrevPage(ref int)
+
 	// Iterator support. This iterator will stop at the end of the
 	// page. It is the responsibility of the btree implementation
 	// to find the next page and continue iteration.
 	Start(prefix []byte) PageIter
 
+	// Like Start, but begins at the first key greater than or
+	// equal to key and does not stop until the end of the page.
+	Seek(key []byte) PageIter
+
 	// Get the key and ref at this index. For leaves keys start at
 	// 1. for internal nodes, key number 0 contains the left
 	// reference, as set by SetFirst, and no actual key.
 	GetKey(i int) ([]byte, int)
 
-	// Split this page into the given one
-	Split(newPageRef int, newPage Page) (splitKey []byte)
+	// Split this page into the given one, moving the upper keys
+	// to newPage. With SplitMiddle about half of the bytes stay,
+	// with SplitRight all but the last key.
+	Split(newPageRef int, newPage Page, policy SplitPolicy) (splitKey []byte)
+
+	// Drop the keys from key n on, keeping the first n. See GetKey
+	// for what that means for internal pages.
+	Truncate(n int)
 
 	First() int
 	SetFirst(ref int)
@@ -57,11 +91,94 @@ type Page interface {
 	// Number of keys. See GetKey for an explanation of what to
 	// expect around key 0.
 	Size() int
+
+	// Check the page's contents against its checksum. Returns
+	// ErrChecksum if they do not match.
+	Verify() error
+}
+
+var ErrChecksum = errors.New("Page checksum mismatch")
+
+// Returned by Btree.Verify for the first page that fails
+// verification.
+type CorruptPageError struct {
+	Ref int
+	Err error
 }
 
+func (e *CorruptPageError) Error() string {
+	return fmt.Sprintf("Corrupt page %d: %v", e.Ref, e.Err)
+}
+
+func (e *CorruptPageError) Unwrap() error {
+	return e.Err
+}
+
+// Wraps the tree's pager for Options.VerifyReads.
+type verifyingPager struct {
+	Pager
+}
+
+func (p verifyingPager) Get(ref int) Page {
+	page := p.Pager.Get(ref)
+	if err := page.Verify(); err != nil {
+		panic(&CorruptPageError{Ref: ref, Err: err})
+	}
+	return page
+}
+
+// Stores the pages of a tree, see NewWithPager. Refs are
+// non-negative, -1 means no page. A ref refers to the same page from
+// New until Release, whatever else happens to the pager, except
+// Defrag, which reports what moved. Get returns the page with
+// everything that was done to it since New. After Release the tree
+// does not use the ref again, and New may hand it out for another
+// page. New(false) returns an internal page holding only key 0, the
+// left reference, see Page.GetKey.
 type Pager interface {
 	New(isLeaf bool) (ref int, page Page)
+
+	// A pager that fails to read the page panics with an error.
+	// Iterators turn that into their Err, see ErrIter.
 	Get(ref int) (page Page)
 	Release(ref int)
 	Stats() BtreeStats
+	ResetStats()
+
+	// Compact the pages, dropping released ones, and return the
+	// refs of the pages that moved, old ref to new, and how many
+	// released pages were dropped. The caller must rewrite every
+	// reference to a moved page.
+	Defrag() (moved map[int]int, reclaimed int)
+
+	// Running totals of the finds and comparisons in all pages,
+	// cheap enough to read around every operation.
+	Counters() (finds, comparisons int)
+
+	// Store a copy of value in a chain of overflow pages, linked
+	// by NextPage. Returns the ref of the first page.
+	WriteOverflow(value []byte) (ref int)
+
+	// Reassemble the value stored in the chain of overflow pages
+	// starting at ref.
+	ReadOverflow(ref int) []byte
+
+	// The bytes of each page in the chain of overflow pages starting
+	// at ref, in order, sharing their memory with the pages.
+	OverflowSegments(ref int) [][]byte
+
+	// The length of the value stored in the chain of overflow
+	// pages starting at ref.
+	OverflowLen(ref int) (n int)
+
+	// Release the chain of overflow pages starting at ref. Returns
+	// the length of the value it held.
+	ReleaseOverflow(ref int) (n int)
+
+	// Make every change to the pages so far durable: once Sync
+	// returns nil they must survive a crash. A pager with a
+	// write-ahead log syncs the log before it writes the pages the
+	// log covers, so that a crash in between replays the log. A
+	// pager in memory has nothing to do.
+	Sync() error
 }
@@ -3,9 +3,70 @@ package btree
 import (
 	"bytes"
 	"fmt"
+	"hash/crc32"
+	"math/bits"
 	"sort"
+	"sync"
 )
 
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// crcZeros[k] maps the state of the CRC32C of some bytes to its state
+// after 2^k more zero bytes, as a matrix over GF(2): bit i of the
+// state goes to crcZeros[k][i]. Enough of them to skip a page.
+var crcZeros = func() (ops [][32]uint32) {
+	// one zero bit shifts the state right, xoring in the
+	// polynomial for the bit that falls off
+	var op [32]uint32
+	op[0] = crc32.Castagnoli
+	for i := 1; i < 32; i++ {
+		op[i] = 1 << (i - 1)
+	}
+	for i := 0; i < 3; i++ {
+		op = gf2Square(&op)
+	}
+	ops = make([][32]uint32, bits.Len(pageSize))
+	ops[0] = op
+	for k := 1; k < len(ops); k++ {
+		ops[k] = gf2Square(&ops[k-1])
+	}
+	return
+}()
+
+func gf2Times(op *[32]uint32, v uint32) (w uint32) {
+	for i := 0; v != 0; i, v = i+1, v>>1 {
+		if v&1 != 0 {
+			w ^= op[i]
+		}
+	}
+	return
+}
+
+func gf2Square(op *[32]uint32) (square [32]uint32) {
+	for i := range square {
+		square[i] = gf2Times(op, op[i])
+	}
+	return
+}
+
+// The CRC32C of data, given crc, the one it had while the bytes at
+// offset were old. A CRC is linear: the two differ by the CRC of the
+// xor of the two, with zero bytes in front, which don't change it,
+// and behind, which the crcZeros skip. This costs the length of old
+// rather than of data.
+func updateCRC(crc uint32, data []byte, offset int, old []byte) uint32 {
+	var delta uint32
+	for i, b := range old {
+		delta = castagnoli[byte(delta)^b^data[offset+i]] ^ delta>>8
+	}
+	for k, n := 0, len(data)-offset-len(old); n != 0; k, n = k+1, n>>1 {
+		if n&1 != 0 {
+			delta = gf2Times(&crcZeros[k], delta)
+		}
+	}
+	return crc ^ delta
+}
+
 // Implements Page using byte slices on the heap. Keys store length,
 // bytes and a reference to the value in the page itself. If it is a
 // leaf, the first key has zero bytes, and its reference is the left
@@ -20,6 +81,12 @@ import (
 //   valueRef: int32, LittleEndian
 //   bytes
 //   repeat
+//
+// A value stored inline follows its key's bytes and is counted in
+// its length.
+//
+// The page keeps a CRC32C of the used part of data, i.e. the keys and
+// their refs, up to date as it is modified.
 type inplacePage struct {
 	// built up while the page is in RAM and when it is read from
 	// disk.
@@ -29,15 +96,26 @@ type inplacePage struct {
 	// disk.
 	data []byte
 
-	// Reference to the next page
+	// Reference to the next and previous page
 	next   int32
+	prev   int32
 	isLeaf bool
 	r      *inplacePager
 
 	// where are we in the current buffer?
 	nextOffset int
 
+	// CRC32C of data[:nextOffset]
+	crc uint32
+
+	// overflow pages hold a chunk of a large value in data
+	// instead of keys.
+	overflow bool
+
 	finds, comparisons int
+
+	// the result of the last Search
+	found keyRef
 }
 
 type inplacePageIter struct {
@@ -60,6 +138,15 @@ func (i *inplacePageIter) Next() (ok bool, key []byte, ref int) {
 	return true, key, ref
 }
 
+func (i *inplacePageIter) reset(page Page, prefix []byte) bool {
+	p, ok := page.(*inplacePage)
+	if !ok {
+		return false
+	}
+	i.pos, i.prefix, i.p = p.find(prefix), prefix, p
+	return true
+}
+
 type keyRef struct {
 	key []byte
 	ref int
@@ -73,11 +160,6 @@ func (k keyRef) Ref() int {
 	return k.ref
 }
 
-func newKeyRef(key []byte, ref int) keyRef {
-	return keyRef{key, ref}
-}
-
-var nilKeyRef = keyRef{nilBytes, -1}
 var nilBytes []byte
 
 func newInplacePage(isLeaf bool, r *inplacePager) *inplacePage {
@@ -85,6 +167,7 @@ func newInplacePage(isLeaf bool, r *inplacePager) *inplacePage {
 		offsets:     make([]int, 0),
 		data:        make([]byte, pageSize),
 		next:        -1,
+		prev:        -1,
 		isLeaf:      isLeaf,
 		r:           r,
 		nextOffset:  0,
@@ -97,21 +180,45 @@ func newInplacePage(isLeaf bool, r *inplacePager) *inplacePage {
 	return ret
 }
 
+// Binary search for the position of the first key greater than or
+// equal to key. Search and Insert both use it, so a page costs about
+// log2(Size()) comparisons per find.
 func (p *inplacePage) find(key []byte) (pos int) {
+	comparisons := p.comparisons
 	pos = sort.Search(len(p.offsets), func(i int) bool {
 		p.comparisons++
 		k, _ := p.readKey(i)
 		return bytes.Compare(k, key) >= 0 // !keyLess(k, key)
 	})
 	p.finds++
+	p.r.finds++
+	p.r.comparisons += p.comparisons - comparisons
 	return
 }
 
-func (p *inplacePage) writeKey(offset int, key []byte, ref int) {
-	length := len(key)
+func (p *inplacePage) writeKey(offset int, key, value []byte, ref int) {
+	length := len(key) + len(value)
 	writeInt32(p.data, offset, int32(length))
 	writeInt32(p.data, offset+4, int32(ref))
-	copy(p.data[offset+8:offset+8+length], key)
+	copy(p.data[offset+8:offset+8+len(key)], key)
+	copy(p.data[offset+8+len(key):offset+8+length], value)
+
+	// keys are written at the end of the used part of data, so
+	// the checksum can be extended instead of recomputed. Writes
+	// over an existing entry update it afterwards from the bytes
+	// they changed.
+	p.crc = crc32.Update(p.crc, castagnoli, p.data[offset:offset+8+length])
+}
+
+func (p *inplacePage) checksum() uint32 {
+	return crc32.Checksum(p.data[:p.nextOffset], castagnoli)
+}
+
+func (p *inplacePage) Verify() error {
+	if p.nextOffset > len(p.data) || p.checksum() != p.crc {
+		return ErrChecksum
+	}
+	return nil
 }
 
 func (p *inplacePage) readKey(pos int) (key []byte, ref int) {
@@ -120,11 +227,22 @@ func (p *inplacePage) readKey(pos int) (key []byte, ref int) {
 	offset+=4
 	ref = int(readInt32(p.data, offset))
 	offset+=4
-	key = p.data[offset : offset+length]
+	key = p.data[offset : offset+length-inlineLen(ref)]
 	return
 }
 
 func (p *inplacePage) Insert(key []byte, ref int) bool {
+	return p.insert(key, nil, ref)
+}
+
+func (p *inplacePage) InsertInline(key []byte, value []byte) bool {
+	if !p.isLeaf {
+		panic("Inline values only go in leaves")
+	}
+	return p.insert(key, value, inlineRef(len(value)))
+}
+
+func (p *inplacePage) insert(key, value []byte, ref int) bool {
 	pos := -1
 
 	// short cut for in-order inserts
@@ -146,19 +264,39 @@ func (p *inplacePage) Insert(key []byte, ref int) bool {
 		k, _ := p.readKey(pos)
 		// replace
 		if bytes.Compare(key, k) == 0 {
-			writeInt32(p.data, p.offsets[pos]+4, int32(ref))
+			offset := p.offsets[pos]
+			if int(readInt32(p.data, offset)) >= len(key)+len(value) {
+				// fits where the old entry was, dropping any
+				// inline value it had
+				crc := p.crc
+				old := append(p.r.scratchData[:0], p.data[offset:offset+8+len(key)+len(value)]...)
+				p.writeKey(offset, key, value, ref)
+				p.crc = updateCRC(crc, p.data[:p.nextOffset], offset, old)
+				p.r.scratchData = old
+				return true
+			}
+
+			// a larger inline value, move the entry to the
+			// end of the page
+			if p.nextOffset+len(key)+len(value)+4+4 >= pageSize {
+				return false
+			}
+			offset = p.nextOffset
+			p.nextOffset += 8 + len(key) + len(value)
+			p.writeKey(offset, key, value, ref)
+			p.offsets[pos] = offset
 			return true
 		}
 	}
 
-	if p.nextOffset+len(key)+4+4 >= pageSize {
+	if p.nextOffset+len(key)+len(value)+4+4 >= pageSize || p.r.full(len(p.offsets)) {
 		return false
 	}
 
 	// append the key to the page
 	offset := p.nextOffset
-	p.nextOffset += 8 + len(key)
-	p.writeKey(offset, key, ref)
+	p.nextOffset += 8 + len(key) + len(value)
+	p.writeKey(offset, key, value, ref)
 
 	// insert its offset into the right place in p.offsets to
 	// maintain sorted order.
@@ -174,17 +312,24 @@ func (p *inplacePage) Search(key []byte) (ok bool, k Key) {
 	if pos == len(p.offsets) {
 		// key is greater than the last key in this page.
 		if !p.isLeaf {
-			return false, newKeyRef(p.readKey(pos - 1))
+			return false, p.setFound(p.readKey(pos - 1))
 		}
-		return false, nilKeyRef
+		return false, p.setFound(nilBytes, -1)
 	}
 
-	k = newKeyRef(p.readKey(pos))
-	ok = bytes.Compare(key, k.Get()) == 0
-	if !ok && !p.isLeaf && bytes.Compare(key, k.Get()) < 0 { // keyLess(key, k.Get()) {
-		k = newKeyRef(p.readKey(pos - 1))
+	found := p.setFound(p.readKey(pos))
+	ok = bytes.Compare(key, found.key) == 0
+	if !ok && !p.isLeaf && bytes.Compare(key, found.key) < 0 { // keyLess(key, k.Get()) {
+		found = p.setFound(p.readKey(pos - 1))
 	}
-	return
+	return ok, found
+}
+
+// Search results are returned in the page itself to avoid allocating
+// a Key per page visited.
+func (p *inplacePage) setFound(key []byte, ref int) *keyRef {
+	p.found = keyRef{key, ref}
+	return &p.found
 }
 
 func (p *inplacePage) IsLeaf() bool {
@@ -199,23 +344,41 @@ func (p *inplacePage) SetNextPage(ref int) {
 	p.next = int32(ref)
 }
 
+func (p *inplacePage) PrevPage() (ref int) {
+	return int(p.prev)
+}
+
+func (p *inplacePage) SetPrevPage(ref int) {
+	p.prev = int32(ref)
+}
+
 func (p *inplacePage) Start(prefix []byte) PageIter {
 	return &inplacePageIter{p.find(prefix), prefix, p}
 }
 
+func (p *inplacePage) Seek(key []byte) PageIter {
+	return &inplacePageIter{p.find(key), nilBytes, p}
+}
+
 func (p *inplacePage) GetKey(i int) ([]byte, int) {
 	return p.readKey(i)
 }
 
 // Used in split. Does not need to do binary search, just keep adding
-// to the end.
+// to the end. key is the whole entry, including any inline value.
 func (p *inplacePage) appendKey(key []byte, ref int) {
-	p.writeKey(p.nextOffset, key, ref)
+	p.writeKey(p.nextOffset, key, nil, ref)
 	p.offsets = append(p.offsets, p.nextOffset)
 	p.nextOffset += 8 + len(key)
 }
 
-func (p *inplacePage) Split(newPageRef int, newPage1 Page) (splitKey []byte) {
+// Keys stay on the left, in order, while the bytes they take up fit
+// in half a page, or all of it with SplitRight. The first key that
+// does not fit, or the last key if they all do, is the split key: it
+// and the keys after it move to newPage, except that an internal page
+// moves the split key up to its parent instead. The split point only
+// depends on the sizes of the keys, so it is deterministic.
+func (p *inplacePage) Split(newPageRef int, newPage1 Page, policy SplitPolicy) (splitKey []byte) {
 	//fmt.Println("Splitting")
 
 	newPage, ok := newPage1.(*inplacePage)
@@ -228,6 +391,12 @@ func (p *inplacePage) Split(newPageRef int, newPage1 Page) (splitKey []byte) {
 
 	p.offsets = p.offsets[:0]
 	p.nextOffset = 0
+	p.crc = 0
+	leftBytes := pageSize / 2
+	if policy == SplitRight {
+		leftBytes = pageSize
+	}
+
 	i := 0
 	var (
 		offset, ref int
@@ -238,7 +407,12 @@ func (p *inplacePage) Split(newPageRef int, newPage1 Page) (splitKey []byte) {
 		length := int(readInt32(p.r.scratchData, offset))
 		ref = int(readInt32(p.r.scratchData, offset+4))
 		key = p.r.scratchData[offset+8 : offset+8+length]
-		if length+p.nextOffset > pageSize/2 {
+		// the last key always goes right, or up for internal
+		// pages
+		if length+p.nextOffset > leftBytes || i == len(p.r.scratchOffsets)-1 {
+			break
+		}
+		if policy == SplitMiddle && p.r.keysPerPage > 0 && i == len(p.r.scratchOffsets)/2 {
 			break
 		}
 		//fmt.Println(i, "Copying", offset, key, ref, "left to", p.nextOffset)
@@ -251,7 +425,7 @@ func (p *inplacePage) Split(newPageRef int, newPage1 Page) (splitKey []byte) {
 		newPage.SetFirst(int(ref))
 		i++
 	}
-	splitKey = copyBytes(key)
+	splitKey = copyBytes(key[:len(key)-inlineLen(ref)])
 	//fmt.Println(i, "Splitkey =", splitKey)
 
 	for ; i < len(p.r.scratchOffsets); i++ {
@@ -266,6 +440,20 @@ func (p *inplacePage) Split(newPageRef int, newPage1 Page) (splitKey []byte) {
 	return
 }
 
+func (p *inplacePage) Truncate(n int) {
+	p.r.scratchData = append(p.r.scratchData[:0], p.data...)
+	p.r.scratchOffsets = append(p.r.scratchOffsets[:0], p.offsets[:n]...)
+
+	p.offsets = p.offsets[:0]
+	p.nextOffset = 0
+	p.crc = 0
+	for _, offset := range p.r.scratchOffsets {
+		length := int(readInt32(p.r.scratchData, offset))
+		ref := int(readInt32(p.r.scratchData, offset+4))
+		p.appendKey(p.r.scratchData[offset+8:offset+8+length], ref)
+	}
+}
+
 func (p *inplacePage) First() int {
 	return int(readInt32(p.data, 4))
 }
@@ -275,29 +463,91 @@ func (p *inplacePage) SetFirst(ref int) {
 		panic("Not setting first on non-leaf node")
 	}
 
+	var old [4]byte
+	copy(old[:], p.data[4:8])
 	writeInt32(p.data, 4, int32(ref))
+	p.crc = updateCRC(p.crc, p.data[:p.nextOffset], 4, old[:])
 }
 
 func (p *inplacePage) Size() int {
 	return len(p.offsets)
 }
 
-// Implements Pager by keeping pages in RAM on the heap.
+// Implements Pager by keeping pages in RAM on the heap. Pages are
+// inplacePages, except for leaves in the PrefixCompressed format.
 type inplacePager struct {
-	pages          []*inplacePage
+	pages          []Page
 	freePages      []int
 	scratchData    []byte
 	scratchOffsets []int
+
+	// totals over all pages, including released ones
+	finds, comparisons int
+
+	leafFormat LeafFormat
+
+	// Options.KeysPerPage
+	keysPerPage int
+
+	// scratch space for prefixPage
+	scratchKey     []byte
+	scratchEntries []prefixEntry
+
+	// released inplacePages, for newPage to reuse
+	pool sync.Pool
 }
 
 func newInplacePager() *inplacePager {
-	return &inplacePager{make([]*inplacePage, 0), make([]int, 0), make([]byte, pageSize), make([]int, 32)}
+	return &inplacePager{
+		pages:          make([]Page, 0),
+		freePages:      make([]int, 0),
+		scratchData:    make([]byte, pageSize),
+		scratchOffsets: make([]int, 32),
+	}
+}
+
+// Whether a page with n keys is full, by Options.KeysPerPage.
+func (r *inplacePager) full(n int) bool {
+	return r.keysPerPage > 0 && n >= r.keysPerPage
 }
 
 func (r *inplacePager) New(isLeaf bool) (ref int, page Page) {
-	// This always allocates a new page, i.e. it does not reuse
-	// pages. It forgets them so that GC can get them. It only
-	// reuses refs.
+	if isLeaf && r.leafFormat == PrefixCompressed {
+		return r.add(newPrefixPage(r))
+	}
+	return r.add(r.newPage(isLeaf))
+}
+
+// Like newInplacePage, but reuses a released page if there is one.
+func (r *inplacePager) newPage(isLeaf bool) *inplacePage {
+	p, ok := r.pool.Get().(*inplacePage)
+	if !ok {
+		return newInplacePage(isLeaf, r)
+	}
+	p.reset(isLeaf)
+	return p
+}
+
+// Clear a released page for reuse, so that nothing it held shows up
+// in the page it becomes.
+func (p *inplacePage) reset(isLeaf bool) {
+	clear(p.data)
+	p.offsets = p.offsets[:0]
+	p.next, p.prev = -1, -1
+	p.isLeaf = isLeaf
+	p.nextOffset = 0
+	p.crc = 0
+	p.overflow = false
+	p.finds, p.comparisons = 0, 0
+	p.found = keyRef{}
+	if !isLeaf {
+		p.Insert(nilBytes, -1)
+	}
+}
+
+func (r *inplacePager) add(page Page) (ref int, _ Page) {
+	// Reuses the refs of released pages. The pages themselves go
+	// to the pool, which GC may empty.
 
 	if len(r.freePages) > 0 {
 		ref := r.freePages[len(r.freePages)-1]
@@ -305,14 +555,12 @@ func (r *inplacePager) New(isLeaf bool) (ref int, page Page) {
 		if r.pages[ref] != nil {
 			panic(fmt.Sprint("page", ref, "was in freePages, but the page appears to be in use"))
 		}
-		page := newInplacePage(isLeaf, r)
 		r.pages[ref] = page
 		return ref, page
 	}
 
 	ref = len(r.pages)
-	r.pages = append(r.pages, newInplacePage(isLeaf, r))
-	page = r.pages[ref]
+	r.pages = append(r.pages, page)
 	return ref, page
 }
 
@@ -325,27 +573,159 @@ func (r *inplacePager) Get(ref int) (page Page) {
 }
 
 func (r *inplacePager) Release(ref int) {
+	if p, ok := r.pages[ref].(*inplacePage); ok {
+		r.pool.Put(p)
+	}
 	r.freePages = append(r.freePages, ref)
 	r.pages[ref] = nil
 }
 
+func (r *inplacePager) WriteOverflow(value []byte) (ref int) {
+	ref = -1
+	var prev *inplacePage
+	for len(value) > 0 {
+		n := len(value)
+		if n > pageSize {
+			n = pageSize
+		}
+
+		p := r.newPage(true)
+		pageRef, _ := r.add(p)
+		p.overflow = true
+		copy(p.data, value[:n])
+		p.nextOffset = n
+		p.crc = p.checksum()
+		value = value[n:]
+
+		if prev == nil {
+			ref = pageRef
+		} else {
+			prev.next = int32(pageRef)
+		}
+		prev = p
+	}
+	return
+}
+
+func (r *inplacePager) ReadOverflow(ref int) []byte {
+	value := make([]byte, 0, pageSize)
+	for ref != -1 {
+		p := r.Get(ref).(*inplacePage)
+		value = append(value, p.data[:p.nextOffset]...)
+		ref = int(p.next)
+	}
+	return value
+}
+
+func (r *inplacePager) OverflowSegments(ref int) (segments [][]byte) {
+	for ref != -1 {
+		p := r.Get(ref).(*inplacePage)
+		segments = append(segments, p.data[:p.nextOffset:p.nextOffset])
+		ref = int(p.next)
+	}
+	return
+}
+
+func (r *inplacePager) OverflowLen(ref int) (n int) {
+	for ref != -1 {
+		p := r.Get(ref).(*inplacePage)
+		n += p.nextOffset
+		ref = int(p.next)
+	}
+	return
+}
+
+func (r *inplacePager) ReleaseOverflow(ref int) (n int) {
+	for ref != -1 {
+		p := r.Get(ref).(*inplacePage)
+		n += p.nextOffset
+		next := int(p.next)
+		r.Release(ref)
+		ref = next
+	}
+	return
+}
+
+// The number of released pages waiting on the free list for New to
+// reuse, and the number of pages there are, free or not. A large share
+// of free pages is memory that only Defrag gives back.
+func (r *inplacePager) FreeListStats() (freePages int, totalPages int) {
+	return len(r.freePages), len(r.pages)
+}
+
 func (r *inplacePager) Stats() BtreeStats {
 	ret := BtreeStats{}
+	ret.FreePages = len(r.freePages)
 	sumFill := 0.0
 	countFill := 0.0
-	for _, p := range r.pages {
-		if p != nil {
-			ret.Finds += p.finds
-			ret.Comparisons += p.comparisons
-			sumFill += float64(p.nextOffset) / float64(pageSize)
-			countFill += 1.0
-			if p.IsLeaf() {
-				ret.NumLeafPages++
-			} else {
-				ret.NumInternalPages++
+	for _, page := range r.pages {
+		var finds, comparisons, used int
+		switch p := page.(type) {
+		case *inplacePage:
+			if p.overflow {
+				ret.NumOverflowPages++
+				continue
 			}
+			finds, comparisons, used = p.finds, p.comparisons, p.nextOffset
+		case *prefixPage:
+			finds, comparisons, used = p.finds, p.comparisons, p.nextOffset
+		default:
+			continue
+		}
+
+		ret.Finds += finds
+		ret.Comparisons += comparisons
+		sumFill += float64(used) / float64(pageSize)
+		countFill += 1.0
+		if page.IsLeaf() {
+			ret.NumLeafPages++
+		} else {
+			ret.NumInternalPages++
 		}
 	}
 	ret.FillRate = sumFill / countFill
 	return ret
 }
+
+func (r *inplacePager) ResetStats() {
+	for _, page := range r.pages {
+		switch p := page.(type) {
+		case *inplacePage:
+			p.finds, p.comparisons = 0, 0
+		case *prefixPage:
+			p.finds, p.comparisons = 0, 0
+		}
+	}
+	r.finds, r.comparisons = 0, 0
+}
+
+// Nothing to do, the pages are only in memory.
+func (r *inplacePager) Sync() error {
+	return nil
+}
+
+func (r *inplacePager) Counters() (finds, comparisons int) {
+	return r.finds, r.comparisons
+}
+
+func (r *inplacePager) Defrag() (moved map[int]int, reclaimed int) {
+	moved = make(map[int]int)
+	n := 0
+	for ref, p := range r.pages {
+		if p == nil {
+			continue
+		}
+		if ref != n {
+			moved[ref] = n
+		}
+		r.pages[n] = p
+		n++
+	}
+	for i := n; i < len(r.pages); i++ {
+		r.pages[i] = nil
+	}
+	reclaimed = len(r.pages) - n
+	r.pages = r.pages[:n]
+	r.freePages = r.freePages[:0]
+	return
+}
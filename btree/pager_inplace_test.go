@@ -2,6 +2,8 @@ package btree
 
 import (
 	"bytes"
+	"hash/crc32"
+	"math/rand"
 	"testing"
 )
 
@@ -156,3 +158,146 @@ func TestInplacePageInsert(t *testing.T) {
 
 	t.Log(h)
 }
+
+func TestInplacePageChecksum(t *testing.T) {
+	p := newInplacePager()
+	h := newInplacePage(false, p)
+	h.SetFirst(7)
+	h.Insert([]byte{1, 2, 3}, 1)
+	h.Insert([]byte{1, 2}, 2)
+	h.Insert([]byte{1, 2}, 3)
+	if err := h.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	h.data[9] ^= 0xFF
+	if err := h.Verify(); err != ErrChecksum {
+		t.Fatal("Expected a checksum mismatch, got", err)
+	}
+}
+
+func TestUpdateCRC(t *testing.T) {
+	data := make([]byte, pageSize)
+	rand.Read(data)
+	for _, n := range []int{0, 1, 8, 1000, pageSize} {
+		crc := crc32.Checksum(data[:n], castagnoli)
+		for _, w := range [][2]int{{0, 0}, {0, 4}, {n / 2, 3}, {n - 4, 4}, {0, n}} {
+			if w[0] < 0 || w[0]+w[1] > n {
+				continue
+			}
+			old := append([]byte(nil), data[w[0]:w[0]+w[1]]...)
+			rand.Read(data[w[0] : w[0]+w[1]])
+			want := crc32.Checksum(data[:n], castagnoli)
+			if got := updateCRC(crc, data[:n], w[0], old); got != want {
+				t.Fatal("Expected", want, "for", n, "bytes changed at", w, "got", got)
+			}
+			crc = want
+		}
+	}
+
+	// replaces on both kinds of page keep the checksum in step
+	r := newInplacePager()
+	for _, page := range []Page{newInplacePage(true, r), newPrefixPage(r)} {
+		for i := 0; i < 100; i++ {
+			page.Insert([]byte{byte(i), 1}, i)
+		}
+		for i := 0; i < 1000; i++ {
+			page.Insert([]byte{byte(rand.Intn(100)), 1}, i)
+			if err := page.Verify(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	internal := newInplacePage(false, r)
+	internal.Insert([]byte{1}, 2)
+	internal.SetFirst(9)
+	if err := internal.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkInplacePageSearch(b *testing.B) {
+	p := newInplacePager()
+	h := newInplacePage(true, p)
+	keys := make([][]byte, 0)
+	for i := 0; ; i++ {
+		k := []byte{byte(i >> 8), byte(i), 0, 0, 0, 0, 0, 0}
+		if !h.Insert(k, i) {
+			break
+		}
+		keys = append(keys, k)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Search(keys[i%len(keys)])
+	}
+	b.StopTimer()
+	b.Log(len(keys), "keys,", float64(h.comparisons)/float64(h.finds), "comparisons per find")
+}
+
+func TestInplacePagerPool(t *testing.T) {
+	r := newInplacePager()
+	ref, page := r.New(true)
+	p := page.(*inplacePage)
+	p.Insert([]byte{1, 2, 3}, 7)
+	p.SetNextPage(5)
+	p.SetPrevPage(6)
+	p.Search([]byte{1, 2, 3})
+	r.Release(ref)
+
+	// a pooled page comes back empty, whether or not the pool kept it
+	for _, isLeaf := range []bool{true, false} {
+		ref, page = r.New(isLeaf)
+		p = page.(*inplacePage)
+		if page.IsLeaf() != isLeaf || page.NextPage() != -1 || page.PrevPage() != -1 || p.overflow {
+			t.Fatal("Expected a fresh page, got", page.IsLeaf(), page.NextPage(), page.PrevPage(), p.overflow)
+		}
+		if ok, _ := page.Search([]byte{1, 2, 3}); ok {
+			t.Fatal("Did not expect to find a key of the released page")
+		}
+		if bytes.Count(p.data[p.nextOffset:], []byte{0}) != len(p.data)-p.nextOffset {
+			t.Fatal("Expected the rest of the page to be zero")
+		}
+		if err := page.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		r.Release(ref)
+	}
+
+	// overflow chains reuse each other's pages
+	long := bytes.Repeat([]byte{1}, 3*pageSize)
+	short := bytes.Repeat([]byte{2}, pageSize+10)
+	r.ReleaseOverflow(r.WriteOverflow(long))
+	ref = r.WriteOverflow(short)
+	if !bytes.Equal(r.ReadOverflow(ref), short) {
+		t.Fatal("Expected the short value back")
+	}
+	if n := r.ReleaseOverflow(ref); n != len(short) {
+		t.Fatal("Expected to release", len(short), "bytes, got", n)
+	}
+}
+
+func TestFreeListStats(t *testing.T) {
+	bt := NewBtree()
+	pager := bt.pager.(*inplacePager)
+	for i := 0; i < 10; i++ {
+		bt.Put([]byte{byte(i)}, make([]byte, 2*pageSize))
+	}
+	if free, _ := pager.FreeListStats(); free != 0 {
+		t.Fatal("Expected no free pages yet, got", free)
+	}
+
+	for i := 0; i < 10; i += 2 {
+		bt.Delete([]byte{byte(i)})
+	}
+	free, total := pager.FreeListStats()
+	if free != 10 || total != len(pager.pages) || bt.Stats().FreePages != free {
+		t.Fatal("Expected the overflow pages of 5 values free, got", free, total, bt.Stats().FreePages)
+	}
+
+	bt.Defrag()
+	if free, total := pager.FreeListStats(); free != 0 || bt.Stats().FreePages != 0 || total != len(pager.pages) {
+		t.Fatal("Expected Defrag to drop the free pages, got", free, total)
+	}
+}
@@ -0,0 +1,420 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"sort"
+)
+
+// Every this many keys a prefix page stores a whole key, so that a
+// key can be rebuilt from at most this many entries, and binary
+// search only needs to rebuild keys after the nearest restart.
+const restartInterval = 16
+
+// A leaf page that front codes its keys: each key is stored as the
+// length of the prefix it shares with the key before it and the rest
+// of its bytes. Used with Options{LeafFormat: PrefixCompressed}, it
+// saves memory when neighbouring keys share long prefixes, like URLs
+// or paths, at the price of rebuilding keys on every read and
+// re-encoding the page on inserts that are not at the end.
+//
+// Keys returned by GetKey and page iterators are rebuilt into new
+// slices. Search rebuilds into a buffer of the page's own, valid
+// until the next Search.
+//
+// Format of data, in key order:
+//
+//	shared: uint16, LittleEndian
+//	length: uint16, LittleEndian, the rest of the key and any
+//	        inline value
+//	valueRef: int32, LittleEndian
+//	bytes
+//	repeat
+type prefixPage struct {
+	// where each entry starts in data, in key order
+	offsets []int
+	data    []byte
+
+	next, prev int32
+	r          *inplacePager
+	nextOffset int
+
+	// CRC32C of data[:nextOffset]
+	crc uint32
+
+	finds, comparisons int
+
+	// the result of the last Search, and the buffer its key was
+	// rebuilt into
+	found    keyRef
+	foundKey []byte
+}
+
+// A decoded entry, Split and Insert work on these.
+type prefixEntry struct {
+	key, value []byte
+	ref        int
+}
+
+func newPrefixPage(r *inplacePager) *prefixPage {
+	return &prefixPage{
+		offsets: make([]int, 0),
+		data:    make([]byte, pageSize),
+		next:    -1,
+		prev:    -1,
+		r:       r,
+	}
+}
+
+// The stored parts of the entry at pos: how much it shares with the
+// key before it, the rest of its key and its inline value.
+func (p *prefixPage) entry(pos int) (shared int, suffix, value []byte, ref int) {
+	offset := p.offsets[pos]
+	shared = int(binary.LittleEndian.Uint16(p.data[offset:]))
+	length := int(binary.LittleEndian.Uint16(p.data[offset+2:]))
+	ref = int(readInt32(p.data, offset+4))
+	rest := p.data[offset+8 : offset+8+length]
+	n := len(rest) - inlineLen(ref)
+	return shared, rest[:n], rest[n:], ref
+}
+
+// Rebuild the key at pos into buf, starting from prev, the key at
+// pos-1, if it is not nil.
+func (p *prefixPage) rebuild(buf, prev []byte, pos int) []byte {
+	start := pos - pos%restartInterval
+	if prev != nil && pos%restartInterval != 0 {
+		start = pos
+		buf = append(buf[:0], prev...)
+	}
+	for i := start; i <= pos; i++ {
+		shared, suffix, _, _ := p.entry(i)
+		buf = append(buf[:shared], suffix...)
+	}
+	return buf
+}
+
+// The key at pos in a new slice, followed by its inline value, if
+// any, as inlineValue expects.
+func (p *prefixPage) readKey(pos int, prev []byte) (key []byte, ref int) {
+	p.r.scratchKey = p.rebuild(p.r.scratchKey[:0], prev, pos)
+	_, _, value, ref := p.entry(pos)
+	key = make([]byte, len(p.r.scratchKey)+len(value))
+	copy(key, p.r.scratchKey)
+	copy(key[len(p.r.scratchKey):], value)
+	return key[:len(p.r.scratchKey)], ref
+}
+
+// Position of the first key greater than or equal to key: a binary
+// search over the whole keys at the restarts, then a scan of the keys
+// after the last restart before key.
+func (p *prefixPage) find(key []byte) (pos int) {
+	comparisons := p.comparisons
+	restarts := (len(p.offsets) + restartInterval - 1) / restartInterval
+	g := sort.Search(restarts, func(g int) bool {
+		p.comparisons++
+		_, k, _, _ := p.entry(g * restartInterval)
+		return bytes.Compare(k, key) >= 0
+	})
+
+	if g > 0 {
+		pos = (g - 1) * restartInterval
+		end := g * restartInterval
+		if end > len(p.offsets) {
+			end = len(p.offsets)
+		}
+		buf := p.r.scratchKey[:0]
+		for ; pos < end; pos++ {
+			shared, suffix, _, _ := p.entry(pos)
+			buf = append(buf[:shared], suffix...)
+			p.comparisons++
+			if bytes.Compare(buf, key) >= 0 {
+				break
+			}
+		}
+		p.r.scratchKey = buf
+	}
+
+	p.finds++
+	p.r.finds++
+	p.r.comparisons += p.comparisons - comparisons
+	return
+}
+
+func (p *prefixPage) checksum() uint32 {
+	return crc32.Checksum(p.data[:p.nextOffset], castagnoli)
+}
+
+func (p *prefixPage) Verify() error {
+	if p.nextOffset > len(p.data) || p.checksum() != p.crc {
+		return ErrChecksum
+	}
+	return nil
+}
+
+func sharedPrefix(a, b []byte) (n int) {
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return
+}
+
+// Write an entry for key at the end of data, front coded against
+// prev. Returns false if it does not fit.
+func (p *prefixPage) appendEntry(prev, key, value []byte, ref int) bool {
+	shared := 0
+	if len(p.offsets)%restartInterval != 0 {
+		shared = sharedPrefix(prev, key)
+	}
+	length := len(key) - shared + len(value)
+	if p.nextOffset+length+8 >= pageSize {
+		return false
+	}
+
+	offset := p.nextOffset
+	binary.LittleEndian.PutUint16(p.data[offset:], uint16(shared))
+	binary.LittleEndian.PutUint16(p.data[offset+2:], uint16(length))
+	writeInt32(p.data, offset+4, int32(ref))
+	copy(p.data[offset+8:], key[shared:])
+	copy(p.data[offset+8+len(key)-shared:], value)
+	p.nextOffset += 8 + length
+	p.offsets = append(p.offsets, offset)
+	p.crc = crc32.Update(p.crc, castagnoli, p.data[offset:p.nextOffset])
+	return true
+}
+
+// Decode all entries into the pager's scratch space. They stay valid
+// until the next decode.
+func (p *prefixPage) decode() []prefixEntry {
+	r := p.r
+	r.scratchData = r.scratchData[:0]
+	ends := r.scratchOffsets[:0]
+	for i := range p.offsets {
+		shared, suffix, value, _ := p.entry(i)
+		prev := r.scratchData
+		if i > 0 {
+			prev = r.scratchData[ends[2*i-2]:ends[2*i-1]]
+		}
+		r.scratchKey = append(append(r.scratchKey[:0], prev[:shared]...), suffix...)
+		r.scratchData = append(r.scratchData, r.scratchKey...)
+		r.scratchData = append(r.scratchData, value...)
+		ends = append(ends, len(r.scratchData)-len(value)-len(r.scratchKey), len(r.scratchData)-len(value))
+	}
+	r.scratchOffsets = ends
+
+	// slice only after scratchData stopped growing
+	entries := r.scratchEntries[:0]
+	for i := range p.offsets {
+		_, _, _, ref := p.entry(i)
+		start, end := ends[2*i], ends[2*i+1]
+		next := len(r.scratchData)
+		if i+1 < len(p.offsets) {
+			next = ends[2*i+2]
+		}
+		entries = append(entries, prefixEntry{r.scratchData[start:end], r.scratchData[end:next], ref})
+	}
+	r.scratchEntries = entries
+	return entries
+}
+
+// Replace the page's contents with entries. Returns false, leaving
+// the page empty, if they do not fit.
+func (p *prefixPage) encode(entries []prefixEntry) bool {
+	p.offsets = p.offsets[:0]
+	p.nextOffset = 0
+	p.crc = 0
+	var prev []byte
+	for _, e := range entries {
+		if !p.appendEntry(prev, e.key, e.value, e.ref) {
+			return false
+		}
+		prev = e.key
+	}
+	return true
+}
+
+func (p *prefixPage) Insert(key []byte, ref int) bool {
+	return p.insert(key, nil, ref)
+}
+
+func (p *prefixPage) InsertInline(key []byte, value []byte) bool {
+	return p.insert(key, value, inlineRef(len(value)))
+}
+
+func (p *prefixPage) insert(key, value []byte, ref int) bool {
+	pos := p.find(key)
+
+	// in order inserts only add an entry
+	if pos == len(p.offsets) {
+		if p.r.full(len(p.offsets)) {
+			return false
+		}
+		var prev []byte
+		if pos > 0 {
+			prev = p.rebuild(p.r.scratchKey[:0], nil, pos-1)
+			p.r.scratchKey = prev
+		}
+		return p.appendEntry(prev, key, value, ref)
+	}
+
+	replace := bytes.Equal(p.rebuild(p.r.scratchKey[:0], nil, pos), key)
+	if _, _, _, old := p.entry(pos); replace && !isInline(old) && !isInline(ref) {
+		var old [4]byte
+		offset := p.offsets[pos] + 4
+		copy(old[:], p.data[offset:offset+4])
+		writeInt32(p.data, offset, int32(ref))
+		p.crc = updateCRC(p.crc, p.data[:p.nextOffset], offset, old[:])
+		return true
+	}
+
+	if !replace && p.r.full(len(p.offsets)) {
+		return false
+	}
+
+	entries := p.decode()
+	old := entries[pos]
+	if replace {
+		entries[pos] = prefixEntry{key, value, ref}
+	} else {
+		entries = append(entries, prefixEntry{})
+		copy(entries[pos+1:], entries[pos:])
+		entries[pos] = prefixEntry{key, value, ref}
+	}
+	p.r.scratchEntries = entries
+	if !p.encode(entries) {
+		// put it back the way it was
+		if replace {
+			entries[pos] = old
+		} else {
+			entries = append(entries[:pos], entries[pos+1:]...)
+		}
+		p.encode(entries)
+		return false
+	}
+	return true
+}
+
+func (p *prefixPage) Search(key []byte) (ok bool, k Key) {
+	pos := p.find(key)
+	if pos == len(p.offsets) {
+		p.found = keyRef{nilBytes, -1}
+		return false, &p.found
+	}
+
+	_, _, value, ref := p.entry(pos)
+	if len(value) > 0 {
+		// the value is read from after the key, so it must
+		// not be overwritten by the next Search
+		p.found.key, p.found.ref = p.readKey(pos, nil)
+	} else {
+		p.foundKey = p.rebuild(p.foundKey[:0], nil, pos)
+		p.found = keyRef{p.foundKey, ref}
+	}
+	return bytes.Equal(key, p.found.key), &p.found
+}
+
+func (p *prefixPage) IsLeaf() bool {
+	return true
+}
+
+func (p *prefixPage) NextPage() (ref int) {
+	return int(p.next)
+}
+
+func (p *prefixPage) SetNextPage(ref int) {
+	p.next = int32(ref)
+}
+
+func (p *prefixPage) PrevPage() (ref int) {
+	return int(p.prev)
+}
+
+func (p *prefixPage) SetPrevPage(ref int) {
+	p.prev = int32(ref)
+}
+
+type prefixPageIter struct {
+	pos    int
+	prefix []byte
+	p      *prefixPage
+
+	// the key returned last, to rebuild the next one from
+	last []byte
+}
+
+func (i *prefixPageIter) Next() (ok bool, key []byte, ref int) {
+	if i.pos >= len(i.p.offsets) {
+		return
+	}
+	key, ref = i.p.readKey(i.pos, i.last)
+	if !prefixMatches(key, i.prefix) {
+		return false, nilBytes, -1
+	}
+
+	i.pos += 1
+	i.last = key
+	return true, key, ref
+}
+
+func (i *prefixPageIter) reset(page Page, prefix []byte) bool {
+	p, ok := page.(*prefixPage)
+	if !ok {
+		return false
+	}
+	i.pos, i.prefix, i.p, i.last = p.find(prefix), prefix, p, nil
+	return true
+}
+
+func (p *prefixPage) Start(prefix []byte) PageIter {
+	return &prefixPageIter{pos: p.find(prefix), prefix: prefix, p: p}
+}
+
+func (p *prefixPage) Seek(key []byte) PageIter {
+	return &prefixPageIter{pos: p.find(key), prefix: nilBytes, p: p}
+}
+
+func (p *prefixPage) GetKey(i int) ([]byte, int) {
+	return p.readKey(i, nil)
+}
+
+func (p *prefixPage) Split(newPageRef int, newPage1 Page, policy SplitPolicy) (splitKey []byte) {
+	newPage, ok := newPage1.(*prefixPage)
+	if !ok {
+		panic("Cannot split into a different type of page: expected a prefixPage")
+	}
+
+	// the last key always goes right
+	entries := p.decode()
+	i := len(entries) - 1
+	if policy == SplitMiddle && p.r.keysPerPage > 0 {
+		i = len(entries) / 2
+	} else if policy == SplitMiddle {
+		for i = 1; i < len(entries)-1 && p.offsets[i] < p.nextOffset/2; i++ {
+		}
+	}
+
+	if !p.encode(entries[:i]) || !newPage.encode(entries[i:]) {
+		panic("Split pages do not fit")
+	}
+	return copyBytes(entries[i].key)
+}
+
+func (p *prefixPage) Truncate(n int) {
+	p.encode(p.decode()[:n])
+}
+
+func (p *prefixPage) First() int {
+	if len(p.offsets) == 0 {
+		return -1
+	}
+	_, _, _, ref := p.entry(0)
+	return ref
+}
+
+func (p *prefixPage) SetFirst(ref int) {
+	panic("Not setting first on non-leaf node")
+}
+
+func (p *prefixPage) Size() int {
+	return len(p.offsets)
+}
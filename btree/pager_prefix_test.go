@@ -0,0 +1,163 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func urlKeys(n int) [][]byte {
+	keys := make([][]byte, n)
+	for i, j := range rand.Perm(n) {
+		keys[i] = []byte(fmt.Sprintf("https://example.com/some/long/path/%06d/index.html", j))
+	}
+	return keys
+}
+
+func TestPrefixPage(t *testing.T) {
+	r := newInplacePager()
+	r.leafFormat = PrefixCompressed
+	_, page := r.New(true)
+	p := page.(*prefixPage)
+
+	keys := urlKeys(100)
+	for i, k := range keys {
+		if i%3 == 0 {
+			if !p.InsertInline(k, []byte{byte(i)}) {
+				t.Fatal("Expected space for", string(k))
+			}
+		} else if !p.Insert(k, i) {
+			t.Fatal("Expected space for", string(k))
+		}
+	}
+	if err := p.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, k := range keys {
+		ok, found := p.Search(k)
+		if !ok || bytes.Compare(found.Get(), k) != 0 {
+			t.Fatal("Expected to find", string(k), "got", string(found.Get()))
+		}
+		if i%3 == 0 {
+			if v := inlineValue(found.Get(), found.Ref()); len(v) != 1 || v[0] != byte(i) {
+				t.Fatal("Expected the inline value of", string(k), "got", v)
+			}
+		} else if found.Ref() != i {
+			t.Fatal("Expected ref", i, "for", string(k), "got", found.Ref())
+		}
+	}
+
+	// replace in place and with a different inline value
+	p.Insert(keys[1], 1000)
+	p.InsertInline(keys[2], []byte{1, 2, 3})
+	p.Insert(keys[3], 3000)
+	if _, found := p.Search(keys[1]); found.Ref() != 1000 {
+		t.Fatal("Expected the replaced ref")
+	}
+	if _, found := p.Search(keys[2]); bytes.Compare(inlineValue(found.Get(), found.Ref()), []byte{1, 2, 3}) != 0 {
+		t.Fatal("Expected the replaced inline value")
+	}
+	if _, found := p.Search(keys[3]); found.Ref() != 3000 {
+		t.Fatal("Expected the inline value to be replaced by a ref")
+	}
+
+	prev := []byte{}
+	it := p.Start(nil)
+	n := 0
+	for ok, k, _ := it.Next(); ok; ok, k, _ = it.Next() {
+		if !keyLess(prev, k) {
+			t.Fatal("Expected keys in order, got", string(prev), string(k))
+		}
+		prev = k
+		n++
+	}
+	if n != len(keys) {
+		t.Fatal("Expected", len(keys), "keys, got", n)
+	}
+
+	_, other := r.New(true)
+	splitKey := p.Split(1, other, SplitMiddle)
+	if first, _ := other.GetKey(0); bytes.Compare(first, splitKey) != 0 {
+		t.Fatal("Expected the split key to be the first key on the right")
+	}
+	if p.Size()+other.Size() != len(keys) || p.Size() == 0 || other.Size() == 0 {
+		t.Fatal("Expected the keys to be split over both pages, got", p.Size(), other.Size())
+	}
+	if err := p.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrefixCompressed(t *testing.T) {
+	keys := urlKeys(20000)
+	plain := NewInMemoryBtree().(*Btree)
+	bt := NewInMemoryBtreeWithOptions(Options{LeafFormat: PrefixCompressed, InlineValues: 8}).(*Btree)
+	for i, k := range keys {
+		v := []byte(fmt.Sprint(i))
+		plain.Put(k, v)
+		bt.Put(k, v)
+	}
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bt.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	plainLeaves, leaves := plain.Stats().NumLeafPages, bt.Stats().NumLeafPages
+	t.Log("Leaves plain:", plainLeaves, "prefix compressed:", leaves)
+	if leaves*3 > plainLeaves*2 {
+		t.Fatal("Expected the prefix compressed leaves to take much fewer pages")
+	}
+
+	for i, k := range keys {
+		if ok, v := bt.Get(k); !ok || string(v) != fmt.Sprint(i) {
+			t.Fatal("Expected the value of", string(k), "got", v)
+		}
+		if i%2 == 0 {
+			bt.Delete(k)
+		} else if i%3 == 0 {
+			bt.Append(k, []byte("appended"))
+		}
+	}
+	bt.Sweep()
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if bt.Size() != int64(len(keys)/2) {
+		t.Fatal("Expected half the keys left, got", bt.Size())
+	}
+
+	prefix := []byte("https://example.com/some/long/path/0001")
+	want := 0
+	it := bt.Start(prefix)
+	for ok, _, _ := it.Next(); ok; ok, _, _ = it.Next() {
+		want++
+	}
+	c := bt.OpenCursor(prefix)
+	n := 0
+	for c.Prev() {
+		n++
+	}
+	if n != want || n == 0 {
+		t.Fatal("Expected", want, "keys with the prefix backwards, got", n)
+	}
+
+	// bulk loading
+	bulk := NewInMemoryBtreeWithOptions(Options{LeafFormat: PrefixCompressed}).(*Btree)
+	iter := plain.Start(nil)
+	for ok, k, v := iter.Next(); ok; ok, k, v = iter.Next() {
+		bulk.PutNext(k, v)
+	}
+	if err := bulk.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if bulk.Size() != plain.Size() {
+		t.Fatal("Expected", plain.Size(), "keys, got", bulk.Size())
+	}
+}
@@ -0,0 +1,112 @@
+package btree
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Estimate how many leaf splits putting keys would cause, without
+// changing the tree. keys must be sorted. Counts the bytes the new
+// keys add to each leaf they land in against the bytes it already
+// holds; a leaf that overflows splits into half full pages. Keys that
+// are already in the tree are not counted. Values and splits of
+// internal pages are ignored, so this is a planning number, not an
+// exact one.
+func (b *Btree) PredictSplits(keys [][]byte) (splits int) {
+	leaf, added := -1, 0
+	flush := func() {
+		if leaf == -1 || added == 0 {
+			return
+		}
+		page := b.pager.Get(leaf)
+		used := 0
+		for i := 0; i < page.Size(); i++ {
+			k, _ := page.GetKey(i)
+			used += 8 + len(k)
+		}
+		// a page is full when its keys reach pageSize
+		if over := used + added - pageSize; over >= 0 {
+			splits += 1 + over/(pageSize/2)
+		}
+	}
+
+	for _, key := range keys {
+		if key == nil || len(key) == 0 {
+			panic("Illegal key nil")
+		}
+		ok, k, pageRefs := b.search(key)
+		if ok && k.Ref() != tombstone {
+			continue
+		}
+		if ref := pageRefs[len(pageRefs)-1]; ref != leaf {
+			flush()
+			leaf, added = ref, 0
+		}
+		added += 8 + len(key)
+	}
+	flush()
+	return
+}
+
+// Estimate how many values come before key, from where key falls in
+// the pages on its way down the tree. Each page counts as holding an
+// equal share of its parent's values, so this is exact when all pages
+// at a level hold the same number of keys, and off the more they
+// differ, or the more tombstones and duplicates there are.
+func (b *Btree) EstimateRank(key []byte) int64 {
+	if key == nil {
+		panic("Illegal key nil")
+	}
+
+	offset, share := 0.0, 1.0
+	page := b.pager.Get(b.root)
+	for !page.IsLeaf() {
+		// the child key goes to, key 0 being the leftmost
+		n := page.Size()
+		i := sort.Search(n-1, func(i int) bool {
+			k, _ := page.GetKey(i + 1)
+			return bytes.Compare(k, key) > 0
+		})
+		share /= float64(n)
+		offset += float64(i) * share
+		_, r := page.GetKey(i)
+		page = b.pager.Get(r)
+	}
+	if n := page.Size(); n > 0 {
+		offset += float64(leafPos(page, key)) / float64(n) * share
+	}
+	return int64(offset*float64(b.size) + 0.5)
+}
+
+// The first key after all keys that start with prefix, nil if there
+// is none because prefix is empty or all 0xff.
+func prefixEnd(prefix []byte) []byte {
+	end := copyBytes(prefix)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return nil
+	}
+	end[len(end)-1]++
+	return end
+}
+
+// Estimate how many values CountRange(lo, hi, true, false) would count,
+// for a query planner choosing between a scan of the range and one of
+// the whole tree. Costs two descents from the root, whatever the size
+// of the range. The tree keeps no counts per page, so this is the
+// difference of two EstimateRank: each can be off by how unevenly the
+// pages on its path are filled, which, with pages between half and
+// completely full, means up to half the share of each page. In
+// practice both are within a few percent of Size of the true rank, so
+// small ranges come out relatively much less accurate than large ones.
+func (b *Btree) EstimateRangeCount(lo, hi []byte) int64 {
+	if lo == nil || hi == nil {
+		panic("Illegal key nil")
+	}
+	if bytes.Compare(lo, hi) >= 0 {
+		return 0
+	}
+	return max(b.EstimateRank(hi)-b.EstimateRank(lo), 0)
+}
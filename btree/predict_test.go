@@ -0,0 +1,90 @@
+package btree
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+func TestPredictSplits(t *testing.T) {
+	key := func(i int) []byte {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, uint64(i))
+		return k
+	}
+
+	bt := NewInMemoryBtree().(*Btree)
+	for i := 0; i < 100000; i += 4 {
+		bt.Put(key(i), []byte{1})
+	}
+
+	var keys [][]byte
+	for i := 0; i < 100000; i++ {
+		if i%4 != 0 {
+			keys = append(keys, key(i))
+		}
+	}
+	predicted := bt.PredictSplits(keys)
+	if bt.PredictSplits(keys) != predicted || bt.Size() != 25000 {
+		t.Fatal("Expected the prediction to leave the tree alone")
+	}
+
+	splits := bt.Stats().Splits
+	for _, k := range keys {
+		bt.Put(k, []byte{1})
+	}
+	actual := int(bt.Stats().Splits - splits)
+	t.Log("Predicted", predicted, "splits, got", actual)
+	if predicted < actual/2 || predicted > actual*2 {
+		t.Fatal("Expected a prediction near", actual, "got", predicted)
+	}
+
+	if n := bt.PredictSplits(keys); n != 0 {
+		t.Fatal("Expected no splits for keys already in the tree, got", n)
+	}
+	if n := bt.PredictSplits(keys[:1]); n != 0 {
+		t.Fatal("Expected no splits for a single key, got", n)
+	}
+}
+
+func TestEstimateRank(t *testing.T) {
+	bt := NewBtree()
+	key := func(i int) []byte {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, uint64(i))
+		return k
+	}
+	for i := 0; i < 100000; i++ {
+		bt.Put(key(i), []byte{1})
+	}
+	for _, i := range []int{0, 1000, 50000, 99999} {
+		got := bt.EstimateRank(key(i))
+		if d := got - int64(i); d < -5000 || d > 5000 {
+			t.Error("Expected a rank near", i, "got", got)
+		}
+	}
+	if got := bt.EstimateRank([]byte{}); got != 0 {
+		t.Error("Expected nothing before the empty key, got", got)
+	}
+	if got := bt.EstimateRank([]byte{0xff}); got != 100000 {
+		t.Error("Expected everything before the end, got", got)
+	}
+}
+
+func TestEstimateRangeCount(t *testing.T) {
+	bt := NewBtree()
+	keys := rand.Perm(100000)
+	for _, i := range keys {
+		bt.Put(Uint64Key(uint64(i)), []byte{1})
+	}
+	for _, r := range [][2]int{{0, 100000}, {1000, 51000}, {90000, 99999}} {
+		got := bt.EstimateRangeCount(Uint64Key(uint64(r[0])), Uint64Key(uint64(r[1])))
+		want := bt.CountRange(Uint64Key(uint64(r[0])), Uint64Key(uint64(r[1])), true, false)
+		if d := got - want; d < -5000 || d > 5000 {
+			t.Error("Expected about", want, "in", r, "got", got)
+		}
+	}
+	if got := bt.EstimateRangeCount(Uint64Key(10), Uint64Key(5)); got != 0 {
+		t.Error("Expected nothing in an empty range, got", got)
+	}
+}
@@ -0,0 +1,270 @@
+package btree
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/avisagie/indexes"
+)
+
+// Is k below the upper bound hi?
+func belowBound(k, hi []byte, inclusive bool) bool {
+	c := bytes.Compare(k, hi)
+	return c < 0 || (inclusive && c == 0)
+}
+
+// Count the keys between lo and hi, each bound included or not as
+// given. Returns 0 if the range is empty. This iterates over the
+// range, so it is linear in the number of keys counted.
+func (b *Btree) CountRange(lo, hi []byte, loInclusive, hiInclusive bool) (n int64) {
+	if lo == nil || hi == nil {
+		panic("Illegal key nil")
+	}
+	if !belowBound(lo, hi, loInclusive && hiInclusive) {
+		return 0
+	}
+
+	it := b.seek(lo)
+	for {
+		ok, k, _ := it.nextRef()
+		if !ok || !belowBound(k, hi, hiInclusive) {
+			break
+		}
+		if !loInclusive && bytes.Compare(k, lo) == 0 {
+			continue
+		}
+		n++
+	}
+	return
+}
+
+// Iterate over all keys strictly greater than key, e.g. to resume
+// after the last key of the previous page of results.
+func (b *Btree) StartAfter(key []byte) indexes.Iter {
+	if key == nil {
+		panic("Illegal key nil")
+	}
+
+	// The smallest key greater than key is key followed by a zero
+	// byte.
+	return b.seek(append(copyBytes(key), 0))
+}
+
+type rangeIter struct {
+	it   *btreeIter
+	hi   []byte
+	done bool
+}
+
+func (i *rangeIter) Next() (ok bool, key []byte, value []byte) {
+	if i.done {
+		return false, nil, nil
+	}
+	ok, key, ref := i.it.nextRef()
+	if !ok || (i.hi != nil && !belowBound(key, i.hi, false)) {
+		i.done = i.it.err == nil
+		return false, nil, nil
+	}
+	return true, key, i.it.b.readValue(key, ref)
+}
+
+func (i *rangeIter) Done() bool {
+	return i.done
+}
+
+func (i *rangeIter) Err() error {
+	return i.it.err
+}
+
+// Iterate over the keys from lo up to but not including hi. A nil hi
+// has no upper bound.
+func (b *Btree) Range(lo, hi []byte) indexes.Iter {
+	if lo == nil {
+		panic("Illegal key nil")
+	}
+	return &rangeIter{it: b.seek(lo), hi: hi}
+}
+
+// The values of the keys from lo up to but not including hi, in key
+// order, like Range without the keys. A nil hi has no upper bound.
+// The values are copies, or with Options.ShareValues the tree's own,
+// as Range returns them. Either way this is the place to return them
+// as a single copy, if the value log ever keeps them next to each
+// other.
+func (b *Btree) RangeValues(lo, hi []byte) (values [][]byte) {
+	it := b.Range(lo, hi)
+	for {
+		ok, _, v := it.Next()
+		if !ok {
+			return
+		}
+		values = append(values, v)
+	}
+}
+
+// Split the whole key space into up to n contiguous ranges [lo, hi)
+// with about the same number of keys each, for scanning in parallel
+// with Range, one iterator per goroutine. The first range starts at
+// the empty key and the last has a nil hi, no upper bound. Small
+// trees get fewer ranges, see Histogram.
+func (b *Btree) SplitRanges(n int) (ranges [][2][]byte) {
+	lo := []byte{}
+	for _, boundary := range b.Histogram(n) {
+		ranges = append(ranges, [2][]byte{lo, boundary})
+		lo = boundary
+	}
+	return append(ranges, [2][]byte{lo, nil})
+}
+
+// Iterates backwards over a leaf's keys from pos down, then over the
+// leaves before it.
+type reverseIter struct {
+	b    *Btree
+	page Page
+	pos  int
+	lo   []byte
+	mods uint64
+
+	// duplicate values still to return for dupKey, last first
+	dupKey []byte
+	dups   []int
+}
+
+func (i *reverseIter) Next() (ok bool, key []byte, value []byte) {
+	if i.mods != i.b.mods && !i.b.opts.UncheckedIteration {
+		panic("concurrent modification")
+	}
+
+	if len(i.dups) > 0 {
+		ref := i.dups[len(i.dups)-1]
+		i.dups = i.dups[:len(i.dups)-1]
+		return true, i.dupKey, i.b.readValue(nil, ref)
+	}
+
+	for i.page != nil {
+		if i.pos < 0 {
+			ref := i.page.PrevPage()
+			if ref == -1 {
+				i.page = nil
+				break
+			}
+			i.page = i.b.pager.Get(ref)
+			i.pos = i.page.Size() - 1
+			continue
+		}
+
+		k, r := i.page.GetKey(i.pos)
+		i.pos--
+		if keyLess(k, i.lo) {
+			i.page = nil
+			break
+		}
+		if r == tombstone || i.b.expired(k) {
+			continue
+		}
+
+		// the values of a duplicate key come last first, ending
+		// with the one in the leaf
+		if dups := i.b.dups[r]; len(dups) > 0 {
+			i.dupKey, i.dups = k, append(append(i.dups[:0], r), dups[:len(dups)-1]...)
+			return true, k, i.b.readValue(nil, dups[len(dups)-1])
+		}
+		return true, k, i.b.readValue(k, r)
+	}
+	return false, nil, nil
+}
+
+func (i *reverseIter) Done() bool {
+	return i.page == nil && len(i.dups) == 0
+}
+
+// Iterate over the keys from lo up to but not including hi, like
+// Range, but from high to low. A nil hi has no upper bound.
+func (b *Btree) RangeReverse(lo, hi []byte) indexes.Iter {
+	if lo == nil {
+		panic("Illegal key nil")
+	}
+
+	var page Page
+	pos := 0
+	if hi == nil {
+		page = b.pager.Get(b.root)
+		for !page.IsLeaf() {
+			_, r := page.GetKey(page.Size() - 1)
+			page = b.pager.Get(r)
+		}
+		pos = page.Size() - 1
+	} else {
+		_, _, pageRefs := b.search(hi)
+		page = b.pager.Get(pageRefs[len(pageRefs)-1])
+		pos = leafPos(page, hi) - 1
+	}
+	return &reverseIter{b: b, page: page, pos: pos, lo: lo, mods: b.mods}
+}
+
+type prefixesIter struct {
+	b        *Btree
+	prefixes [][]byte
+	it       indexes.Iter
+
+	// the error starting the iterator of the next prefix failed with
+	err error
+}
+
+func (i *prefixesIter) Next() (ok bool, key []byte, value []byte) {
+	for i.err == nil {
+		if i.it != nil {
+			if ok, key, value = i.it.Next(); ok || iterErr(i.it) != nil {
+				return
+			}
+		}
+		if len(i.prefixes) == 0 {
+			return false, nil, nil
+		}
+		i.start()
+	}
+	return false, nil, nil
+}
+
+// Start the iterator of the next prefix.
+func (i *prefixesIter) start() {
+	defer readError(&i.err)
+	i.it = nil
+	i.it, i.prefixes = i.b.Start(i.prefixes[0]), i.prefixes[1:]
+}
+
+func (i *prefixesIter) Done() bool {
+	return i.err == nil && len(i.prefixes) == 0 && (i.it == nil || i.it.Done())
+}
+
+func (i *prefixesIter) Err() error {
+	if i.err != nil || i.it == nil {
+		return i.err
+	}
+	return iterErr(i.it)
+}
+
+// Iterate over the keys that start with any of prefixes, in order,
+// like one Start per prefix in the order of the prefixes. A prefix
+// that starts with another one in the list is dropped, so every key
+// comes once even if it matches several prefixes. Each prefix costs
+// a search from the root when the iteration gets to it.
+func (b *Btree) StartPrefixes(prefixes [][]byte) indexes.Iter {
+	sorted := make([][]byte, 0, len(prefixes))
+	for _, p := range prefixes {
+		if p == nil {
+			p = []byte{}
+		}
+		sorted = append(sorted, p)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return keyLess(sorted[i], sorted[j]) })
+
+	// a prefix sorts right before the ones that start with it
+	kept := sorted[:0]
+	for _, p := range sorted {
+		if len(kept) == 0 || !prefixMatches(p, kept[len(kept)-1]) {
+			kept = append(kept, p)
+		}
+	}
+	return &prefixesIter{b: b, prefixes: kept}
+}
@@ -0,0 +1,286 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+func TestCountRange(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	key := func(i uint32) []byte {
+		k := make([]byte, 4)
+		binary.BigEndian.PutUint32(k, i)
+		return k
+	}
+	// even keys only, enough to span pages
+	for i := uint32(0); i < 20000; i += 2 {
+		bt.PutNext(key(i), key(i))
+	}
+
+	cases := []struct {
+		lo, hi                   uint32
+		loInclusive, hiInclusive bool
+		expected                 int64
+	}{
+		{100, 200, true, true, 51},
+		{100, 200, true, false, 50},
+		{100, 200, false, true, 50},
+		{100, 200, false, false, 49},
+		{101, 199, true, true, 49},
+		{0, 19998, true, true, 10000},
+		{0, 30000, false, false, 9999},
+		{100, 100, true, true, 1},
+		{100, 100, true, false, 0},
+		{100, 100, false, true, 0},
+		{100, 100, false, false, 0},
+		{101, 101, true, true, 0},
+		{200, 100, true, true, 0},
+	}
+	for _, c := range cases {
+		n := bt.CountRange(key(c.lo), key(c.hi), c.loInclusive, c.hiInclusive)
+		if n != c.expected {
+			t.Error("CountRange", c.lo, c.hi, c.loInclusive, c.hiInclusive, "expected", c.expected, "got", n)
+		}
+	}
+
+	bt.Delete(key(150))
+	if n := bt.CountRange(key(100), key(200), true, true); n != 50 {
+		t.Error("Expected deleted keys not to be counted, got", n)
+	}
+}
+
+func TestStartAfter(t *testing.T) {
+	index := NewInMemoryBtree()
+	fill(t, index)
+	bt := index.(*Btree)
+
+	// page through the whole tree, 1000 keys at a time
+	count := int64(0)
+	after := []byte{}
+	for {
+		it := bt.StartAfter(after)
+		n := 0
+		for ; n < 1000; n++ {
+			ok, k, _ := it.Next()
+			if !ok {
+				break
+			}
+			if !keyLess(after, k) {
+				t.Fatal("Expected", k, "to be after", after)
+			}
+			after = copyBytes(k)
+			count++
+		}
+		if n < 1000 {
+			break
+		}
+	}
+	if count != bt.Size() {
+		t.Fatal("Expected", bt.Size(), "got", count)
+	}
+
+	ok, k, _ := bt.StartAfter([]byte{4, 0, 0, 0}).Next()
+	if !ok || bytes.Compare(k, []byte{4, 1, 0, 0}) != 0 {
+		t.Fatal("Expected {4, 1, 0, 0}, got", ok, k)
+	}
+}
+
+func TestRange(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	for i := 0; i < 1000; i += 2 {
+		bt.Put([]byte{byte(i >> 8), byte(i)}, []byte{byte(i)})
+	}
+
+	count := func(it interface {
+		Next() (bool, []byte, []byte)
+	}) (n int) {
+		for ok, _, _ := it.Next(); ok; ok, _, _ = it.Next() {
+			n++
+		}
+		return
+	}
+	if n := count(bt.Range([]byte{0, 10}, []byte{0, 20})); n != 5 {
+		t.Fatal("Expected 5 keys, got", n)
+	}
+	if n := count(bt.Range([]byte{0, 11}, []byte{0, 21})); n != 5 {
+		t.Fatal("Expected 5 keys, got", n)
+	}
+	if n := count(bt.Range([]byte{}, nil)); n != 500 {
+		t.Fatal("Expected all keys, got", n)
+	}
+	if n := count(bt.Range([]byte{0, 20}, []byte{0, 10})); n != 0 {
+		t.Fatal("Expected an empty range, got", n)
+	}
+}
+
+func TestRangeValues(t *testing.T) {
+	bt := NewBtree()
+	for i := 0; i < 1000; i += 2 {
+		bt.Put([]byte{byte(i >> 8), byte(i)}, []byte{byte(i)})
+	}
+	bt.Delete([]byte{0, 14})
+
+	got := bt.RangeValues([]byte{0, 10}, []byte{0, 20})
+	want := [][]byte{{10}, {12}, {16}, {18}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatal("Expected", want, "got", got)
+	}
+	if n := len(bt.RangeValues([]byte{}, nil)); n != 499 {
+		t.Fatal("Expected all values, got", n)
+	}
+	if got := bt.RangeValues([]byte{0, 20}, []byte{0, 10}); got != nil {
+		t.Fatal("Expected no values, got", got)
+	}
+}
+
+func TestSplitRanges(t *testing.T) {
+	bt := NewInMemoryBtree()
+	fill(t, bt)
+
+	ranges := bt.(*Btree).SplitRanges(8)
+	if len(ranges) != 8 {
+		t.Fatal("Expected 8 ranges, got", len(ranges))
+	}
+	if len(ranges[0][0]) != 0 || ranges[len(ranges)-1][1] != nil {
+		t.Fatal("Expected the ranges to cover the whole key space")
+	}
+
+	total := int64(0)
+	for i, r := range ranges {
+		if i > 0 && bytes.Compare(ranges[i-1][1], r[0]) != 0 {
+			t.Fatal("Expected range", i, "to start where the one before ends")
+		}
+		n := int64(0)
+		it := bt.(*Btree).Range(r[0], r[1])
+		for ok, _, _ := it.Next(); ok; ok, _, _ = it.Next() {
+			n++
+		}
+		if n < bt.Size()/8-1 || n > bt.Size()/8+8 {
+			t.Fatal("Expected about", bt.Size()/8, "keys in range", i, "got", n)
+		}
+		total += n
+	}
+	if total != bt.Size() {
+		t.Fatal("Expected", bt.Size(), "keys in all ranges, got", total)
+	}
+
+	if ranges := NewInMemoryBtree().(*Btree).SplitRanges(4); len(ranges) != 1 {
+		t.Fatal("Expected a single range for an empty tree, got", ranges)
+	}
+}
+
+func TestRangeReverse(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	key := func(i uint32) []byte {
+		k := make([]byte, 4)
+		binary.BigEndian.PutUint32(k, i)
+		return k
+	}
+	// even keys only, enough to span pages
+	for i := uint32(0); i < 20000; i += 2 {
+		bt.PutNext(key(i), key(i))
+	}
+	bt.Delete(key(100))
+
+	cases := []struct {
+		lo, hi   []byte
+		expected []uint32
+	}{
+		{key(95), key(106), []uint32{104, 102, 98, 96}},
+		{key(96), key(104), []uint32{102, 98, 96}},
+		{key(19990), nil, []uint32{19998, 19996, 19994, 19992, 19990}},
+		{[]byte{}, key(5), []uint32{4, 2, 0}},
+		{key(10), key(10), nil},
+		{key(20), key(10), nil},
+	}
+	for _, c := range cases {
+		var got []uint32
+		it := bt.RangeReverse(c.lo, c.hi)
+		for ok, k, v := it.Next(); ok; ok, k, v = it.Next() {
+			if bytes.Compare(k, v) != 0 {
+				t.Fatal("Expected the value of", k)
+			}
+			got = append(got, binary.BigEndian.Uint32(k))
+		}
+		if len(got) != len(c.expected) {
+			t.Fatal("Expected", c.expected, "got", got)
+		}
+		for i := range got {
+			if got[i] != c.expected[i] {
+				t.Fatal("Expected", c.expected, "got", got)
+			}
+		}
+	}
+
+	// across all pages
+	n := 0
+	prev := key(20000)
+	it := bt.RangeReverse([]byte{}, nil)
+	for ok, k, _ := it.Next(); ok; ok, k, _ = it.Next() {
+		if !keyLess(k, prev) {
+			t.Fatal("Expected descending keys, got", k, "after", prev)
+		}
+		prev = copyBytes(k)
+		n++
+	}
+	if int64(n) != bt.Size() || bt.Stats().NumLeafPages < 3 {
+		t.Fatal("Expected all", bt.Size(), "keys over several pages, got", n)
+	}
+
+	dups := NewInMemoryBtreeWithOptions(Options{AllowDuplicates: true}).(*Btree)
+	for i := byte(0); i < 3; i++ {
+		dups.Put([]byte{1}, []byte{i})
+	}
+	dups.Put([]byte{2}, []byte{3})
+	var values []byte
+	it = dups.RangeReverse([]byte{}, nil)
+	for ok, _, v := it.Next(); ok; ok, _, v = it.Next() {
+		values = append(values, v...)
+	}
+	if bytes.Compare(values, []byte{3, 2, 1, 0}) != 0 {
+		t.Fatal("Expected the values last first, got", values)
+	}
+}
+
+func TestStartPrefixes(t *testing.T) {
+	bt := NewBtree()
+	for _, k := range []string{"a1", "a2", "b1", "b2", "ba", "c1", "d1", "d2"} {
+		bt.Put([]byte(k), []byte(k))
+	}
+
+	collect := func(prefixes ...string) (keys []string) {
+		var ps [][]byte
+		for _, p := range prefixes {
+			ps = append(ps, []byte(p))
+		}
+		it := bt.StartPrefixes(ps)
+		for {
+			ok, k, v := it.Next()
+			if !ok {
+				break
+			}
+			if string(k) != string(v) {
+				t.Fatal("Unexpected value", v, "for", k)
+			}
+			keys = append(keys, string(k))
+		}
+		return
+	}
+
+	for _, c := range []struct {
+		prefixes []string
+		want     string
+	}{
+		{[]string{"d", "a"}, "[a1 a2 d1 d2]"},
+		{[]string{"b1", "b", "ba"}, "[b1 b2 ba]"},
+		{[]string{"a", "a", "x", "c1"}, "[a1 a2 c1]"},
+		{[]string{"", "b"}, "[a1 a2 b1 b2 ba c1 d1 d2]"},
+		{nil, "[]"},
+	} {
+		if got := fmt.Sprint(collect(c.prefixes...)); got != c.want {
+			t.Fatal("Expected", c.want, "for", c.prefixes, "got", got)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package btree
+
+import (
+	"github.com/avisagie/indexes"
+)
+
+// The read only part of an index, for consumers that should not be
+// able to modify it.
+type ReadOnlyIndex interface {
+	indexes.ROIndex
+	Contains(key []byte) bool
+
+	// The first and last key and value. ok is false if the index
+	// is empty.
+	Min() (ok bool, key []byte, value []byte)
+	Max() (ok bool, key []byte, value []byte)
+}
+
+type readOnly struct {
+	index indexes.Index
+}
+
+// Wrap index so that only its read methods are reachable. It does no
+// locking of its own.
+func ReadOnly(index indexes.Index) ReadOnlyIndex {
+	return readOnly{index}
+}
+
+func (r readOnly) Get(key []byte) (ok bool, value []byte) {
+	return r.index.Get(key)
+}
+
+func (r readOnly) Start(keyPrefix []byte) indexes.Iter {
+	return r.index.Start(keyPrefix)
+}
+
+func (r readOnly) Size() int64 {
+	return r.index.Size()
+}
+
+func (r readOnly) Contains(key []byte) bool {
+	ok, _ := r.index.Get(key)
+	return ok
+}
+
+func (r readOnly) Min() (ok bool, key []byte, value []byte) {
+	return r.index.Start([]byte{}).Next()
+}
+
+func (r readOnly) Max() (ok bool, key []byte, value []byte) {
+	if m, isMax := r.index.(interface {
+		Max() (bool, []byte, []byte)
+	}); isMax {
+		return m.Max()
+	}
+
+	// no way to go backwards, so go through all of it
+	it := r.index.Start([]byte{})
+	for {
+		more, k, v := it.Next()
+		if !more {
+			return
+		}
+		ok, key, value = more, k, v
+	}
+}
+
+func (b *Btree) Contains(key []byte) bool {
+	ok, _ := b.Get(key)
+	return ok
+}
+
+func (b *Btree) Min() (ok bool, key []byte, value []byte) {
+	return b.Start([]byte{}).Next()
+}
+
+func (b *Btree) Max() (ok bool, key []byte, value []byte) {
+	page := b.pager.Get(b.root)
+	for !page.IsLeaf() {
+		_, r := page.GetKey(page.Size() - 1)
+		page = b.pager.Get(r)
+	}
+
+	for {
+		for i := page.Size() - 1; i >= 0; i-- {
+			k, r := page.GetKey(i)
+			if r == tombstone || b.expired(k) {
+				continue
+			}
+			if dups := b.dups[r]; len(dups) > 0 {
+				return true, k, b.readValue(nil, dups[len(dups)-1])
+			}
+			return true, k, b.readValue(k, r)
+		}
+		ref := page.PrevPage()
+		if ref == -1 {
+			return
+		}
+		page = b.pager.Get(ref)
+	}
+}
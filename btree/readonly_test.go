@@ -0,0 +1,58 @@
+package btree
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/avisagie/indexes"
+)
+
+// An index that only has the methods of indexes.Index
+type plainIndex struct {
+	indexes.Index
+}
+
+func TestReadOnly(t *testing.T) {
+	index := NewInMemoryBtree()
+	keys := fill(t, index)
+
+	min, max := keys[0], keys[0]
+	for _, k := range keys {
+		if keyLess(k, min) {
+			min = k
+		}
+		if keyLess(max, k) {
+			max = k
+		}
+	}
+
+	for _, ro := range []ReadOnlyIndex{ReadOnly(index), ReadOnly(plainIndex{index}), index.(*Btree)} {
+		if _, isBtree := ro.(*Btree); !isBtree {
+			if _, ok := ro.(indexes.Putable); ok {
+				t.Fatal("Expected the wrapper to hide Put")
+			}
+		}
+		if ro.Size() != int64(len(keys)) || !ro.Contains(keys[0]) || ro.Contains([]byte{200, 200, 200, 200, 200}) {
+			t.Fatal("Unexpected contents", ro.Size())
+		}
+		if ok, k, v := ro.Min(); !ok || bytes.Compare(k, min) != 0 || bytes.Compare(v, min) != 0 {
+			t.Fatal("Expected min", min, "got", ok, k, v)
+		}
+		if ok, k, v := ro.Max(); !ok || bytes.Compare(k, max) != 0 || bytes.Compare(v, max) != 0 {
+			t.Fatal("Expected max", max, "got", ok, k, v)
+		}
+	}
+
+	index.(*Btree).Delete(max)
+	if ok, k, _ := index.(*Btree).Max(); !ok || !keyLess(k, max) {
+		t.Fatal("Expected Max to skip the deleted key, got", ok, k)
+	}
+
+	empty := ReadOnly(NewInMemoryBtree())
+	if ok, _, _ := empty.Min(); ok {
+		t.Fatal("Expected no min in an empty index")
+	}
+	if ok, _, _ := empty.Max(); ok {
+		t.Fatal("Expected no max in an empty index")
+	}
+}
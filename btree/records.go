@@ -0,0 +1,165 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/avisagie/indexes"
+)
+
+// Append value as a separate record to the value of key. Each record
+// is prefixed with its length as a uvarint so that GetRecords can
+// split them again. Don't mix this with plain Put or Append on the
+// same key.
+func (b *Btree) AppendRecord(key []byte, value []byte) {
+	if value == nil {
+		panic("Illegal nil key or value")
+	}
+
+	b.Append(key, appendRecord(make([]byte, 0, binary.MaxVarintLen64+len(value)), value))
+}
+
+func appendRecord(dst, value []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(value)))
+	return append(dst, value...)
+}
+
+// Merge records, sorted in increasing order, into the records of key,
+// keeping them sorted and dropping duplicates, e.g. for posting lists
+// of document IDs. The records of key must have been sorted too, by
+// an earlier MergeAppend. Returns how many records were new. Rewrites
+// the whole value, so it costs O(n+m) for n records in the tree and m
+// to merge, and a merge of a few records into a long list is much
+// slower than AppendRecord. Panics if the value of key is not a
+// sequence of records or sortedRecords is out of order.
+func (b *Btree) MergeAppend(key []byte, sortedRecords [][]byte) (added int) {
+	for i, r := range sortedRecords {
+		if r == nil {
+			panic("Illegal nil key or value")
+		}
+		if i > 0 && bytes.Compare(sortedRecords[i-1], r) > 0 {
+			panic("out of order record")
+		}
+	}
+
+	var old [][]byte
+	size := 0
+	ok, value := b.Get(key)
+	if ok {
+		if old, ok = splitRecords(value); !ok {
+			panic("MergeAppend on a value that is not a sequence of records")
+		}
+		size = len(value)
+	} else if len(sortedRecords) == 0 {
+		return 0
+	}
+	for _, r := range sortedRecords {
+		size += binary.MaxVarintLen64 + len(r)
+	}
+
+	merged := make([]byte, 0, size)
+	var last []byte
+	add := func(r []byte) {
+		if last == nil || !bytes.Equal(last, r) {
+			merged = appendRecord(merged, r)
+			last = r
+		}
+	}
+	i, j := 0, 0
+	for i < len(old) || j < len(sortedRecords) {
+		if j == len(sortedRecords) || (i < len(old) && bytes.Compare(old[i], sortedRecords[j]) <= 0) {
+			add(old[i])
+			i++
+		} else {
+			n := len(merged)
+			add(sortedRecords[j])
+			if len(merged) > n {
+				added++
+			}
+			j++
+		}
+	}
+	if added > 0 {
+		b.PutOwned(key, merged)
+	}
+	return
+}
+
+// Get the records appended to key with AppendRecord, in the order
+// they were appended. The records are slices of a copy of the value
+// unless Options.ShareValues, in which case they are only valid
+// until the tree is modified. ok is false if the key does not exist or its value is not a sequence of
+// records.
+func (b *Btree) GetRecords(key []byte) (records [][]byte, ok bool) {
+	ok, value := b.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return splitRecords(value)
+}
+
+func splitRecords(value []byte) (records [][]byte, ok bool) {
+	records = make([][]byte, 0)
+	for len(value) > 0 {
+		length, n := binary.Uvarint(value)
+		if n <= 0 || uint64(len(value)-n) < length {
+			return nil, false
+		}
+		value = value[n:]
+		records = append(records, value[:length:length])
+		value = value[length:]
+	}
+	return records, true
+}
+
+type recordsIter struct {
+	it      *btreeIter
+	to      []byte
+	key     []byte
+	records [][]byte
+	done    bool
+}
+
+func (i *recordsIter) Next() (ok bool, key []byte, value []byte) {
+	for len(i.records) == 0 {
+		if i.done {
+			return false, nil, nil
+		}
+		ok, key, ref := i.it.nextRef()
+		if !ok || !belowBound(key, i.to, true) {
+			i.done = i.it.err == nil
+			return false, nil, nil
+		}
+		value := i.it.b.readValue(key, ref)
+		if i.records, ok = splitRecords(value); !ok {
+			i.records = [][]byte{value}
+		}
+		i.key = key
+	}
+	value = i.records[0]
+	i.records = i.records[1:]
+	return true, i.key, value
+}
+
+func (i *recordsIter) Done() bool {
+	return i.done
+}
+
+func (i *recordsIter) Err() error {
+	return i.it.err
+}
+
+// Iterate over the keys from fromBucket up to and including
+// toBucket, yielding the records appended to each with AppendRecord
+// one at a time, in the order they were appended, with the key they
+// belong to: for time series kept as records under time bucket keys.
+// A plain value that does not split into records comes whole, as a
+// single record; one that happens to split, like a value of a single
+// zero byte, comes split. An empty value has no records and is left
+// out.
+func (b *Btree) StartTimeRange(fromBucket, toBucket []byte) indexes.Iter {
+	if fromBucket == nil || toBucket == nil {
+		panic("Illegal key nil")
+	}
+	return &recordsIter{it: b.seek(fromBucket), to: toBucket}
+}
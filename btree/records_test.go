@@ -0,0 +1,106 @@
+package btree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAppendRecord(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	key := []byte{1, 2, 3}
+
+	if _, ok := bt.GetRecords(key); ok {
+		t.Fatal("Did not expect to find anything")
+	}
+
+	expected := [][]byte{{4, 5, 6}, {}, bytes.Repeat([]byte{7}, 300)}
+	for _, r := range expected {
+		bt.AppendRecord(key, r)
+	}
+
+	records, ok := bt.GetRecords(key)
+	if !ok || len(records) != len(expected) {
+		t.Fatal("Expected", len(expected), "records, got", ok, records)
+	}
+	for i := range expected {
+		if bytes.Compare(records[i], expected[i]) != 0 {
+			t.Fatal("Expected", expected[i], "got", records[i])
+		}
+	}
+
+	bt.Put([]byte{9}, []byte{200})
+	if _, ok := bt.GetRecords([]byte{9}); ok {
+		t.Fatal("Expected a plain value not to split into records")
+	}
+
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeAppend(t *testing.T) {
+	bt := NewBtree()
+	key := []byte("term")
+
+	if added := bt.MergeAppend(key, [][]byte{{3}, {5}, {5}, {9}}); added != 3 {
+		t.Fatal("Expected 3 new records, got", added)
+	}
+	if added := bt.MergeAppend(key, [][]byte{{1}, {5}, {7}, {10}}); added != 3 {
+		t.Fatal("Expected 3 new records, got", added)
+	}
+	if added := bt.MergeAppend(key, [][]byte{{7}}); added != 0 {
+		t.Fatal("Expected no new records, got", added)
+	}
+
+	records, ok := bt.GetRecords(key)
+	expected := [][]byte{{1}, {3}, {5}, {7}, {9}, {10}}
+	if !ok || len(records) != len(expected) {
+		t.Fatal("Expected", expected, "got", ok, records)
+	}
+	for i := range expected {
+		if !bytes.Equal(records[i], expected[i]) {
+			t.Fatal("Expected", expected, "got", records)
+		}
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Expected out of order records to panic")
+			}
+		}()
+		bt.MergeAppend(key, [][]byte{{2}, {1}})
+	}()
+}
+
+func TestStartTimeRange(t *testing.T) {
+	bt := NewBtree()
+	for bucket := byte(1); bucket <= 5; bucket++ {
+		for i := byte(0); i < bucket; i++ {
+			bt.AppendRecord([]byte{bucket}, []byte{bucket, i})
+		}
+	}
+	bt.Put([]byte{3, 0}, []byte{200, 1, 2})
+
+	var got [][]byte
+	it := bt.StartTimeRange([]byte{2}, []byte{4})
+	for {
+		ok, k, v := it.Next()
+		if !ok {
+			break
+		}
+		if k[0] != v[0] && !bytes.Equal(k, []byte{3, 0}) {
+			t.Fatal("Expected the records of", k, "got", v)
+		}
+		got = append(got, v)
+	}
+	expected := [][]byte{{2, 0}, {2, 1}, {3, 0}, {3, 1}, {3, 2}, {200, 1, 2}, {4, 0}, {4, 1}, {4, 2}, {4, 3}}
+	if !it.Done() || len(got) != len(expected) {
+		t.Fatal("Expected", expected, "got", got)
+	}
+	for i := range expected {
+		if !bytes.Equal(got[i], expected[i]) {
+			t.Fatal("Expected", expected, "got", got)
+		}
+	}
+}
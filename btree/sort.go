@@ -0,0 +1,16 @@
+package btree
+
+import (
+	"github.com/avisagie/indexes"
+)
+
+// Sort key/value pairs by key using an in memory tree. If a key
+// appears more than once the last pair with that key wins. The
+// tree keeps its own copies, so pairs can be reused afterwards.
+func SortBytes(pairs [][2][]byte) indexes.Iter {
+	index := NewInMemoryBtree()
+	for _, kv := range pairs {
+		index.Put(kv[0], kv[1])
+	}
+	return index.Start([]byte{})
+}
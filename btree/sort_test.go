@@ -0,0 +1,36 @@
+package btree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSortBytes(t *testing.T) {
+	pairs := [][2][]byte{
+		{[]byte{3}, []byte{1}},
+		{[]byte{1, 2}, []byte{2}},
+		{[]byte{1}, []byte{3}},
+		{[]byte{3}, []byte{4}},
+		{[]byte{2}, []byte{5}},
+	}
+	expected := [][2][]byte{
+		{[]byte{1}, []byte{3}},
+		{[]byte{1, 2}, []byte{2}},
+		{[]byte{2}, []byte{5}},
+		{[]byte{3}, []byte{4}},
+	}
+
+	it := SortBytes(pairs)
+	for i := 0; ; i++ {
+		ok, k, v := it.Next()
+		if !ok {
+			if i != len(expected) {
+				t.Fatal("Expected", len(expected), "pairs, got", i)
+			}
+			break
+		}
+		if i >= len(expected) || bytes.Compare(k, expected[i][0]) != 0 || bytes.Compare(v, expected[i][1]) != 0 {
+			t.Fatal("Unexpected pair", i, k, v)
+		}
+	}
+}
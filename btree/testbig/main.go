@@ -88,7 +88,7 @@ func main() {
 	runtime.GC()
 
 	start = time.Now().UnixNano()
-	index2 := btree.NewInMemoryBtree().(*btree.Btree)
+	index2 := btree.NewBtree()
 	iter := index.Start([]byte{})
 	for {
 		ok, k, v := iter.Next()
@@ -99,7 +99,7 @@ func main() {
 	}
 
 	if index.Size() != index2.Size() {
-		panic(fmt.Sprint("Sizes differ, ", index.Size, " vs ", index2.Size()))
+		panic(fmt.Sprint("Sizes differ, ", index.Size(), " vs ", index2.Size()))
 	}
 
 	printStats(index2.Stats())
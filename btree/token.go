@@ -0,0 +1,136 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+
+	"github.com/avisagie/indexes"
+)
+
+// Returned by StartFromToken for tokens that were not made by Token
+// or were changed since.
+var ErrBadToken = errors.New("Invalid iterator token")
+
+// An iterator that can save its position in a token, for example to
+// continue a scan in a later request. Iterators returned by Start and
+// StartFromToken are TokenIters.
+type TokenIter interface {
+	indexes.Iter
+
+	// An opaque token for the iterator's position, after the last
+	// key Next returned. StartFromToken continues from it. Tokens
+	// carry a checksum, so changed tokens are refused.
+	Token() []byte
+}
+
+// Token format: the prefix and the last key returned, each preceded
+// by its length as a uvarint, the number of values of the last key
+// returned as a uvarint, 0 before the first Next, and a CRC32C of all
+// that.
+func makeToken(prefix, last []byte, n int) []byte {
+	var header [binary.MaxVarintLen64]byte
+	token := make([]byte, 0, len(prefix)+len(last)+3*binary.MaxVarintLen64+4)
+	for _, field := range [][]byte{prefix, last} {
+		token = append(token, header[:binary.PutUvarint(header[:], uint64(len(field)))]...)
+		token = append(token, field...)
+	}
+	token = append(token, header[:binary.PutUvarint(header[:], uint64(n))]...)
+
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.Checksum(token, castagnoli))
+	return append(token, crc[:]...)
+}
+
+func parseToken(token []byte) (prefix, last []byte, n int, err error) {
+	if len(token) < 4 {
+		return nil, nil, 0, ErrBadToken
+	}
+	data, crc := token[:len(token)-4], token[len(token)-4:]
+	if crc32.Checksum(data, castagnoli) != binary.LittleEndian.Uint32(crc) {
+		return nil, nil, 0, ErrBadToken
+	}
+
+	var fields [2][]byte
+	for i := range fields {
+		length, m := binary.Uvarint(data)
+		if m <= 0 || uint64(len(data)-m) < length {
+			return nil, nil, 0, ErrBadToken
+		}
+		fields[i], data = data[m:m+int(length)], data[m+int(length):]
+	}
+	count, m := binary.Uvarint(data)
+	if m <= 0 || m != len(data) || (count == 0) != (len(fields[1]) == 0) {
+		return nil, nil, 0, ErrBadToken
+	}
+	return copyBytes(fields[0]), copyBytes(fields[1]), int(count), nil
+}
+
+func (i *btreeIter) Token() []byte {
+	return makeToken(i.prefix, i.last, i.lastN)
+}
+
+// Iterates from a token on, stopping at the first key without the
+// prefix, which the seek it starts with does not.
+type resumeIter struct {
+	it     *btreeIter
+	prefix []byte
+	done   bool
+}
+
+func (i *resumeIter) Next() (ok bool, key []byte, value []byte) {
+	if i.done {
+		return false, nil, nil
+	}
+	ok, key, value = i.it.Next()
+	if !ok || !prefixMatches(key, i.prefix) {
+		i.done = i.it.err == nil
+		return false, nil, nil
+	}
+	return
+}
+
+func (i *resumeIter) Done() bool {
+	return i.done
+}
+
+func (i *resumeIter) Err() error {
+	return i.it.err
+}
+
+func (i *resumeIter) Token() []byte {
+	return makeToken(i.prefix, i.it.last, i.it.lastN)
+}
+
+// Continue iterating where the iterator that made token with Token
+// was, over the same prefix. Returns ErrBadToken if the token is
+// invalid. Keys put behind the position since are not seen, keys
+// deleted are skipped.
+func (b *Btree) StartFromToken(token []byte) (TokenIter, error) {
+	prefix, last, n, err := parseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return b.Start(prefix).(*btreeIter), nil
+	}
+
+	// The smallest key greater than last is last followed by a
+	// zero byte. With duplicates the values of last that were not
+	// returned yet come first.
+	it := b.seek(append(copyBytes(last), 0))
+	if b.dups != nil {
+		dups := b.seek(last)
+		if ok, k, _ := dups.nextRef(); ok && bytes.Equal(k, last) {
+			if n-1 < len(dups.dups) {
+				dups.dups = dups.dups[n-1:]
+			} else {
+				dups.dups = nil
+			}
+			it = dups
+		}
+	}
+	it.last, it.lastN = last, n
+	return &resumeIter{it: it, prefix: prefix}, nil
+}
@@ -0,0 +1,92 @@
+package btree
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Read up to n pairs from the iterator the token resumes, returning
+// their keys and the next token.
+func tokenPage(t *testing.T, bt *Btree, token []byte, n int) (keys [][]byte, next []byte) {
+	it, err := bt.StartFromToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(keys) < n {
+		ok, k, v := it.Next()
+		if !ok {
+			break
+		}
+		keys = append(keys, append(copyBytes(k), v...))
+	}
+	return keys, it.Token()
+}
+
+func TestToken(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	fill(t, bt)
+
+	for _, prefix := range [][]byte{nil, {7}} {
+		var want [][]byte
+		iter := bt.Start(prefix)
+		for ok, k, v := iter.Next(); ok; ok, k, v = iter.Next() {
+			want = append(want, append(copyBytes(k), v...))
+		}
+
+		var got [][]byte
+		token := bt.Start(prefix).(TokenIter).Token()
+		for {
+			keys, next := tokenPage(t, bt, token, 100)
+			if len(keys) == 0 {
+				break
+			}
+			got = append(got, keys...)
+			token = next
+		}
+
+		if len(got) != len(want) {
+			t.Fatal("Expected", len(want), "keys over all pages, got", len(got))
+		}
+		for i := range want {
+			if bytes.Compare(got[i], want[i]) != 0 {
+				t.Fatal("Expected", want[i], "at", i, "got", got[i])
+			}
+		}
+	}
+
+	token := bt.Start(nil).(TokenIter).Token()
+	for i := range token {
+		bad := copyBytes(token)
+		bad[i] ^= 1
+		if _, err := bt.StartFromToken(bad); err != ErrBadToken {
+			t.Fatal("Expected ErrBadToken for a changed byte", i, "got", err)
+		}
+	}
+	if _, err := bt.StartFromToken(nil); err != ErrBadToken {
+		t.Fatal("Expected ErrBadToken for an empty token, got", err)
+	}
+}
+
+func TestTokenDuplicates(t *testing.T) {
+	bt := NewInMemoryBtreeWithOptions(Options{AllowDuplicates: true}).(*Btree)
+	for i := byte(0); i < 5; i++ {
+		bt.Put([]byte{1}, []byte{i})
+	}
+	bt.Put([]byte{2}, []byte{5})
+
+	var got []byte
+	token := bt.Start(nil).(TokenIter).Token()
+	for {
+		keys, next := tokenPage(t, bt, token, 2)
+		if len(keys) == 0 {
+			break
+		}
+		for _, kv := range keys {
+			got = append(got, kv[1])
+		}
+		token = next
+	}
+	if bytes.Compare(got, []byte{0, 1, 2, 3, 4, 5}) != 0 {
+		t.Fatal("Expected every value once, got", got)
+	}
+}
@@ -0,0 +1,58 @@
+package btree
+
+import "time"
+
+// Put key with a value that expires at expireAt, in the units of
+// Options.Clock, Unix seconds by default. From then on Get, GetAll,
+// Max, iterators and cursors treat the key as absent, but it stays in
+// the tree, and in Size, until PurgeExpired or Delete deletes it,
+// Delete returning false as for a key that is not there. Put,
+// PutOwned and Delete drop the expiry along with the value, Append
+// keeps it, unless it passed, in which case it starts the key over.
+// The expiries are kept in a map by key, not in a header on the
+// value: values in the log are plain slices without headers, inline
+// and overflow values are not in the log at all, and a header would
+// cost every value of every tree for the few that expire. Rebuild
+// carries the map over; Freeze and the dump formats leave it out.
+func (b *Btree) PutWithTTL(key, value []byte, expireAt int64) (replaced bool) {
+	start := b.startTimer()
+	replaced = b.put(key, value, false)
+	if b.expiries == nil {
+		b.expiries = make(map[string]int64)
+	}
+	b.expiries[string(key)] = expireAt
+	b.observePut(start, replaced)
+	return
+}
+
+// Delete the keys that expired at or before now and return how many
+// that were. Like Delete, this leaves tombstones for Sweep.
+func (b *Btree) PurgeExpired(now int64) (purged int64) {
+	for k, at := range b.expiries {
+		if now >= at {
+			// without its expiry, Delete tells whether the key
+			// was still there
+			delete(b.expiries, k)
+			if b.Delete([]byte(k)) {
+				purged++
+			}
+		}
+	}
+	return
+}
+
+// Whether key has an expiry that has passed.
+func (b *Btree) expired(key []byte) bool {
+	if b.expiries == nil {
+		return false
+	}
+	at, ok := b.expiries[string(key)]
+	return ok && b.now() >= at
+}
+
+func (b *Btree) now() int64 {
+	if b.opts.Clock != nil {
+		return b.opts.Clock()
+	}
+	return time.Now().Unix()
+}
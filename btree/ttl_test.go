@@ -0,0 +1,183 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPutWithTTL(t *testing.T) {
+	now := int64(100)
+	bt := NewBtreeWithOptions(Options{Clock: func() int64 { return now }})
+	bt.Put([]byte("a"), []byte("1"))
+	bt.PutWithTTL([]byte("b"), []byte("2"), 110)
+	bt.PutWithTTL([]byte("c"), []byte("3"), 120)
+	bt.PutWithTTL([]byte("d"), []byte("4"), 110)
+	bt.Put([]byte("d"), []byte("5"))
+
+	keys := func() (got []string) {
+		for k := range bt.All() {
+			got = append(got, string(k))
+		}
+		return
+	}
+	if got := fmt.Sprint(keys()); got != "[a b c d]" {
+		t.Fatal("Expected all keys before they expire, got", got)
+	}
+
+	now = 110
+	if ok, _ := bt.Get([]byte("b")); ok {
+		t.Fatal("Expected b to have expired")
+	}
+	if got := fmt.Sprint(keys()); got != "[a c d]" {
+		t.Fatal("Expected b to be skipped, got", got)
+	}
+	if bt.Size() != 4 {
+		t.Fatal("Expected expired keys to count until purged, got", bt.Size())
+	}
+	bt.Append([]byte("c"), []byte("3"))
+	if bt.Delete([]byte("b")) {
+		t.Fatal("Did not expect to delete an expired key")
+	}
+
+	now = 120
+	if ok, _ := bt.Get([]byte("c")); ok {
+		t.Fatal("Expected Append to keep the expiry")
+	}
+	bt.PutWithTTL([]byte("e"), []byte("6"), 200)
+	if n := bt.PurgeExpired(now); n != 1 {
+		t.Fatal("Expected to purge c, got", n)
+	}
+	if got := fmt.Sprint(keys()); got != "[a d e]" || bt.Size() != 3 {
+		t.Fatal("Expected a, d and e to be left, got", got, bt.Size())
+	}
+
+	// the expiry survives a Sweep
+	bt.Sweep()
+	now = 200
+	if got := fmt.Sprint(keys()); got != "[a d]" {
+		t.Fatal("Expected e to expire after Sweep, got", got)
+	}
+}
+
+func TestExpiredKeysAreAbsent(t *testing.T) {
+	now := int64(100)
+	clock := func() int64 { return now }
+	bt := NewBtreeWithOptions(Options{Clock: clock})
+	for _, k := range []string{"a", "b", "c", "d"} {
+		bt.Put([]byte(k), []byte(k))
+	}
+	bt.PutWithTTL([]byte("b"), []byte("old"), 110)
+	bt.PutWithTTL([]byte("x"), []byte("x"), 110)
+	now = 110
+
+	if before, _ := bt.Neighbors([]byte("c"), 2); fmt.Sprintf("%s", before) != "[a]" {
+		t.Fatal("Expected expired keys not to be neighbours, got", fmt.Sprintf("%s", before))
+	}
+	if bt.SwapValues([]byte("a"), []byte("b")) {
+		t.Fatal("Did not expect to swap with an expired key")
+	}
+	if ok, v := bt.Get([]byte("a")); !ok || string(v) != "a" {
+		t.Fatal("Expected a to keep its value, got", ok, v)
+	}
+	if !bt.PutIfAbsent([]byte("b"), []byte("new")) {
+		t.Fatal("Expected PutIfAbsent to put over an expired key")
+	}
+	if ok, v := bt.Get([]byte("b")); !ok || string(v) != "new" {
+		t.Fatal("Expected the new value, got", ok, v)
+	}
+	if bt.Size() != 5 {
+		t.Fatal("Expected the expired value to be replaced, got", bt.Size())
+	}
+
+	// x is deleted by hand before its expiry is purged, y is cut
+	bt.PutWithTTL([]byte("y"), []byte("y"), 200)
+	bt.Delete([]byte("x"))
+	bt.TruncateTo(4)
+	if n := bt.PurgeExpired(now); n != 0 || len(bt.expiries) != 0 {
+		t.Fatal("Expected nothing left to purge, got", n, len(bt.expiries))
+	}
+}
+
+func TestExpiredDuplicates(t *testing.T) {
+	now := int64(100)
+	bt := NewBtreeWithOptions(Options{AllowDuplicates: true, Clock: func() int64 { return now }})
+	bt.PutWithTTL([]byte("k"), []byte("old"), 110)
+	bt.Put([]byte("k"), []byte("old2"))
+	bt.PutWithTTL([]byte("j"), []byte("old"), 110)
+	now = 110
+
+	bt.Put([]byte("j"), []byte("new"))
+	if got := fmt.Sprintf("%s", bt.GetAll([]byte("j"))); got != "[new]" {
+		t.Fatal("Expected only the new value of an expired key, got", got)
+	}
+	if got := fmt.Sprintf("%s", bt.GetAll([]byte("k"))); got != "[old old2]" {
+		t.Fatal("Expected a Put to drop the expiry, got", got)
+	}
+	if bt.Size() != 3 {
+		t.Fatal("Expected 3 values, got", bt.Size())
+	}
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpiredVersions(t *testing.T) {
+	now := int64(100)
+	bt := NewBtreeWithOptions(Options{Versioned: true, Clock: func() int64 { return now }})
+	bt.Put([]byte("a"), []byte("A"))
+	bt.PutWithTTL([]byte("b"), []byte("B"), 110)
+	seqB := bt.Seq()
+	bt.Put([]byte("c"), []byte("C"))
+	now = 110
+
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal("Expected expired keys to count in Size:", err)
+	}
+	bt.Rebuild()
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, v := bt.GetAsOf([]byte("b"), seqB); !ok || string(v) != "B" {
+		t.Fatal("Expected the expired key's old value, got", ok, string(v))
+	}
+	if ok, v := bt.GetAsOf([]byte("c"), bt.Seq()); !ok || string(v) != "C" {
+		t.Fatal("Expected c's own value, got", ok, string(v))
+	}
+}
+
+func TestTruncateToExpired(t *testing.T) {
+	now := int64(100)
+	bt := NewBtreeWithOptions(Options{Clock: func() int64 { return now }})
+	bt.Put([]byte("a"), []byte("A"))
+	bt.PutWithTTL([]byte("b"), []byte("B"), 110)
+	bt.Put([]byte("c"), []byte("C"))
+	now = 110
+
+	bt.TruncateTo(2)
+	if ok, _ := bt.Get([]byte("c")); ok || bt.Size() != 2 {
+		t.Fatal("Expected the expired key to count as one of the two kept, got", bt.Size())
+	}
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSwapValuesKeepsExpiries(t *testing.T) {
+	for _, opts := range []Options{{}, {InlineValues: 8}, {Versioned: true}} {
+		now := int64(100)
+		opts.Clock = func() int64 { return now }
+		bt := NewBtreeWithOptions(opts)
+		bt.PutWithTTL([]byte("a"), []byte("A"), 110)
+		bt.Put([]byte("b"), []byte("B"))
+		if !bt.SwapValues([]byte("a"), []byte("b")) {
+			t.Fatal("Expected to swap")
+		}
+		now = 110
+		if ok, _ := bt.Get([]byte("a")); ok {
+			t.Fatal("Expected a to keep its expiry with", opts.InlineValues, opts.Versioned)
+		}
+		if ok, v := bt.Get([]byte("b")); !ok || string(v) != "A" {
+			t.Fatal("Expected b to get a's value without its expiry, got", ok, v)
+		}
+	}
+}
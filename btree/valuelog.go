@@ -0,0 +1,62 @@
+package btree
+
+// The number of values in a segment of the value log when
+// Options.ValueSegmentSize is 0.
+const DefaultValueSegmentSize = 1 << 20
+
+// The values of a tree, addressed by ref. Kept in segments of segSize
+// values each, so that growing the log starts a new segment instead
+// of copying all the slice headers there are into a bigger array.
+// The zero value is an empty log with the default segment size.
+type valueLog struct {
+	segs    [][][]byte
+	segSize int
+	n       int
+}
+
+// A log sized for expected values, see Options.ExpectedEntries.
+func newValueLog(segSize, expected int) valueLog {
+	if segSize <= 0 {
+		segSize = DefaultValueSegmentSize
+	}
+	l := valueLog{segSize: segSize}
+	if expected > 0 {
+		l.segs = make([][][]byte, 1, (expected+segSize-1)/segSize)
+		l.segs[0] = make([][]byte, 0, min(expected, segSize))
+	}
+	return l
+}
+
+func (l *valueLog) len() int {
+	return l.n
+}
+
+func (l *valueLog) get(ref int) []byte {
+	return l.segs[ref/l.segSize][ref%l.segSize]
+}
+
+func (l *valueLog) set(ref int, value []byte) {
+	l.segs[ref/l.segSize][ref%l.segSize] = value
+}
+
+// Add value at the end of the log and return its ref.
+func (l *valueLog) add(value []byte) (ref int) {
+	if l.segSize == 0 {
+		l.segSize = DefaultValueSegmentSize
+	}
+	ref = l.n
+	last := len(l.segs) - 1
+	if last < 0 || len(l.segs[last]) == l.segSize {
+		// the first segment grows as needed, so that small trees
+		// stay small, the ones after it start out full size
+		size := l.segSize
+		if last < 0 {
+			size = 0
+		}
+		l.segs = append(l.segs, make([][]byte, 0, size))
+		last++
+	}
+	l.segs[last] = append(l.segs[last], value)
+	l.n++
+	return
+}
@@ -0,0 +1,241 @@
+package btree
+
+import "math"
+
+// Values larger than this are stored in a chain of overflow pages in
+// the pager instead of in the value log, so that a pager with fixed
+// size pages never has to reference a value bigger than a page.
+const overflowThreshold = pageSize
+
+// The largest value Options.InlineValues can keep in a leaf.
+const MaxInlineValue = 255
+
+// Leaf refs from inlineBase to inlineBase+MaxInlineValue mark a value
+// of ref-inlineBase bytes stored in the leaf right after its key.
+const inlineBase = math.MinInt32
+
+func isInline(ref int) bool {
+	return ref <= inlineBase+MaxInlineValue
+}
+
+func inlineRef(n int) int {
+	return inlineBase + n
+}
+
+// The length of the inline value ref marks, 0 if it is not inline.
+func inlineLen(ref int) int {
+	if isInline(ref) {
+		return ref - inlineBase
+	}
+	return 0
+}
+
+// The inline value that follows key in its leaf. Its capacity is
+// capped so that appending to it copies instead of writing into the
+// page.
+func inlineValue(key []byte, ref int) []byte {
+	n := len(key) + inlineLen(ref)
+	return key[len(key):n:n]
+}
+
+// Other leaf refs below tombstone refer to the first page of a chain
+// of overflow pages.
+func isOverflow(ref int) bool {
+	return ref < tombstone && !isInline(ref)
+}
+
+func overflowRef(head int) int {
+	return -head - 2
+}
+
+func overflowHead(ref int) int {
+	return -ref - 2
+}
+
+// The value a leaf ref refers to. key is the key as returned by the
+// leaf, needed for inline values; refs of duplicate values are never
+// inline. Values in overflow pages are reassembled into a new slice.
+func (b *Btree) value(key []byte, ref int) []byte {
+	if isInline(ref) {
+		return inlineValue(key, ref)
+	}
+	if isOverflow(ref) {
+		return b.pager.ReadOverflow(overflowHead(ref))
+	}
+	return b.values.get(ref)
+}
+
+// The value a read returns for a leaf ref: a copy, unless
+// Options.ShareValues. Values in overflow pages are copies anyway.
+func (b *Btree) readValue(key []byte, ref int) []byte {
+	v := b.value(key, ref)
+	if b.opts.ShareValues || isOverflow(ref) {
+		return v
+	}
+	return copyBytes(v)
+}
+
+// The value of key in the pieces it is stored in, without joining them
+// into one slice: a value larger than a page comes a page at a time
+// from its overflow pages, saving a multi-megabyte copy for readers
+// that can work through it piece by piece. Other values, including
+// ones built up by Append, which rewrites the value, come whole as a
+// single segment. The segments are copies unless Options.ShareValues,
+// in which case they are only valid until the tree is modified. With
+// AllowDuplicates, only the first value.
+func (b *Btree) GetSegments(key []byte) (segments [][]byte, ok bool) {
+	if key == nil || len(key) == 0 {
+		panic("Illegal key nil")
+	}
+
+	ok, k, _ := b.search(key)
+	if !ok || k.Ref() == tombstone || b.expired(key) {
+		return nil, false
+	}
+	if !isOverflow(k.Ref()) {
+		return [][]byte{b.readValue(k.Get(), k.Ref())}, true
+	}
+	segments = b.pager.OverflowSegments(overflowHead(k.Ref()))
+	if !b.opts.ShareValues {
+		for i, s := range segments {
+			segments[i] = copyBytes(s)
+		}
+	}
+	return segments, true
+}
+
+// The length of the value a leaf ref refers to.
+func (b *Btree) valueLen(ref int) int {
+	if isInline(ref) {
+		return inlineLen(ref)
+	}
+	if isOverflow(ref) {
+		return b.pager.OverflowLen(overflowHead(ref))
+	}
+	return len(b.values.get(ref))
+}
+
+// Whether value goes inline in its leaf. Duplicate values are keyed
+// by their ref, and old versions are not in a leaf, so they never do.
+func (b *Btree) inlines(value []byte) bool {
+	return b.dups == nil && !b.opts.Versioned && b.opts.InlineValues > 0 && len(value) <= b.opts.InlineValues && len(value) <= MaxInlineValue
+}
+
+// Store a copy of value and return the ref the leaf must use. If
+// owned, the value log keeps value itself instead of a copy. Values
+// that go inline are not stored anywhere yet, insert puts them in the
+// leaf.
+func (b *Btree) storeValue(value []byte, owned bool) (ref int) {
+	if b.inlines(value) {
+		return inlineRef(len(value))
+	}
+	b.valueBytes += int64(len(value))
+	if len(value) > overflowThreshold {
+		return overflowRef(b.pager.WriteOverflow(value))
+	}
+	if !owned {
+		value = copyBytes(value)
+	}
+	return b.values.add(value)
+}
+
+// Insert key into page with the ref storeValue returned for value.
+func (b *Btree) insert(page Page, key []byte, ref int, value []byte) bool {
+	if isInline(ref) {
+		return page.InsertInline(key, value)
+	}
+	return page.Insert(key, ref)
+}
+
+// Drop the value at ref, counting it as dead. Inline values go with
+// their leaf entry.
+func (b *Btree) dropValue(ref int) {
+	if isInline(ref) {
+		return
+	}
+	var n int
+	if isOverflow(ref) {
+		n = b.pager.ReleaseOverflow(overflowHead(ref))
+	} else {
+		n = len(b.values.get(ref))
+		b.values.set(ref, nil)
+	}
+	b.valueBytes -= int64(n)
+	b.deadValueBytes += int64(n)
+}
+
+// Replace the value at ref with a copy of value, or value itself if
+// owned. Returns the ref the leaf must use from now on, which changes
+// if the value moves into or out of overflow pages or the leaf. A
+// Versioned tree keeps the old value and always stores a new one.
+func (b *Btree) replaceValue(ref int, value []byte, owned bool) int {
+	if b.versions != nil {
+		return b.storeValue(value, owned)
+	}
+	inLog := ref >= 0 && len(value) <= overflowThreshold && !b.inlines(value)
+	if inLog {
+		old := b.values.get(ref)
+		b.valueBytes += int64(len(value) - len(old))
+		b.deadValueBytes += int64(len(old))
+		if !owned {
+			value = append(old[:0], value...)
+		}
+		b.values.set(ref, value)
+		return ref
+	}
+	b.dropValue(ref)
+	return b.storeValue(value, owned)
+}
+
+// Append value to the value at ref, which is not inline. Returns the
+// ref the leaf must use from now on, like replaceValue.
+func (b *Btree) appendValue(ref int, value []byte) int {
+	if ref >= 0 && len(b.values.get(ref))+len(value) <= overflowThreshold {
+		b.values.set(ref, append(b.values.get(ref), value...))
+		b.valueBytes += int64(len(value))
+		return ref
+	}
+	return b.replaceValue(ref, append(b.value(nil, ref), value...), true)
+}
+
+// Iterate over the value log in the order the values were stored in
+// it, not in key order, with the key that refers to each value. A
+// value overwritten in place by Put takes its old value's place, a
+// value that moved got a new place. Places of values that were
+// deleted or overwritten elsewhere yield ok with a nil key and a nil
+// value, old versions of a Versioned tree their key. Values kept
+// inline or in overflow pages are not in the log. Keys and values are
+// only valid until the tree is modified.
+func (b *Btree) ValueLogOrder() func() (ok bool, key, value []byte) {
+	keys := make([][]byte, b.values.len())
+	it := b.Start(nil).(*btreeIter)
+	for {
+		ok, k, ref := it.nextRef()
+		if !ok {
+			break
+		}
+		if ref >= 0 {
+			keys[ref] = k
+		}
+	}
+	for k, versions := range b.versions {
+		for _, v := range versions {
+			if v.ref >= 0 && keys[v.ref] == nil {
+				keys[v.ref] = []byte(k)
+			}
+		}
+	}
+
+	i := 0
+	return func() (ok bool, key, value []byte) {
+		if i >= len(keys) {
+			return false, nil, nil
+		}
+		key = keys[i]
+		if key != nil {
+			value = b.values.get(i)
+		}
+		i++
+		return true, key, value
+	}
+}
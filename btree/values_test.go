@@ -0,0 +1,412 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOverflowValues(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	fill(t, bt)
+
+	big := make([]byte, 3*pageSize+17)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	key := []byte{1, 2, 3, 4, 5}
+	bt.Put(key, big)
+
+	ok, v := bt.Get(key)
+	if !ok || bytes.Compare(v, big) != 0 {
+		t.Fatal("Expected to get the large value back")
+	}
+	if n := bt.Stats().NumOverflowPages; n != 4 {
+		t.Fatal("Expected 4 overflow pages, got", n)
+	}
+
+	bt.Append(key, []byte{1, 2})
+	ok, v = bt.Get(key)
+	if !ok || len(v) != len(big)+2 || bytes.Compare(v[:len(big)], big) != 0 {
+		t.Fatal("Expected to append to the large value")
+	}
+
+	// move it out of overflow pages and back in again
+	bt.Put(key, []byte{9})
+	if n := bt.Stats().NumOverflowPages; n != 0 {
+		t.Fatal("Expected overflow pages to be released, got", n)
+	}
+	bt.Append(key, big)
+	ok, v = bt.Get(key)
+	if !ok || len(v) != len(big)+1 || v[0] != 9 {
+		t.Fatal("Expected to append into overflow pages")
+	}
+
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bt.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bt.Delete(key) || bt.valueBytes != int64(bt.Size())*4 {
+		t.Fatal("Expected the large value to be dropped:", bt.valueBytes)
+	}
+	if n := bt.Stats().NumOverflowPages; n != 0 {
+		t.Fatal("Expected overflow pages to be released, got", n)
+	}
+}
+
+func TestInlineValues(t *testing.T) {
+	bt := NewInMemoryBtreeWithOptions(Options{InlineValues: 8}).(*Btree)
+	keys := fill(t, bt)
+	if bt.values.len() != 0 || bt.valueBytes != 0 {
+		t.Fatal("Expected all values inline, got", bt.values.len(), bt.valueBytes)
+	}
+	for _, k := range keys {
+		if ok, v := bt.Get(k); !ok || bytes.Compare(v, k) != 0 {
+			t.Fatal("Expected the inline value of", k, "got", v)
+		}
+	}
+
+	// grow inline, move to the value log and back, and delete
+	values := make(map[string][]byte)
+	for i, k := range keys[:5000] {
+		var v []byte
+		switch i % 4 {
+		case 0:
+			v = []byte{byte(i)}
+		case 1:
+			v = make([]byte, 8)
+			binary.LittleEndian.PutUint64(v, uint64(i))
+		case 2:
+			v = bytes.Repeat(k, 10)
+		case 3:
+			bt.Delete(k)
+			continue
+		}
+		bt.Put(k, v)
+		values[string(k)] = v
+	}
+	for i, k := range keys[:5000] {
+		if i%4 == 2 {
+			bt.Put(k, []byte{1, 2})
+			bt.Append(k, []byte{3})
+			values[string(k)] = []byte{1, 2, 3}
+		} else if i%4 == 0 {
+			bt.Append(k, bytes.Repeat(k, 3))
+			values[string(k)] = append(values[string(k)], bytes.Repeat(k, 3)...)
+		}
+	}
+
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bt.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range keys {
+		ok, v := bt.Get(k)
+		want, changed := values[string(k)]
+		switch {
+		case i < 5000 && i%4 == 3:
+			if ok {
+				t.Fatal("Expected", k, "to be deleted")
+			}
+		case changed:
+			if !ok || bytes.Compare(v, want) != 0 {
+				t.Fatal("Expected", want, "for", k, "got", v)
+			}
+		default:
+			if !ok || bytes.Compare(v, k) != 0 {
+				t.Fatal("Expected the inline value of", k, "got", v)
+			}
+		}
+	}
+
+	n := 0
+	iter := bt.Start(nil)
+	for ok, k, v := iter.Next(); ok; ok, k, v = iter.Next() {
+		if _, vv := bt.Get(k); bytes.Compare(v, vv) != 0 {
+			t.Fatal("Expected iteration to return the value of", k)
+		}
+		n++
+	}
+	if int64(n) != bt.Size() {
+		t.Fatal("Expected", bt.Size(), "keys, got", n)
+	}
+}
+
+func TestDeadValueBytes(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	bt.Put([]byte{1}, []byte{1, 2, 3})
+	bt.Put([]byte{2}, []byte{1, 2, 3, 4})
+	bt.Append([]byte{2}, []byte{5})
+	if n := bt.Stats().DeadValueBytes; n != 0 {
+		t.Fatal("Expected no dead bytes, got", n)
+	}
+
+	bt.Put([]byte{1}, []byte{1})
+	bt.Delete([]byte{2})
+	if n := bt.Stats().DeadValueBytes; n != 8 {
+		t.Fatal("Expected 8 dead bytes, got", n)
+	}
+
+	bt.Sweep()
+	if n := bt.Stats().DeadValueBytes; n != 0 {
+		t.Fatal("Expected Sweep to drop dead bytes, got", n)
+	}
+}
+
+func TestShareValues(t *testing.T) {
+	bt := NewBtree()
+	bt.Put([]byte("a"), []byte("1234"))
+	_, v := bt.Get([]byte("a"))
+	v[0] = 'x'
+	_, _, it := bt.Start(nil).Next()
+	it[1] = 'x'
+	if _, v := bt.Get([]byte("a")); string(v) != "1234" {
+		t.Fatal("Expected reads to return copies, got", string(v))
+	}
+
+	shared := NewBtreeWithOptions(Options{ShareValues: true})
+	shared.Put([]byte("a"), []byte("1234"))
+	_, v1 := shared.Get([]byte("a"))
+	_, _, v2 := shared.Start(nil).Next()
+	if &v1[0] != &v2[0] {
+		t.Fatal("Expected reads to return the tree's own value")
+	}
+}
+
+func TestPutOwned(t *testing.T) {
+	bt := NewInMemoryBtree().(*Btree)
+	v1 := []byte{1, 2, 3}
+	bt.PutOwned([]byte{1}, v1)
+	v1[0] = 9
+	if ok, v := bt.Get([]byte{1}); !ok || v[0] != 9 {
+		t.Fatal("Expected the tree to keep the caller's slice, got", ok, v)
+	}
+
+	v2 := []byte{4, 5}
+	if !bt.PutOwned([]byte{1}, v2) {
+		t.Fatal("Expected to replace")
+	}
+	v2[0] = 8
+	if ok, v := bt.Get([]byte{1}); !ok || bytes.Compare(v, []byte{8, 5}) != 0 {
+		t.Fatal("Expected the tree to keep the caller's slice, got", ok, v)
+	}
+	if bt.valueBytes != 2 || bt.deadValueBytes != 3 {
+		t.Fatal("Unexpected accounting", bt.valueBytes, bt.deadValueBytes)
+	}
+
+	v3 := []byte{7}
+	bt.Put([]byte{1}, v3)
+	v3[0] = 6
+	if ok, v := bt.Get([]byte{1}); !ok || bytes.Compare(v, []byte{7}) != 0 {
+		t.Fatal("Expected Put to copy, got", ok, v)
+	}
+}
+
+func benchmarkLoad(b *testing.B, put func(index *Btree, k, v []byte) bool) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		index := NewInMemoryBtree().(*Btree)
+		for j := 0; j < 100000; j++ {
+			k := []byte{byte(j >> 16), byte(j >> 8), byte(j)}
+			v := make([]byte, 16)
+			put(index, k, v)
+		}
+	}
+}
+
+func BenchmarkLoadPut(b *testing.B) {
+	benchmarkLoad(b, (*Btree).Put)
+}
+
+func BenchmarkLoadPutOwned(b *testing.B) {
+	benchmarkLoad(b, (*Btree).PutOwned)
+}
+
+func benchmarkLoadEntries(b *testing.B, opts Options) {
+	const n = 10000000
+	b.ReportAllocs()
+	k := make([]byte, 4)
+	v := make([]byte, 8)
+	for i := 0; i < b.N; i++ {
+		index := NewInMemoryBtreeWithOptions(opts).(*Btree)
+		for j := 0; j < n; j++ {
+			binary.BigEndian.PutUint32(k, uint32(j))
+			index.Put(k, v)
+		}
+	}
+}
+
+func BenchmarkLoad10M(b *testing.B) {
+	benchmarkLoadEntries(b, Options{})
+}
+
+func BenchmarkLoad10MExpectedEntries(b *testing.B) {
+	benchmarkLoadEntries(b, Options{ExpectedEntries: 10000000})
+}
+
+func TestMaxValueSize(t *testing.T) {
+	bt := NewInMemoryBtreeWithOptions(Options{MaxValueSize: 4}).(*Btree)
+	expectPanic := func(name string, f func()) {
+		defer func() {
+			if r := recover(); r != ErrValueTooLarge {
+				t.Error("Expected", name, "to panic with ErrValueTooLarge, got", r)
+			}
+		}()
+		f()
+	}
+
+	if _, err := bt.PutE([]byte{1}, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatal("Expected a value at the limit to go in, got", err)
+	}
+	if _, err := bt.PutE([]byte{2}, []byte{1, 2, 3, 4, 5}); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatal("Expected ErrValueTooLarge, got", err)
+	}
+	if err := bt.AppendE([]byte{1}, []byte{5}); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatal("Expected ErrValueTooLarge, got", err)
+	}
+	if err := bt.AppendE([]byte{3}, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bt.AppendE([]byte{3}, []byte{3, 4}); err != nil {
+		t.Fatal("Expected to append up to the limit, got", err)
+	}
+	if err := bt.AppendE([]byte{3}, []byte{5}); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatal("Expected ErrValueTooLarge, got", err)
+	}
+
+	expectPanic("Put", func() { bt.Put([]byte{4}, make([]byte, 5)) })
+	expectPanic("PutOwned", func() { bt.PutOwned([]byte{4}, make([]byte, 5)) })
+	expectPanic("Append", func() { bt.Append([]byte{1}, []byte{5}) })
+	expectPanic("PutNext", func() { bt.PutNext([]byte{9}, make([]byte, 5)) })
+
+	if ok, v := bt.Get([]byte{1}); !ok || len(v) != 4 {
+		t.Fatal("Expected the value to be left as it was, got", v)
+	}
+	if ok, v := bt.Get([]byte{3}); !ok || bytes.Compare(v, []byte{1, 2, 3, 4}) != 0 {
+		t.Fatal("Expected the appended value, got", v)
+	}
+	if bt.Size() != 2 {
+		t.Fatal("Expected 2 keys, got", bt.Size())
+	}
+
+	unlimited := NewInMemoryBtree().(*Btree)
+	if _, err := unlimited.PutE([]byte{1}, make([]byte, 3*pageSize)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValueLogOrder(t *testing.T) {
+	bt := NewBtree()
+	bt.Put([]byte("b"), []byte("1"))
+	bt.Put([]byte("a"), []byte("2"))
+	bt.Put([]byte("c"), []byte("3"))
+	bt.Put([]byte("b"), []byte("4"))
+	bt.Delete([]byte("c"))
+	bt.Put([]byte("a"), bytes.Repeat([]byte{5}, overflowThreshold+1))
+	bt.Put([]byte("d"), []byte("6"))
+
+	var got []string
+	next := bt.ValueLogOrder()
+	for {
+		ok, k, v := next()
+		if !ok {
+			break
+		}
+		got = append(got, fmt.Sprintf("%s=%s", k, v))
+	}
+	want := []string{"b=4", "=", "=", "d=6"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatal("Expected", want, "got", got)
+	}
+}
+
+func TestValueSegments(t *testing.T) {
+	bt := NewBtreeWithOptions(Options{ValueSegmentSize: 10, ExpectedEntries: 25})
+	for i := 0; i < 100; i++ {
+		bt.Put([]byte(fmt.Sprint(i)), []byte(fmt.Sprint("v", i)))
+	}
+	for i := 0; i < 100; i += 3 {
+		bt.Put([]byte(fmt.Sprint(i)), []byte(fmt.Sprint("w", i)))
+	}
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(bt.values.segs); n != 10 {
+		t.Fatal("Expected 10 segments, got", n)
+	}
+	for i := 0; i < 100; i++ {
+		want := fmt.Sprint("v", i)
+		if i%3 == 0 {
+			want = fmt.Sprint("w", i)
+		}
+		if ok, v := bt.Get([]byte(fmt.Sprint(i))); !ok || string(v) != want {
+			t.Fatal("Expected", want, "got", ok, string(v))
+		}
+	}
+}
+
+// Reports the slowest Put, which is the one that grows the value log
+// the most.
+func benchmarkLoadLatency(b *testing.B, opts Options) {
+	const n = 50000000
+	k := make([]byte, 4)
+	v := make([]byte, 8)
+	var slowest time.Duration
+	for i := 0; i < b.N; i++ {
+		index := NewBtreeWithOptions(opts)
+		for j := 0; j < n; j++ {
+			binary.BigEndian.PutUint32(k, uint32(j))
+			start := time.Now()
+			index.Put(k, v)
+			if d := time.Since(start); d > slowest {
+				slowest = d
+			}
+		}
+	}
+	b.ReportMetric(float64(slowest.Microseconds()), "max-put-us")
+}
+
+func BenchmarkLoad50MLatency(b *testing.B) {
+	benchmarkLoadLatency(b, Options{})
+}
+
+func BenchmarkLoad50MLatencyOneSegment(b *testing.B) {
+	benchmarkLoadLatency(b, Options{ValueSegmentSize: 50000000})
+}
+
+func TestGetSegments(t *testing.T) {
+	for _, opts := range []Options{{}, {ShareValues: true}} {
+		bt := NewBtreeWithOptions(opts)
+		big := make([]byte, 3*pageSize+17)
+		for i := range big {
+			big[i] = byte(i)
+		}
+		bt.Put([]byte("big"), big)
+		bt.Put([]byte("small"), []byte{1, 2})
+
+		segments, ok := bt.GetSegments([]byte("big"))
+		if !ok || len(segments) != 4 || !bytes.Equal(bytes.Join(segments, nil), big) {
+			t.Fatal("Expected the large value in 4 segments, got", ok, len(segments))
+		}
+		segments[0][0] = 99
+		if _, v := bt.Get([]byte("big")); (v[0] == 99) != opts.ShareValues {
+			t.Fatal("Expected the segments to be copies unless ShareValues, got", v[0])
+		}
+
+		segments, ok = bt.GetSegments([]byte("small"))
+		if !ok || len(segments) != 1 || !bytes.Equal(segments[0], []byte{1, 2}) {
+			t.Fatal("Expected a small value in one segment, got", ok, segments)
+		}
+		if _, ok := bt.GetSegments([]byte("none")); ok {
+			t.Fatal("Did not expect to find a missing key")
+		}
+	}
+}
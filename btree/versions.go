@@ -0,0 +1,106 @@
+package btree
+
+import "sort"
+
+// A value a key had in a Versioned tree, or tombstone if it was
+// deleted, and the sequence number of the write.
+type version struct {
+	seq uint64
+	ref int
+}
+
+// The sequence number of the last write to a Versioned tree, 0 if
+// there were none. Read it after a write to tell GetAsOf to look at
+// the tree as it was then.
+func (b *Btree) Seq() uint64 {
+	return b.seq
+}
+
+// Record a write of ref, or tombstone, to key under the next sequence
+// number.
+func (b *Btree) stamp(key []byte, ref int) {
+	if b.versions == nil {
+		return
+	}
+	b.seq++
+	b.versions[string(key)] = append(b.versions[string(key)], version{b.seq, ref})
+}
+
+// The index of the last of versions written at or before seq, -1 if
+// there is none.
+func versionAt(versions []version, seq uint64) int {
+	return sort.Search(len(versions), func(i int) bool { return versions[i].seq > seq }) - 1
+}
+
+// Get the value key had right after the write with sequence number
+// seq. ok is false if key did not exist then, if Compact dropped the
+// value since, or if the tree is not Versioned.
+func (b *Btree) GetAsOf(key []byte, seq uint64) (ok bool, value []byte) {
+	if key == nil || len(key) == 0 {
+		panic("Illegal key nil")
+	}
+
+	versions := b.versions[string(key)]
+	i := versionAt(versions, seq)
+	if i < 0 || versions[i].ref == tombstone {
+		return false, nil
+	}
+	return true, b.readValue(nil, versions[i].ref)
+}
+
+// Drop the versions that GetAsOf no longer needs to read the tree at
+// watermark or later: for each key all but the last version written
+// at or before watermark, and that one too if the key was deleted.
+// Returns the number of versions dropped. Their values count as dead
+// until the next Sweep.
+func (b *Btree) Compact(watermark uint64) (dropped int) {
+	for key, versions := range b.versions {
+		i := versionAt(versions, watermark)
+		if i < 0 {
+			continue
+		}
+		if versions[i].ref == tombstone {
+			i++
+		}
+		for _, v := range versions[:i] {
+			if v.ref != tombstone {
+				b.dropValue(v.ref)
+			}
+		}
+		dropped += i
+		if i == len(versions) {
+			delete(b.versions, key)
+		} else if i > 0 {
+			b.versions[key] = append([]version(nil), versions[i:]...)
+		}
+	}
+	return
+}
+
+// Store the versions of b in fresh, a copy of b's live keys that Sweep
+// built. The last version of a live key is the one in its leaf.
+func (b *Btree) sweepVersions(fresh *Btree) {
+	fresh.versions = make(map[string][]version, len(b.versions))
+	for key, versions := range b.versions {
+		moved := make([]version, len(versions))
+		for i, v := range versions {
+			moved[i] = v
+			if v.ref == tombstone {
+				continue
+			}
+			if i == len(versions)-1 {
+				// the leaf's value, unless the key expired and
+				// the copy left it out
+				if ok, k, _ := fresh.search([]byte(key)); ok {
+					moved[i].ref = k.Ref()
+				} else {
+					moved[i].ref = fresh.storeValue(b.value(nil, v.ref), true)
+				}
+			} else {
+				moved[i].ref = fresh.storeValue(b.value(nil, v.ref), true)
+			}
+		}
+		fresh.versions[key] = moved
+	}
+	fresh.seq = b.seq
+}
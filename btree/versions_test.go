@@ -0,0 +1,88 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestVersioned(t *testing.T) {
+	bt := NewInMemoryBtreeWithOptions(Options{Versioned: true}).(*Btree)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%04d", i)) }
+	value := func(i, v int) []byte { return []byte(fmt.Sprintf("%d.%d", i, v)) }
+
+	// seqs[v] is the sequence number after writing version v of
+	// every key
+	var seqs []uint64
+	for v := 0; v < 4; v++ {
+		for i := 0; i < 1000; i++ {
+			bt.Put(key(i), value(i, v))
+		}
+		seqs = append(seqs, bt.Seq())
+	}
+	for i := 0; i < 1000; i += 2 {
+		bt.Delete(key(i))
+	}
+	deleted := bt.Seq()
+	bt.Append(key(1), []byte("+"))
+	big := bytes.Repeat([]byte{7}, 3*pageSize)
+	bt.Put(key(3), big)
+	bt.Put(key(3), []byte("small"))
+
+	check := func(name string, from int) {
+		for v := from; v < 4; v++ {
+			for i := 0; i < 1000; i++ {
+				ok, got := bt.GetAsOf(key(i), seqs[v])
+				if !ok || !bytes.Equal(got, value(i, v)) {
+					t.Fatal(name, "expected", string(value(i, v)), "got", ok, string(got))
+				}
+			}
+		}
+		if ok, _ := bt.GetAsOf(key(2), deleted); ok {
+			t.Fatal(name, "did not expect a deleted key")
+		}
+		if ok, v := bt.GetAsOf(key(1), bt.Seq()); !ok || string(v) != "1.3+" {
+			t.Fatal(name, "expected the appended value, got", string(v))
+		}
+		if ok, v := bt.GetAsOf(key(3), bt.Seq()-1); !ok || !bytes.Equal(v, big) {
+			t.Fatal(name, "expected the value in overflow pages, got", len(v))
+		}
+		if ok, v := bt.Get(key(3)); !ok || string(v) != "small" {
+			t.Fatal(name, "expected the latest value, got", string(v))
+		}
+	}
+	check("before Compact", 0)
+	if ok, _ := bt.GetAsOf(key(1), 0); ok {
+		t.Fatal("Did not expect a value before the first write")
+	}
+
+	bt.Sweep()
+	check("after Sweep", 0)
+	bt.Defrag()
+	check("after Defrag", 0)
+
+	// drops versions 0 and 1 of every key
+	if n := bt.Compact(seqs[2]); n != 2000 {
+		t.Fatal("Expected to drop 2000 versions, got", n)
+	}
+	check("after Compact", 2)
+	if ok, _ := bt.GetAsOf(key(1), seqs[1]); ok {
+		t.Fatal("Did not expect a compacted version")
+	}
+	bt.Sweep()
+	check("after Compact and Sweep", 2)
+
+	// drops the deleted keys and versions 2 of the others
+	if n := bt.Compact(deleted); n != 500*3+500 {
+		t.Fatal("Expected to drop 2000 versions, got", n)
+	}
+	if len(bt.versions) != 500 {
+		t.Fatal("Expected versions of 500 keys, got", len(bt.versions))
+	}
+	if ok, v := bt.GetAsOf(key(5), deleted); !ok || !bytes.Equal(v, value(5, 3)) {
+		t.Fatal("Expected the last version, got", string(v))
+	}
+	if err := bt.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,72 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Buffers keys put in increasing order and adds them to the tree in
+// batches with the bulk put of PutNext, descending the tree once per
+// leaf instead of once per key. Keys must be strictly increasing and
+// go after all the keys in the tree, as with PutNext. Buffered keys
+// are not in the tree until Flush or Close.
+type SortedWriter struct {
+	b      *Btree
+	n      int
+	keys   [][]byte
+	values [][]byte
+	last   []byte
+	closed bool
+}
+
+// A SortedWriter that flushes every n keys.
+func (b *Btree) NewSortedWriter(n int) *SortedWriter {
+	if n < 1 {
+		n = 1
+	}
+	return &SortedWriter{b: b, n: n, keys: make([][]byte, 0, n), values: make([][]byte, 0, n)}
+}
+
+// Buffer a copy of key and value, flushing if the buffer is full.
+// Panics like PutNext does on keys and values the tree does not take,
+// and on keys that do not go after the one put before.
+func (w *SortedWriter) Put(key, value []byte) {
+	if w.closed {
+		panic("Put on a closed SortedWriter")
+	}
+	if key == nil || len(key) == 0 || value == nil {
+		panic("Illegal nil key or value")
+	}
+	if err := checkKeySize(key); err != nil {
+		panic(err)
+	}
+	if err := w.b.checkValueSize(len(value)); err != nil {
+		panic(err)
+	}
+	if w.last != nil && bytes.Compare(w.last, key) >= 0 {
+		panic(fmt.Sprint("out of order put:", key))
+	}
+
+	w.last = copyBytes(key)
+	w.keys, w.values = append(w.keys, w.last), append(w.values, copyBytes(value))
+	if len(w.keys) >= w.n {
+		w.Flush()
+	}
+}
+
+// Add the buffered keys to the tree.
+func (w *SortedWriter) Flush() {
+	if len(w.keys) == 0 {
+		return
+	}
+	w.b.putNextOwned(w.keys, w.values)
+	clear(w.keys)
+	clear(w.values)
+	w.keys, w.values = w.keys[:0], w.values[:0]
+}
+
+// Flush, and stop taking keys.
+func (w *SortedWriter) Close() {
+	w.Flush()
+	w.closed = true
+}
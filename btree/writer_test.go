@@ -0,0 +1,50 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+func TestSortedWriter(t *testing.T) {
+	for _, opts := range []Options{{}, {InlineValues: 8}, {Versioned: true}} {
+		bt := NewBtreeWithOptions(opts)
+		w := bt.NewSortedWriter(100)
+		k := make([]byte, 4)
+		for i := 0; i < 10050; i++ {
+			binary.BigEndian.PutUint32(k, uint32(i))
+			w.Put(k, k[2:])
+			if i == 149 && bt.Size() != 100 {
+				t.Fatal("Expected a flush every 100 keys, got", bt.Size())
+			}
+		}
+		w.Close()
+
+		if err := bt.CheckConsistency(); err != nil {
+			t.Fatal(err)
+		}
+		if bt.Size() != 10050 {
+			t.Fatal("Expected all keys, got", bt.Size())
+		}
+		for i := 0; i < 10050; i++ {
+			binary.BigEndian.PutUint32(k, uint32(i))
+			if ok, v := bt.Get(k); !ok || string(v) != string(k[2:]) {
+				t.Fatal("Expected", k[2:], "got", ok, v)
+			}
+		}
+	}
+
+	bt := NewBtree()
+	w := bt.NewSortedWriter(10)
+	w.Put([]byte("b"), []byte{1})
+	for _, key := range []string{"b", "a"} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil || fmt.Sprint(r)[:12] != "out of order" {
+					t.Error("Expected", key, "to be out of order, got", r)
+				}
+			}()
+			w.Put([]byte(key), []byte{1})
+		}()
+	}
+}
@@ -6,6 +6,11 @@ type Iter interface {
 	// return consecutive keys and values. ok is false (key abd
 	// value are nil) when done.
 	Next() (ok bool, key []byte, value []byte)
+
+	// true once Next returned false because there is nothing left.
+	// An iterator that can stop early, e.g. on an error, stays
+	// false when it does, so that callers can tell the two apart.
+	Done() bool
 }
 
 // Read-only index